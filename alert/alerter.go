@@ -2,6 +2,7 @@ package alert
 
 import (
 	"fmt"
+	"math"
 	"net/http"
 	"strings"
 	"time"
@@ -18,56 +19,76 @@ const (
 	PredLowGlucoseEvent     = "pred_low_glucose"
 	HighGlucoseEvent        = "high_glucose"
 	MissingLongInsulinEvent = "missing_long_insulin"
+	InvalidCredentialsEvent = "invalid_credentials_alert"
+	MeterDiscrepancyEvent   = "meter_discrepancy"
+	HighKetonesEvent        = "high_ketones"
 
 	PredLowGlucoseWindow     = 5 * time.Minute
 	HighGlucoseWindow        = 45 * time.Minute
 	MissingLongInsulinWindow = 1 * time.Hour
+	InvalidCredentialsWindow = 6 * time.Hour
+	MeterDiscrepancyWindow   = 30 * time.Minute
+	HighKetonesWindow        = 2 * time.Hour
+
+	ntfyUrl = "https://ntfy.sh/"
 )
 
 type AlertingReadWriter interface {
-	ReadGlucosePoints(startTs, endTs int) ([]store.GlucosePoint, error)
-	ReadInsulinPoints(startTs, endTs int) ([]store.InsulinPoint, error)
-	ReadCarbPoints(startTs, endTs int) ([]store.CarbPoint, error)
+	ReadGlucosePoints(startTs, endTs int, opts ...store.ReadOption) ([]store.GlucosePoint, error)
+	ReadInsulinPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.InsulinPoint, error)
+	ReadCarbPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.CarbPoint, error)
 	WriteEventPoint(point store.EventPoint) error
-	ReadEventPoints(startTs, endTs int) ([]store.EventPoint, error)
+	ReadEventPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.EventPoint, error)
+	ReadMeterPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.MeterPoint, error)
+	ReadKetonePoints(startTs, endTs int, opts ...store.ReadOption) ([]store.KetonePoint, error)
 }
 
 type Alerter struct {
 	rw AlertingReadWriter
 
 	// Configs.
+	ntfyUrl              string
 	unit                 string
 	insPeriodType        map[string]string
 	endpoint             string
 	missingLongThreshold time.Duration
 	lowThreshold         int
 	highThreshold        int
+	ketoneThreshold      float64
 
 	logger *zap.Logger
 }
 
 func NewAlerter(rw AlertingReadWriter, cfg config.Iv3Config,
+	insCfg []config.InsulinConfig, logger *zap.Logger) *Alerter {
+	a := newAlerter(rw, cfg, insCfg, logger)
+	logger.Info("started Alerter",
+		zap.Duration("missingLongThreshold", a.missingLongThreshold),
+		zap.Int("lowThreshold", a.lowThreshold),
+	)
+
+	go a.run()
+	return a
+}
+
+// newAlerter is NewAlerter without the checks running in the background.
+func newAlerter(rw AlertingReadWriter, cfg config.Iv3Config,
 	insCfg []config.InsulinConfig, logger *zap.Logger) *Alerter {
 	a := &Alerter{
 		rw:                   rw,
+		ntfyUrl:              ntfyUrl,
 		unit:                 cfg.Unit,
 		insPeriodType:        make(map[string]string),
 		endpoint:             cfg.Endpoint,
 		missingLongThreshold: time.Duration(cfg.MissingLongThreshold) * time.Hour,
 		lowThreshold:         cfg.LowThreshold,
 		highThreshold:        cfg.HighThreshold,
+		ketoneThreshold:      cfg.KetoneThreshold,
 		logger:               logger,
 	}
 	for _, ins := range insCfg {
 		a.insPeriodType[ins.Name] = ins.PeriodType
 	}
-
-	logger.Info("started Alerter",
-		zap.Duration("missingLongThreshold", a.missingLongThreshold),
-		zap.Int("lowThreshold", a.lowThreshold),
-	)
-
-	go a.run()
 	return a
 }
 
@@ -77,6 +98,9 @@ func (a *Alerter) run() {
 		a.checkPredictedGlucose()
 		a.checkMissingLongInsulin()
 		a.checkHighGlucose()
+		a.checkInvalidCredentials()
+		a.checkMeterDiscrepancy()
+		a.checkHighKetones()
 	}
 }
 
@@ -101,6 +125,12 @@ func (a *Alerter) checkPredictedGlucose() {
 	lastPoints := points[len(points)-3:]
 	trend := (lastPoints[2].Value - lastPoints[0].Value) / 2
 	predValue := lastPoints[2].Value + trend*4
+
+	// The sensor's own trend is coarser, but reacts quicker to sudden drops,
+	// so take whichever prediction is lower.
+	if rate, ok := lastPoints[2].Trend.Rate(); ok {
+		predValue = min(predValue, lastPoints[2].Value+rate*20)
+	}
 	a.logger.Debug("predicted glucose", zap.Float64("value", predValue))
 
 	if predValue < float64(a.lowThreshold) &&
@@ -196,23 +226,142 @@ func (a *Alerter) checkHighGlucose() {
 	}
 }
 
+func (a *Alerter) checkInvalidCredentials() {
+	// The fetcher records an event whenever it gives up on logging in.
+	if a.noEventsInPast(store.InvalidCredentialsEvent, time.Hour) {
+		return
+	}
+	if !a.noEventsInPast(InvalidCredentialsEvent, InvalidCredentialsWindow) {
+		return
+	}
+
+	alert := Alert{
+		Title:    "Invalid Credentials",
+		Event:    InvalidCredentialsEvent,
+		Message:  "Unable to log into Dexcom Share, check that the account and password are correct",
+		Priority: "high",
+	}
+	if err := a.publishAlert(alert); err != nil {
+		a.logger.Error("unable to publish alert", zap.Error(err))
+	}
+}
+
+// checkMeterDiscrepancy compares the latest fingerstick with the sensor
+// reading closest to it, to catch a sensor that needs calibrating. The
+// difference allowed is 20 mg/dL below 100 mg/dL and 20% above, same as
+// the usual accuracy standard for CGMs.
+func (a *Alerter) checkMeterDiscrepancy() {
+	windowStart := time.Now().Add(-15 * time.Minute)
+	windowEnd := time.Now().Add(time.Second)
+
+	meter, err := a.rw.ReadMeterPoints(
+		int(windowStart.Unix()),
+		int(windowEnd.Unix()),
+		store.Descending(),
+		store.WithLimit(1),
+	)
+	if err != nil {
+		a.logger.Error("error reading meter points", zap.Error(err))
+		return
+	}
+	if len(meter) == 0 {
+		return
+	}
+
+	points, err := a.rw.ReadGlucosePoints(
+		int(meter[0].Time.Add(-5*time.Minute).Unix()),
+		int(meter[0].Time.Add(5*time.Minute).Unix())+1,
+	)
+	if err != nil {
+		a.logger.Error("error reading glucose points", zap.Error(err))
+		return
+	}
+	if len(points) == 0 {
+		return
+	}
+	closest := points[0]
+	for _, point := range points[1:] {
+		if point.Time.Sub(meter[0].Time).Abs() < closest.Time.Sub(meter[0].Time).Abs() {
+			closest = point
+		}
+	}
+
+	diff := math.Abs(closest.Value - meter[0].Value)
+	allowed := 20.0
+	if meter[0].Value >= 100 {
+		allowed = meter[0].Value * 0.2
+	}
+	if diff <= allowed {
+		return
+	}
+	if !a.noEventsInPast(MeterDiscrepancyEvent, MeterDiscrepancyWindow) {
+		return
+	}
+
+	alert := Alert{
+		Title: "Sensor Disagrees With Meter",
+		Event: MeterDiscrepancyEvent,
+		Message: fmt.Sprintf("Meter read %.1f but the sensor read %.1f, consider calibrating",
+			a.molarOrMass(meter[0].Value),
+			a.molarOrMass(closest.Value),
+		),
+		Priority: "default",
+	}
+	if err = a.publishAlert(alert); err != nil {
+		a.logger.Error("unable to publish alert", zap.Error(err))
+	}
+}
+
+func (a *Alerter) checkHighKetones() {
+	windowStart := time.Now().Add(-HighKetonesWindow)
+	windowEnd := time.Now().Add(time.Second)
+
+	ketones, err := a.rw.ReadKetonePoints(
+		int(windowStart.Unix()),
+		int(windowEnd.Unix()),
+		store.Descending(),
+		store.WithLimit(1),
+	)
+	if err != nil {
+		a.logger.Error("error reading ketone points", zap.Error(err))
+		return
+	}
+	if len(ketones) == 0 || ketones[0].Value < a.ketoneThreshold {
+		return
+	}
+	if !a.noEventsInPast(HighKetonesEvent, HighKetonesWindow) {
+		return
+	}
+
+	alert := Alert{
+		Title: "High Ketones",
+		Event: HighKetonesEvent,
+		Message: fmt.Sprintf("Ketones are %.1f mmol/L and above %.1f mmol/L",
+			ketones[0].Value,
+			a.ketoneThreshold,
+		),
+		Priority: "high",
+	}
+	if err = a.publishAlert(alert); err != nil {
+		a.logger.Error("unable to publish alert", zap.Error(err))
+	}
+}
+
 func (a *Alerter) noEventsInPast(event string, d time.Duration) bool {
-	windowStart, windowEnd := time.Now().Add(-d), time.Now()
+	// Reads end before the given second, so round up to include events
+	// written just now.
+	windowStart, windowEnd := time.Now().Add(-d), time.Now().Add(time.Second)
 	points, err := a.rw.ReadEventPoints(
 		int(windowStart.Unix()),
 		int(windowEnd.Unix()),
+		store.WithEvent(event),
+		store.WithLimit(1),
 	)
 	if err != nil {
 		a.logger.Error("error reading event points", zap.Error(err))
 		return false
 	}
-
-	for _, point := range points {
-		if point.Event == event {
-			return false
-		}
-	}
-	return true
+	return len(points) == 0
 }
 
 type Alert struct {
@@ -225,7 +374,7 @@ type Alert struct {
 
 func (a *Alerter) publishAlert(alert Alert) error {
 	req, err := http.NewRequest("POST",
-		"https://ntfy.sh/"+a.endpoint,
+		a.ntfyUrl+a.endpoint,
 		strings.NewReader(alert.Message),
 	)
 	if err != nil {
@@ -0,0 +1,293 @@
+package alert
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/algao1/iv3/config"
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+// ntfyRecorder stands in for ntfy, and records the published alerts.
+type ntfyRecorder struct {
+	mu     sync.Mutex
+	alerts []Alert
+}
+
+func (n *ntfyRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.alerts = append(n.alerts, Alert{
+		Title:    r.Header.Get("Title"),
+		Message:  string(body),
+		Priority: r.Header.Get("Priority"),
+	})
+}
+
+func (n *ntfyRecorder) titles() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	titles := make([]string, len(n.alerts))
+	for i, alert := range n.alerts {
+		titles[i] = alert.Title
+	}
+	return titles
+}
+
+func newTestAlerter(t *testing.T, st *store.MemoryStore) (*Alerter, *ntfyRecorder) {
+	t.Helper()
+	ntfy := &ntfyRecorder{}
+	srv := httptest.NewServer(ntfy)
+	t.Cleanup(srv.Close)
+
+	cfg := config.Iv3Config{
+		Unit:                 "mg/dL",
+		Endpoint:             "test",
+		MissingLongThreshold: 24,
+		HighThreshold:        180,
+		LowThreshold:         70,
+		KetoneThreshold:      1.5,
+	}
+	insCfg := []config.InsulinConfig{
+		{Name: "Humalog", PeriodType: "rapid"},
+		{Name: "Tresiba", PeriodType: "long"},
+	}
+	a := newAlerter(st, cfg, insCfg, zap.NewNop())
+	a.ntfyUrl = srv.URL + "/"
+	return a, ntfy
+}
+
+// writeGlucose writes readings 5 minutes apart, with the last one a
+// minute ago.
+func writeGlucose(t *testing.T, st *store.MemoryStore, values ...float64) {
+	t.Helper()
+	now := time.Now()
+	glucose := make([]store.GlucosePoint, len(values))
+	for i, v := range values {
+		glucose[i] = store.GlucosePoint{
+			Value: v,
+			Trend: store.TrendFlat,
+			Time:  now.Add(-time.Minute - time.Duration(len(values)-1-i)*5*time.Minute),
+		}
+	}
+	if err := st.WriteGlucosePoints(glucose); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckPredictedGlucose(t *testing.T) {
+	st := store.NewMemoryStore()
+	a, ntfy := newTestAlerter(t, st)
+	writeGlucose(t, st, 120, 105, 90)
+
+	a.checkPredictedGlucose()
+	if got := ntfy.titles(); len(got) != 1 || got[0] != "Incoming Low Glucose" {
+		t.Fatalf("expected a predicted low alert, got %v", got)
+	}
+
+	// The alert is recorded, so it is not sent again right away.
+	a.checkPredictedGlucose()
+	if got := ntfy.titles(); len(got) != 1 {
+		t.Fatalf("expected the alert to be sent once, got %v", got)
+	}
+}
+
+func TestCheckPredictedGlucoseSteady(t *testing.T) {
+	st := store.NewMemoryStore()
+	a, ntfy := newTestAlerter(t, st)
+	writeGlucose(t, st, 110, 110, 110)
+
+	a.checkPredictedGlucose()
+	if got := ntfy.titles(); len(got) != 0 {
+		t.Fatalf("expected no alerts, got %v", got)
+	}
+}
+
+func TestCheckPredictedGlucoseUsesTrend(t *testing.T) {
+	st := store.NewMemoryStore()
+	a, ntfy := newTestAlerter(t, st)
+	writeGlucose(t, st, 110, 110, 110)
+
+	// The readings are flat, but the sensor says it is dropping quickly.
+	latest, err := st.ReadLatestGlucosePoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest.Trend = store.TrendDoubleDown
+	if err = st.WriteGlucosePoints([]store.GlucosePoint{*latest}); err != nil {
+		t.Fatal(err)
+	}
+
+	a.checkPredictedGlucose()
+	if got := ntfy.titles(); len(got) != 1 {
+		t.Fatalf("expected a predicted low alert, got %v", got)
+	}
+}
+
+func TestCheckHighGlucose(t *testing.T) {
+	st := store.NewMemoryStore()
+	a, ntfy := newTestAlerter(t, st)
+	writeGlucose(t, st, 200)
+
+	a.checkHighGlucose()
+	a.checkHighGlucose()
+	if got := ntfy.titles(); len(got) != 1 || got[0] != "High Glucose" {
+		t.Fatalf("expected a single high glucose alert, got %v", got)
+	}
+
+	events, err := st.ReadEventPoints(0, int(time.Now().Add(time.Minute).Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Event != HighGlucoseEvent {
+		t.Fatalf("expected a high glucose event, got %v", events)
+	}
+}
+
+func TestCheckMissingLongInsulin(t *testing.T) {
+	st := store.NewMemoryStore()
+	a, ntfy := newTestAlerter(t, st)
+
+	// Rapid insulin does not count.
+	err := st.WriteInsulinPoint(store.InsulinPoint{
+		Value: 4,
+		Type:  "Humalog",
+		Time:  time.Now().Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.checkMissingLongInsulin()
+	if got := ntfy.titles(); len(got) != 1 || got[0] != "Missing Long Insulin" {
+		t.Fatalf("expected a missing long insulin alert, got %v", got)
+	}
+}
+
+func TestCheckMissingLongInsulinTaken(t *testing.T) {
+	st := store.NewMemoryStore()
+	a, ntfy := newTestAlerter(t, st)
+
+	err := st.WriteInsulinPoint(store.InsulinPoint{
+		Value: 20,
+		Type:  "Tresiba",
+		Time:  time.Now().Add(-12 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.checkMissingLongInsulin()
+	if got := ntfy.titles(); len(got) != 0 {
+		t.Fatalf("expected no alerts, got %v", got)
+	}
+}
+
+func TestCheckInvalidCredentials(t *testing.T) {
+	st := store.NewMemoryStore()
+	a, ntfy := newTestAlerter(t, st)
+
+	a.checkInvalidCredentials()
+	if got := ntfy.titles(); len(got) != 0 {
+		t.Fatalf("expected no alerts, got %v", got)
+	}
+
+	err := st.WriteEventPoint(store.EventPoint{
+		Event: store.InvalidCredentialsEvent,
+		Time:  time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.checkInvalidCredentials()
+	a.checkInvalidCredentials()
+	if got := ntfy.titles(); len(got) != 1 || got[0] != "Invalid Credentials" {
+		t.Fatalf("expected a single invalid credentials alert, got %v", got)
+	}
+}
+
+func TestCheckMeterDiscrepancy(t *testing.T) {
+	tests := []struct {
+		cgm, meter float64
+		alert      bool
+	}{
+		// Within 20 mg/dL below 100.
+		{cgm: 80, meter: 95, alert: false},
+		{cgm: 60, meter: 85, alert: true},
+		// Within 20% above 100.
+		{cgm: 230, meter: 200, alert: false},
+		{cgm: 150, meter: 200, alert: true},
+	}
+	for _, tt := range tests {
+		st := store.NewMemoryStore()
+		a, ntfy := newTestAlerter(t, st)
+		writeGlucose(t, st, 180, tt.cgm)
+		err := st.WriteMeterPoint(store.MeterPoint{Value: tt.meter, Time: time.Now().Add(-2 * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a.checkMeterDiscrepancy()
+		a.checkMeterDiscrepancy()
+		got := ntfy.titles()
+		if tt.alert && (len(got) != 1 || got[0] != "Sensor Disagrees With Meter") {
+			t.Errorf("cgm %v, meter %v: expected a single discrepancy alert, got %v", tt.cgm, tt.meter, got)
+		}
+		if !tt.alert && len(got) != 0 {
+			t.Errorf("cgm %v, meter %v: expected no alerts, got %v", tt.cgm, tt.meter, got)
+		}
+	}
+}
+
+func TestCheckMeterDiscrepancyNoSensor(t *testing.T) {
+	st := store.NewMemoryStore()
+	a, ntfy := newTestAlerter(t, st)
+	err := st.WriteMeterPoint(store.MeterPoint{Value: 40, Time: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.checkMeterDiscrepancy()
+	if got := ntfy.titles(); len(got) != 0 {
+		t.Fatalf("expected no alerts without a sensor reading, got %v", got)
+	}
+}
+
+func TestCheckHighKetones(t *testing.T) {
+	st := store.NewMemoryStore()
+	a, ntfy := newTestAlerter(t, st)
+
+	st.WriteKetonePoint(store.KetonePoint{Value: 0.6, Time: time.Now().Add(-time.Hour)})
+	a.checkHighKetones()
+	if got := ntfy.titles(); len(got) != 0 {
+		t.Fatalf("expected no alerts for normal ketones, got %v", got)
+	}
+
+	st.WriteKetonePoint(store.KetonePoint{Value: 2.1, Time: time.Now().Add(-time.Minute)})
+	a.checkHighKetones()
+	a.checkHighKetones()
+	if got := ntfy.titles(); len(got) != 1 || got[0] != "High Ketones" {
+		t.Fatalf("expected a single high ketones alert, got %v", got)
+	}
+}
+
+func TestAlertsAreScopedToSubject(t *testing.T) {
+	st := store.NewMemoryStore()
+	alice := st.ForSubject("alice").(*store.MemoryStore)
+	bob := st.ForSubject("bob").(*store.MemoryStore)
+
+	a, ntfy := newTestAlerter(t, alice)
+	writeGlucose(t, bob, 250)
+
+	a.checkHighGlucose()
+	if got := ntfy.titles(); len(got) != 0 {
+		t.Fatalf("expected no alerts for alice, got %v", got)
+	}
+}
@@ -0,0 +1,107 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/algao1/iv3/store"
+)
+
+const (
+	// postActivityWindow is how long after an activity ends its curve goes on,
+	// since exercise can keep glucose dropping for hours.
+	postActivityWindow = 4 * time.Hour
+	// baselineWindow is how far before an activity to look for a reading
+	// to use as the baseline.
+	baselineWindow = 15 * time.Minute
+)
+
+// ActivityCurve is the glucose following an activity.
+type ActivityCurve struct {
+	Activity store.ActivityPoint
+	// Baseline is the last reading at or before the start, or 0 if there
+	// is none within baselineWindow.
+	Baseline float64
+	// Nadir is the lowest reading from the start, NadirMinutes after it.
+	Nadir        float64
+	NadirMinutes int
+	// Curve is the average glucose in 5 minute buckets from the start of
+	// the activity until postActivityWindow after its end, or 0 if there
+	// are no readings in a bucket.
+	Curve []float64
+}
+
+// PostActivity returns the glucose curve following each activity that
+// started in [startTs, endTs), so curves can be compared by type and
+// intensity. Options apply to the activities, e.g. store.WithType.
+func (a *Analyzer) PostActivity(startTs, endTs int, opts ...store.ReadOption) ([]ActivityCurve, error) {
+	activity, err := a.reader.ReadActivityPoints(startTs, endTs, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read activity points: %w", err)
+	}
+	curves := make([]ActivityCurve, 0, len(activity))
+	if len(activity) == 0 {
+		return curves, nil
+	}
+
+	// Read the glucose for every activity at once.
+	from, to := activity[0].Time, activity[0].End()
+	for _, act := range activity {
+		if act.Time.Before(from) {
+			from = act.Time
+		}
+		if act.End().After(to) {
+			to = act.End()
+		}
+	}
+	glucosePoints, err := a.reader.ReadGlucosePoints(
+		int(from.Add(-baselineWindow).Unix()),
+		int(to.Add(postActivityWindow).Unix())+1,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read glucose points: %w", err)
+	}
+
+	for _, act := range activity {
+		curves = append(curves, activityCurve(act, glucosePoints))
+	}
+	return curves, nil
+}
+
+func activityCurve(act store.ActivityPoint, glucosePoints []store.GlucosePoint) ActivityCurve {
+	end := act.End().Add(postActivityWindow)
+	curve := ActivityCurve{
+		Activity: act,
+		Curve:    make([]float64, int(end.Sub(act.Time)/(5*time.Minute))+1),
+	}
+	counts := make([]int, len(curve.Curve))
+
+	i := sort.Search(len(glucosePoints), func(i int) bool {
+		return !glucosePoints[i].Time.Before(act.Time.Add(-baselineWindow))
+	})
+	for ; i < len(glucosePoints) && !glucosePoints[i].Time.After(end); i++ {
+		point := glucosePoints[i]
+		if !point.Time.After(act.Time) {
+			curve.Baseline = point.Value
+		}
+		if point.Time.Before(act.Time) {
+			continue
+		}
+
+		bucket := int(point.Time.Sub(act.Time) / (5 * time.Minute))
+		curve.Curve[bucket] += point.Value
+		counts[bucket]++
+		if curve.Nadir == 0 || point.Value < curve.Nadir {
+			curve.Nadir = point.Value
+			curve.NadirMinutes = int(point.Time.Sub(act.Time).Minutes())
+		}
+	}
+
+	for i, count := range counts {
+		if count > 0 {
+			curve.Curve[i] /= float64(count)
+		}
+	}
+	return curve
+}
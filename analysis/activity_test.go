@@ -0,0 +1,72 @@
+package analysis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+func TestPostActivity(t *testing.T) {
+	st := store.NewMemoryStore()
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	st.WriteActivityPoint(store.ActivityPoint{
+		Type:      "run",
+		Intensity: store.IntensityHigh,
+		Duration:  30,
+		Time:      start,
+	})
+	st.WriteActivityPoint(store.ActivityPoint{
+		Type:      "walk",
+		Intensity: store.IntensityLow,
+		Duration:  60,
+		Time:      start.Add(24 * time.Hour),
+	})
+	err := st.WriteGlucosePoints([]store.GlucosePoint{
+		{Value: 150, Time: start.Add(-5 * time.Minute)},
+		{Value: 140, Time: start.Add(5 * time.Minute)},
+		{Value: 90, Time: start.Add(time.Hour)},
+		{Value: 110, Time: start.Add(2 * time.Hour)},
+		// After the window.
+		{Value: 60, Time: start.Add(5 * time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAnalyzer(st, testCfg, zap.NewNop())
+	curves, err := a.PostActivity(int(start.Unix()), int(start.Add(48*time.Hour).Unix()), store.WithType("run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(curves) != 1 || curves[0].Activity.Type != "run" {
+		t.Fatalf("expected only the run, got %+v", curves)
+	}
+
+	curve := curves[0]
+	if curve.Baseline != 150 {
+		t.Errorf("expected a baseline of 150, got %v", curve.Baseline)
+	}
+	if curve.Nadir != 90 || curve.NadirMinutes != 60 {
+		t.Errorf("expected a nadir of 90 after 60 minutes, got %v after %d", curve.Nadir, curve.NadirMinutes)
+	}
+	// 30 minutes of running, then 4 hours.
+	if len(curve.Curve) != (30+4*60)/5+1 {
+		t.Fatalf("expected a bucket for every 5 minutes, got %d", len(curve.Curve))
+	}
+	if curve.Curve[1] != 140 || curve.Curve[12] != 90 || curve.Curve[2] != 0 {
+		t.Errorf("unexpected curve: %v", curve.Curve)
+	}
+}
+
+func TestPostActivityEmpty(t *testing.T) {
+	a := NewAnalyzer(store.NewMemoryStore(), testCfg, zap.NewNop())
+	curves, err := a.PostActivity(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if curves == nil || len(curves) != 0 {
+		t.Errorf("expected no curves, got %+v", curves)
+	}
+}
@@ -0,0 +1,113 @@
+package analysis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/algao1/iv3/store"
+	"github.com/montanaflynn/stats"
+)
+
+// readingInterval is how often the sensor takes a reading.
+const readingInterval = 5 * time.Minute
+
+// AGPResult is an Ambulatory Glucose Profile, the standard report of
+// CGM data for clinicians.
+type AGPResult struct {
+	// Percentile curves over the day, by the wearer's local time, in
+	// 5 minute buckets. Buckets without readings are 0.
+	P5  []float64
+	P25 []float64
+	P50 []float64
+	P75 []float64
+	P95 []float64
+
+	Summary AGPSummary
+}
+
+// AGPSummary is the summary block at the top of the AGP. Fractions are
+// between 0 and 1.
+type AGPSummary struct {
+	Days int
+	// SensorWear is the fraction of the expected readings that were taken.
+	SensorWear float64
+	Mean       float64
+	// GMI is the Glucose Management Indicator, an estimate of A1c (%)
+	// from the mean.
+	GMI float64
+	// CV is the coefficient of variation, the SD over the mean.
+	CV          float64
+	TimeInRange TimeInRange
+}
+
+// AGP computes the Ambulatory Glucose Profile over [startTs, endTs).
+// It is meant for at least 14 days of data.
+func (a *Analyzer) AGP(startTs, endTs int) (*AGPResult, error) {
+	glucosePoints, err := a.reader.ReadGlucosePoints(startTs, endTs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read glucose points: %w", err)
+	}
+
+	buckets := make([][]float64, 24*12)
+	for _, point := range glucosePoints {
+		truncated := point.LocalTime().Truncate(readingInterval)
+		bucket := truncated.Hour()*12 + truncated.Minute()/5
+		buckets[bucket] = append(buckets[bucket], point.Value)
+	}
+
+	result := &AGPResult{
+		P5:  make([]float64, len(buckets)),
+		P25: make([]float64, len(buckets)),
+		P50: make([]float64, len(buckets)),
+		P75: make([]float64, len(buckets)),
+		P95: make([]float64, len(buckets)),
+	}
+	for i, bucket := range buckets {
+		if len(bucket) == 0 {
+			continue
+		}
+		result.P5[i], _ = stats.PercentileNearestRank(bucket, 5)
+		result.P25[i], _ = stats.PercentileNearestRank(bucket, 25)
+		result.P50[i], _ = stats.PercentileNearestRank(bucket, 50)
+		result.P75[i], _ = stats.PercentileNearestRank(bucket, 75)
+		result.P95[i], _ = stats.PercentileNearestRank(bucket, 95)
+	}
+
+	duration := time.Duration(endTs-startTs) * time.Second
+	result.Summary = AGPSummary{
+		Days:        int((duration + 24*time.Hour - 1) / (24 * time.Hour)),
+		SensorWear:  sensorWear(len(glucosePoints), duration),
+		TimeInRange: timeInRange(glucosePoints, a.tiers),
+	}
+	if len(glucosePoints) > 0 {
+		values := glucoseValues(glucosePoints)
+		result.Summary.Mean, _ = stats.Mean(values)
+		sd, _ := stats.StandardDeviation(values)
+		result.Summary.GMI = gmi(result.Summary.Mean)
+		result.Summary.CV = sd / result.Summary.Mean
+	}
+	return result, nil
+}
+
+// gmi estimates A1c (%) from the mean glucose in mg/dL.
+func gmi(mean float64) float64 {
+	return 3.31 + 0.02392*mean
+}
+
+// sensorWear is the fraction of the readings expected over d that were
+// taken, at most 1.
+func sensorWear(readings int, d time.Duration) float64 {
+	expected := int(d / readingInterval)
+	if expected <= 0 {
+		return 0
+	}
+	return min(float64(readings)/float64(expected), 1)
+}
+
+func glucoseValues(glucosePoints []store.GlucosePoint) []float64 {
+	values := make([]float64, len(glucosePoints))
+	for i, point := range glucosePoints {
+		values[i] = point.Value
+	}
+	return values
+}
@@ -0,0 +1,79 @@
+package analysis
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+func TestAGP(t *testing.T) {
+	st := store.NewMemoryStore()
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	// Twenty days with a reading at midnight, from 40 to 230.
+	var glucose []store.GlucosePoint
+	for day := 0; day < 20; day++ {
+		glucose = append(glucose, store.GlucosePoint{
+			Value: float64(40 + 10*day),
+			Time:  start.Add(time.Duration(day) * 24 * time.Hour),
+		})
+	}
+	if err := st.WriteGlucosePoints(glucose); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAnalyzer(st, testCfg, zap.NewNop())
+	result, err := a.AGP(int(start.Unix()), int(start.Add(20*24*time.Hour).Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.P50) != 24*12 {
+		t.Fatalf("expected a bucket for every 5 minutes, got %d", len(result.P50))
+	}
+	want := map[string][2]float64{
+		"P5":  {result.P5[0], 40},
+		"P25": {result.P25[0], 80},
+		"P50": {result.P50[0], 130},
+		"P75": {result.P75[0], 180},
+		"P95": {result.P95[0], 220},
+	}
+	for name, got := range want {
+		if got[0] != got[1] {
+			t.Errorf("expected %s to be %v, got %v", name, got[1], got[0])
+		}
+	}
+	if result.P50[1] != 0 {
+		t.Errorf("expected empty buckets to be 0, got %v", result.P50[1])
+	}
+
+	summary := result.Summary
+	if summary.Days != 20 || summary.Mean != 135 {
+		t.Errorf("expected 20 days with a mean of 135, got %+v", summary)
+	}
+	if math.Abs(summary.GMI-(3.31+0.02392*135)) > 1e-9 {
+		t.Errorf("unexpected GMI: %v", summary.GMI)
+	}
+	if math.Abs(summary.SensorWear-20.0/(20*288)) > 1e-9 {
+		t.Errorf("unexpected sensor wear: %v", summary.SensorWear)
+	}
+	// 40, 50 | 60 | 70..180 | 190..250 | none.
+	tir := summary.TimeInRange
+	if tir.VeryLow.Fraction != 0.1 || tir.Low.Fraction != 0.05 || tir.InRange.Fraction != 0.6 ||
+		tir.High.Fraction != 0.25 || tir.VeryHigh.Fraction != 0 {
+		t.Errorf("unexpected time in range: %+v", tir)
+	}
+}
+
+func TestAGPEmpty(t *testing.T) {
+	a := NewAnalyzer(store.NewMemoryStore(), testCfg, zap.NewNop())
+	result, err := a.AGP(0, 24*60*60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Summary.Mean != 0 || result.Summary.CV != 0 || result.Summary.SensorWear != 0 {
+		t.Errorf("expected an empty summary, got %+v", result.Summary)
+	}
+}
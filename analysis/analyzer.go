@@ -11,9 +11,10 @@ import (
 )
 
 type PointsReader interface {
-	ReadGlucosePoints(startTs, endTs int) ([]store.GlucosePoint, error)
-	ReadInsulinPoints(startTs, endTs int) ([]store.InsulinPoint, error)
-	ReadCarbPoints(startTs, endTs int) ([]store.CarbPoint, error)
+	ReadGlucosePoints(startTs, endTs int, opts ...store.ReadOption) ([]store.GlucosePoint, error)
+	ReadInsulinPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.InsulinPoint, error)
+	ReadCarbPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.CarbPoint, error)
+	ReadActivityPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.ActivityPoint, error)
 }
 
 type Analyzer struct {
@@ -21,21 +22,30 @@ type Analyzer struct {
 
 	lowThreshold  int
 	highThreshold int
+	tiers         config.RangeTiers
 	logger        *zap.Logger
 }
 
 func NewAnalyzer(reader PointsReader, cfg config.Iv3Config, logger *zap.Logger) *Analyzer {
+	tiers := cfg.Tiers
+	if tiers == (config.RangeTiers{}) {
+		tiers = config.DefaultRangeTiers
+	}
 	return &Analyzer{
 		reader:        reader,
 		lowThreshold:  cfg.LowThreshold,
 		highThreshold: cfg.HighThreshold,
+		tiers:         tiers,
 		logger:        logger,
 	}
 }
 
 type DayToDayResult struct {
 	Average float64
+	// InRange is the fraction of readings between the low and high
+	// thresholds, Tiers breaks it down by the range tiers.
 	InRange float64
+	Tiers   TimeInRange
 	DtdAvg  []float64
 }
 
@@ -50,7 +60,8 @@ func (a *Analyzer) DayToDay(startTs, endTs int) (*DayToDayResult, error) {
 	glucoseValues := make([]float64, len(glucosePoints))
 
 	for i, point := range glucosePoints {
-		truncated := point.Time.Truncate(5 * time.Minute)
+		// Bucket by the wearer's local time, not the server's.
+		truncated := point.LocalTime().Truncate(5 * time.Minute)
 		bucket := truncated.Hour()*12 + truncated.Minute()/5
 		buckets[bucket] = append(buckets[bucket], point)
 
@@ -75,9 +86,15 @@ func (a *Analyzer) DayToDay(startTs, endTs int) (*DayToDayResult, error) {
 		bucketAvg[i] /= float64(len(bucket))
 	}
 
+	// Avoid NaN, which cannot be encoded as JSON.
+	if len(glucosePoints) > 0 {
+		inRange /= float64(len(glucosePoints))
+	}
+
 	return &DayToDayResult{
 		Average: avg,
-		InRange: inRange / float64(len(glucosePoints)),
+		InRange: inRange,
+		Tiers:   timeInRange(glucosePoints, a.tiers),
 		DtdAvg:  bucketAvg,
 	}, nil
 }
@@ -0,0 +1,108 @@
+package analysis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/algao1/iv3/config"
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+var testCfg = config.Iv3Config{
+	Unit:          "mg/dL",
+	HighThreshold: 180,
+	LowThreshold:  70,
+}
+
+func TestDayToDay(t *testing.T) {
+	st := store.NewMemoryStore()
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	err := st.WriteGlucosePoints([]store.GlucosePoint{
+		{Value: 100, Time: start},
+		{Value: 200, Time: start.Add(5 * time.Minute)},
+		{Value: 60, Time: start.Add(24 * time.Hour)},
+		{Value: 140, Time: start.Add(24*time.Hour + 5*time.Minute)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAnalyzer(st, testCfg, zap.NewNop())
+	result, err := a.DayToDay(int(start.Unix()), int(start.Add(48*time.Hour).Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Average != 125 {
+		t.Errorf("expected an average of 125, got %v", result.Average)
+	}
+	if result.InRange != 0.5 {
+		t.Errorf("expected half the points in range, got %v", result.InRange)
+	}
+	if len(result.DtdAvg) != 24*12 {
+		t.Fatalf("expected a bucket for every 5 minutes, got %d", len(result.DtdAvg))
+	}
+	if result.DtdAvg[0] != 80 || result.DtdAvg[1] != 170 {
+		t.Errorf("expected the first buckets to be 80 and 170, got %v and %v",
+			result.DtdAvg[0], result.DtdAvg[1])
+	}
+}
+
+func TestDayToDayRange(t *testing.T) {
+	st := store.NewMemoryStore()
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	err := st.WriteGlucosePoints([]store.GlucosePoint{
+		{Value: 100, Time: start.Add(-5 * time.Minute)},
+		{Value: 120, Time: start},
+		{Value: 300, Time: start.Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The end is exclusive, same as the Flux range.
+	a := NewAnalyzer(st, testCfg, zap.NewNop())
+	result, err := a.DayToDay(int(start.Unix()), int(start.Add(time.Hour).Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Average != 120 {
+		t.Errorf("expected only the point at the start, got an average of %v", result.Average)
+	}
+}
+
+func TestDayToDayLocalTime(t *testing.T) {
+	st := store.NewMemoryStore()
+	// 06:00 UTC is midnight for a wearer at UTC-6.
+	ts := time.Date(2024, 3, 1, 6, 0, 0, 0, time.UTC)
+	err := st.WriteGlucosePoints([]store.GlucosePoint{
+		{Value: 150, Time: ts, UTCOffset: -6 * 60 * 60},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAnalyzer(st, testCfg, zap.NewNop())
+	result, err := a.DayToDay(int(ts.Unix()), int(ts.Add(time.Minute).Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DtdAvg[0] != 150 {
+		t.Errorf("expected the reading in the midnight bucket, got %v", result.DtdAvg[0])
+	}
+	if result.DtdAvg[6*12] != 0 {
+		t.Errorf("expected nothing in the 06:00 bucket, got %v", result.DtdAvg[6*12])
+	}
+}
+
+func TestDayToDayEmpty(t *testing.T) {
+	a := NewAnalyzer(store.NewMemoryStore(), testCfg, zap.NewNop())
+	result, err := a.DayToDay(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.InRange != 0 {
+		t.Errorf("expected no time in range with no points, got %v", result.InRange)
+	}
+}
@@ -0,0 +1,180 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/algao1/iv3/store"
+)
+
+const (
+	EpisodeHypo  = "hypo"
+	EpisodeHyper = "hyper"
+
+	// episodeMinDuration is how long glucose has to be out of range to
+	// start an episode, and back in range to end it.
+	episodeMinDuration = 15 * time.Minute
+	// maxReadingGap is the longest gap between readings that still counts
+	// as continuous, for starting and ending episodes.
+	maxReadingGap = 15 * time.Minute
+
+	// Carbs and insulin in this window around an episode are reported
+	// with it, since they are likely the cause or the treatment.
+	episodeContextBefore = 3 * time.Hour
+	episodeContextAfter  = 30 * time.Minute
+)
+
+// Episode is a hypo (below the low tier) or hyper (above the high tier)
+// found using the consensus rules, from when glucose went out of range to
+// when it came back.
+type Episode struct {
+	Type            string
+	Start           time.Time
+	End             time.Time
+	DurationMinutes int
+	// Extreme is the nadir of a hypo, or the peak of a hyper.
+	Extreme     float64
+	ExtremeTime time.Time
+	// Ongoing is true if glucose has not been back in range long enough
+	// by the last reading, which is then the end.
+	Ongoing bool
+
+	Carbs   []store.CarbPoint
+	Insulin []store.InsulinPoint
+}
+
+// Episodes finds the hypo and hyper episodes in [startTs, endTs), oldest
+// first, along with the carbs and insulin logged around them. Episode
+// type can be EpisodeHypo or EpisodeHyper, or empty for both.
+func (a *Analyzer) Episodes(startTs, endTs int, episodeType string) ([]Episode, error) {
+	var types []string
+	switch episodeType {
+	case "":
+		types = []string{EpisodeHypo, EpisodeHyper}
+	case EpisodeHypo, EpisodeHyper:
+		types = []string{episodeType}
+	default:
+		return nil, fmt.Errorf("episode type must be %s or %s: %s", EpisodeHypo, EpisodeHyper, episodeType)
+	}
+
+	glucosePoints, err := a.reader.ReadGlucosePoints(startTs, endTs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read glucose points: %w", err)
+	}
+
+	episodes := make([]Episode, 0)
+	for _, t := range types {
+		episodes = append(episodes, a.findEpisodes(glucosePoints, t)...)
+	}
+	if len(episodes) == 0 {
+		return episodes, nil
+	}
+	sort.SliceStable(episodes, func(i, j int) bool {
+		return episodes[i].Start.Before(episodes[j].Start)
+	})
+
+	contextStart := int(time.Unix(int64(startTs), 0).Add(-episodeContextBefore).Unix())
+	contextEnd := int(time.Unix(int64(endTs), 0).Add(episodeContextAfter).Unix())
+	carbs, err := a.reader.ReadCarbPoints(contextStart, contextEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read carb points: %w", err)
+	}
+	insulin, err := a.reader.ReadInsulinPoints(contextStart, contextEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read insulin points: %w", err)
+	}
+
+	for i := range episodes {
+		from := episodes[i].Start.Add(-episodeContextBefore)
+		to := episodes[i].End.Add(episodeContextAfter)
+		episodes[i].Carbs = make([]store.CarbPoint, 0)
+		for _, carb := range carbs {
+			if !carb.Time.Before(from) && carb.Time.Before(to) {
+				episodes[i].Carbs = append(episodes[i].Carbs, carb)
+			}
+		}
+		episodes[i].Insulin = make([]store.InsulinPoint, 0)
+		for _, ins := range insulin {
+			if !ins.Time.Before(from) && ins.Time.Before(to) {
+				episodes[i].Insulin = append(episodes[i].Insulin, ins)
+			}
+		}
+	}
+	return episodes, nil
+}
+
+// findEpisodes walks the readings, starting an episode once they have
+// been out of range for episodeMinDuration, and ending it once they have
+// been back in range for as long.
+func (a *Analyzer) findEpisodes(glucosePoints []store.GlucosePoint, episodeType string) []Episode {
+	outOfRange := func(v float64) bool {
+		if episodeType == EpisodeHypo {
+			return v < float64(a.tiers.Low)
+		}
+		return v > float64(a.tiers.High)
+	}
+	moreExtreme := func(v, than float64) bool {
+		if episodeType == EpisodeHypo {
+			return v < than
+		}
+		return v > than
+	}
+
+	var episodes []Episode
+	var current *Episode
+	// run is the first reading of the current run of readings out of
+	// range (if not in an episode) or back in range (if in one), and
+	// extreme is the most extreme reading out of range since.
+	var run, extreme *store.GlucosePoint
+	for i := range glucosePoints {
+		point := &glucosePoints[i]
+		if i > 0 && point.Time.Sub(glucosePoints[i-1].Time) > maxReadingGap {
+			run = nil
+		}
+
+		if outOfRange(point.Value) {
+			if current != nil {
+				run = nil
+			} else if run == nil {
+				run, extreme = point, point
+			}
+			if extreme == nil || moreExtreme(point.Value, extreme.Value) {
+				extreme = point
+			}
+		} else if current == nil {
+			run = nil
+			continue
+		} else if run == nil {
+			run = point
+		}
+		if run == nil {
+			continue
+		}
+
+		// Each reading stands for the interval up to the next one.
+		if point.Time.Sub(run.Time)+readingInterval < episodeMinDuration {
+			continue
+		}
+		if current == nil {
+			current = &Episode{Type: episodeType, Start: run.Time}
+		} else {
+			current.End = run.Time
+			current.Extreme, current.ExtremeTime = extreme.Value, extreme.Time
+			episodes = append(episodes, *current)
+			current, extreme = nil, nil
+		}
+		run = nil
+	}
+
+	if current != nil {
+		current.End = glucosePoints[len(glucosePoints)-1].Time
+		current.Extreme, current.ExtremeTime = extreme.Value, extreme.Time
+		current.Ongoing = true
+		episodes = append(episodes, *current)
+	}
+	for i := range episodes {
+		episodes[i].DurationMinutes = int(episodes[i].End.Sub(episodes[i].Start).Minutes())
+	}
+	return episodes
+}
@@ -0,0 +1,94 @@
+package analysis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+// writeSeries writes readings 5 minutes apart from start.
+func writeSeries(t *testing.T, st *store.MemoryStore, start time.Time, values ...float64) {
+	t.Helper()
+	glucose := make([]store.GlucosePoint, len(values))
+	for i, v := range values {
+		glucose[i] = store.GlucosePoint{Value: v, Time: start.Add(time.Duration(i) * readingInterval)}
+	}
+	if err := st.WriteGlucosePoints(glucose); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEpisodes(t *testing.T) {
+	st := store.NewMemoryStore()
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	writeSeries(t, st, start,
+		// Two readings low is too short to count.
+		100, 65, 65, 100,
+		// A hypo, with a short recovery in the middle.
+		65, 60, 55, 80, 60, 70, 75, 80,
+		// A hyper that has not ended.
+		190, 220, 200,
+	)
+	st.WriteCarbPoint(store.CarbPoint{Value: 15, Time: start.Add(35 * time.Minute)})
+	st.WriteInsulinPoint(store.InsulinPoint{Value: 4, Type: "Humalog", Time: start.Add(-2 * time.Hour)})
+	st.WriteInsulinPoint(store.InsulinPoint{Value: 4, Type: "Humalog", Time: start.Add(-4 * time.Hour)})
+
+	a := NewAnalyzer(st, testCfg, zap.NewNop())
+	endTs := int(start.Add(2 * time.Hour).Unix())
+	episodes, err := a.Episodes(int(start.Unix()), endTs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(episodes) != 2 {
+		t.Fatalf("expected a hypo and a hyper, got %+v", episodes)
+	}
+
+	hypo := episodes[0]
+	if hypo.Type != EpisodeHypo || !hypo.Start.Equal(start.Add(20*time.Minute)) || !hypo.End.Equal(start.Add(45*time.Minute)) {
+		t.Errorf("expected a hypo from 00:20 to 00:45, got %v to %v", hypo.Start, hypo.End)
+	}
+	if hypo.DurationMinutes != 25 || hypo.Ongoing {
+		t.Errorf("expected a 25 minute hypo that ended, got %+v", hypo)
+	}
+	if hypo.Extreme != 55 || !hypo.ExtremeTime.Equal(start.Add(30*time.Minute)) {
+		t.Errorf("expected a nadir of 55 at 00:30, got %v at %v", hypo.Extreme, hypo.ExtremeTime)
+	}
+	if len(hypo.Carbs) != 1 || len(hypo.Insulin) != 1 {
+		t.Errorf("expected the nearby carbs and insulin, got %+v and %+v", hypo.Carbs, hypo.Insulin)
+	}
+
+	hyper := episodes[1]
+	if hyper.Type != EpisodeHyper || !hyper.Ongoing || hyper.Extreme != 220 {
+		t.Errorf("expected an ongoing hyper peaking at 220, got %+v", hyper)
+	}
+
+	hypos, err := a.Episodes(int(start.Unix()), endTs, EpisodeHypo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hypos) != 1 {
+		t.Errorf("expected only the hypo, got %+v", hypos)
+	}
+	if _, err = a.Episodes(0, endTs, "sideways"); err == nil {
+		t.Error("expected an error for an unknown episode type")
+	}
+}
+
+func TestEpisodesGap(t *testing.T) {
+	st := store.NewMemoryStore()
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	// Low readings either side of an hour without any are not continuous.
+	writeSeries(t, st, start, 60, 60)
+	writeSeries(t, st, start.Add(time.Hour), 60, 100, 100, 100)
+
+	a := NewAnalyzer(st, testCfg, zap.NewNop())
+	episodes, err := a.Episodes(int(start.Unix()), int(start.Add(2*time.Hour).Unix()), EpisodeHypo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(episodes) != 0 {
+		t.Errorf("expected no episodes across the gap, got %+v", episodes)
+	}
+}
@@ -0,0 +1,84 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// minGMICoverage is the sensor wear needed for the GMI to be reported,
+// the consensus minimum of 70% of readings.
+const minGMICoverage = 0.7
+
+// gmiWindows are the rolling windows the GMI is computed over, in days.
+var gmiWindows = []int{14, 90}
+
+// GMISeries is the GMI over a rolling window, once per day.
+type GMISeries struct {
+	Days   int
+	Points []GMIPoint
+}
+
+// GMIPoint is the GMI over the window ending at Time. If the coverage is
+// too low, Sufficient is false and the estimates are left at 0.
+type GMIPoint struct {
+	Time       time.Time
+	Coverage   float64
+	Sufficient bool
+	Mean       float64
+	// GMI and EA1C are both estimates of A1c (%), from the GMI and the
+	// older ADAG formulas.
+	GMI  float64
+	EA1C float64
+}
+
+// GMI computes the GMI over rolling 14 and 90 day windows, for each day
+// ending in (startTs, endTs], so it can be tracked against lab A1c results.
+// The last point ends at endTs.
+func (a *Analyzer) GMI(startTs, endTs int) ([]GMISeries, error) {
+	longest := gmiWindows[len(gmiWindows)-1]
+	readStart := time.Unix(int64(startTs), 0).AddDate(0, 0, -longest)
+	glucosePoints, err := a.reader.ReadGlucosePoints(int(readStart.Unix()), endTs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read glucose points: %w", err)
+	}
+
+	// Readings are summed with prefix sums, so each window is O(log n).
+	sums := make([]float64, len(glucosePoints)+1)
+	for i, point := range glucosePoints {
+		sums[i+1] = sums[i] + point.Value
+	}
+	// countBefore returns the number of readings before ts.
+	countBefore := func(ts int64) int {
+		return sort.Search(len(glucosePoints), func(i int) bool {
+			return glucosePoints[i].Time.Unix() >= ts
+		})
+	}
+
+	const day = 24 * 60 * 60
+	ends := make([]int64, 0, max(0, (endTs-startTs+day-1)/day))
+	for end := int64(endTs) - int64(cap(ends)-1)*day; end <= int64(endTs); end += day {
+		ends = append(ends, end)
+	}
+
+	series := make([]GMISeries, len(gmiWindows))
+	for i, days := range gmiWindows {
+		series[i] = GMISeries{Days: days, Points: make([]GMIPoint, len(ends))}
+		window := time.Duration(days) * 24 * time.Hour
+		for j, end := range ends {
+			from, to := countBefore(end-int64(window.Seconds())), countBefore(end)
+			point := GMIPoint{
+				Time:     time.Unix(end, 0),
+				Coverage: sensorWear(to-from, window),
+			}
+			if point.Coverage >= minGMICoverage {
+				point.Sufficient = true
+				point.Mean = (sums[to] - sums[from]) / float64(to-from)
+				point.GMI = gmi(point.Mean)
+				point.EA1C = (point.Mean + 46.7) / 28.7
+			}
+			series[i].Points[j] = point
+		}
+	}
+	return series, nil
+}
@@ -0,0 +1,77 @@
+package analysis
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+func TestGMI(t *testing.T) {
+	st := store.NewMemoryStore()
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	// 20 days of readings every 5 minutes, at 150 for the first 10 days
+	// and 200 after.
+	var glucose []store.GlucosePoint
+	for i := 0; i < 20*288; i++ {
+		v := 150.0
+		if i >= 10*288 {
+			v = 200
+		}
+		glucose = append(glucose, store.GlucosePoint{Value: v, Time: start.Add(time.Duration(i) * 5 * time.Minute)})
+	}
+	if err := st.WriteGlucosePoints(glucose); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAnalyzer(st, testCfg, zap.NewNop())
+	end := start.Add(20 * 24 * time.Hour)
+	series, err := a.GMI(int(start.Unix()), int(end.Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 2 || series[0].Days != 14 || series[1].Days != 90 {
+		t.Fatalf("expected 14 and 90 day series, got %+v", series)
+	}
+
+	daily := series[0].Points
+	if len(daily) != 20 || !daily[19].Time.Equal(end) {
+		t.Fatalf("expected a point per day ending at the end, got %d", len(daily))
+	}
+	// 9 days of readings is too little coverage for 14 days, 10 is enough.
+	if daily[8].Sufficient || daily[8].GMI != 0 {
+		t.Errorf("expected no GMI from 9 days, got %+v", daily[8])
+	}
+	if !daily[9].Sufficient || daily[9].Mean != 150 {
+		t.Errorf("expected a GMI from 10 days, got %+v", daily[9])
+	}
+	last := daily[19]
+	// The last 14 days are 4 days at 150 and 10 at 200.
+	mean := (4*150.0 + 10*200.0) / 14
+	if !last.Sufficient || !approx(last.Coverage, 1) || !approx(last.Mean, mean) {
+		t.Fatalf("expected full coverage with a mean of %v, got %+v", mean, last)
+	}
+	if !approx(last.GMI, 3.31+0.02392*mean) || !approx(last.EA1C, (mean+46.7)/28.7) {
+		t.Errorf("unexpected estimates: %+v", last)
+	}
+
+	// 20 days is not enough for 90.
+	for _, point := range series[1].Points {
+		if point.Sufficient || math.IsNaN(point.Mean) {
+			t.Fatalf("expected no 90 day GMI, got %+v", point)
+		}
+	}
+}
+
+func TestGMIEmptyRange(t *testing.T) {
+	a := NewAnalyzer(store.NewMemoryStore(), testCfg, zap.NewNop())
+	series, err := a.GMI(100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series[0].Points) != 0 {
+		t.Errorf("expected no points, got %+v", series[0].Points)
+	}
+}
@@ -0,0 +1,126 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/algao1/iv3/config"
+	"github.com/algao1/iv3/store"
+)
+
+const (
+	PeriodDay  = "day"
+	PeriodWeek = "week"
+)
+
+// TimeInRange is the time spent in each of the range tiers, from very
+// low to very high.
+type TimeInRange struct {
+	VeryLow  Tier
+	Low      Tier
+	InRange  Tier
+	High     Tier
+	VeryHigh Tier
+}
+
+type Tier struct {
+	// Fraction of the readings in the tier, between 0 and 1.
+	Fraction float64
+	// MinutesPerDay is the fraction as minutes in an average day.
+	MinutesPerDay float64
+}
+
+// TimeInRangePeriod is the time in range over a single day or week,
+// starting at Start in the wearer's local time.
+type TimeInRangePeriod struct {
+	Start    time.Time
+	Readings int
+	TimeInRange
+}
+
+type TimeInRangeResult struct {
+	Overall TimeInRange
+	Periods []TimeInRangePeriod
+}
+
+// TimeInRange breaks [startTs, endTs) down by the range tiers, overall and
+// per day or week, so it can be trended over months. Weeks start on Monday.
+// Periods without readings are left out.
+func (a *Analyzer) TimeInRange(startTs, endTs int, period string) (*TimeInRangeResult, error) {
+	if period != PeriodDay && period != PeriodWeek {
+		return nil, fmt.Errorf("period must be %s or %s: %s", PeriodDay, PeriodWeek, period)
+	}
+
+	glucosePoints, err := a.reader.ReadGlucosePoints(startTs, endTs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read glucose points: %w", err)
+	}
+
+	// Keyed by the local date of the day, or of the week's Monday, since
+	// points on either side of a DST change have different offsets and
+	// so disagree on when midnight was. The start is the midnight of the
+	// first point, which has the offset in effect at the time.
+	starts := make(map[string]time.Time)
+	byStart := make(map[string][]store.GlucosePoint)
+	for _, point := range glucosePoints {
+		start := periodStart(point.LocalTime(), period)
+		key := start.Format(time.DateOnly)
+		if _, ok := starts[key]; !ok {
+			starts[key] = start
+		}
+		byStart[key] = append(byStart[key], point)
+	}
+
+	result := &TimeInRangeResult{
+		Overall: timeInRange(glucosePoints, a.tiers),
+		Periods: make([]TimeInRangePeriod, 0, len(byStart)),
+	}
+	for key, points := range byStart {
+		result.Periods = append(result.Periods, TimeInRangePeriod{
+			Start:       starts[key],
+			Readings:    len(points),
+			TimeInRange: timeInRange(points, a.tiers),
+		})
+	}
+	sort.Slice(result.Periods, func(i, j int) bool {
+		return result.Periods[i].Start.Before(result.Periods[j].Start)
+	})
+	return result, nil
+}
+
+// periodStart returns the local midnight starting the day or week of t.
+func periodStart(t time.Time, period string) time.Time {
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if period == PeriodWeek {
+		// Go weeks start on Sunday.
+		start = start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+	}
+	return start
+}
+
+func timeInRange(glucosePoints []store.GlucosePoint, tiers config.RangeTiers) TimeInRange {
+	var tir TimeInRange
+	if len(glucosePoints) == 0 {
+		return tir
+	}
+	for _, point := range glucosePoints {
+		switch {
+		case point.Value < float64(tiers.VeryLow):
+			tir.VeryLow.Fraction++
+		case point.Value < float64(tiers.Low):
+			tir.Low.Fraction++
+		case point.Value <= float64(tiers.High):
+			tir.InRange.Fraction++
+		case point.Value <= float64(tiers.VeryHigh):
+			tir.High.Fraction++
+		default:
+			tir.VeryHigh.Fraction++
+		}
+	}
+	for _, tier := range []*Tier{&tir.VeryLow, &tir.Low, &tir.InRange, &tir.High, &tir.VeryHigh} {
+		tier.Fraction /= float64(len(glucosePoints))
+		tier.MinutesPerDay = tier.Fraction * 24 * 60
+	}
+	return tir
+}
@@ -0,0 +1,148 @@
+package analysis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/algao1/iv3/config"
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+func TestTimeInRange(t *testing.T) {
+	st := store.NewMemoryStore()
+	// A Wednesday.
+	start := time.Date(2024, 3, 6, 12, 0, 0, 0, time.UTC)
+	err := st.WriteGlucosePoints([]store.GlucosePoint{
+		{Value: 50, Time: start},
+		{Value: 100, Time: start.Add(5 * time.Minute)},
+		{Value: 200, Time: start.Add(24 * time.Hour)},
+		{Value: 260, Time: start.Add(24*time.Hour + 5*time.Minute)},
+		// The next Monday.
+		{Value: 65, Time: start.Add(5 * 24 * time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAnalyzer(st, testCfg, zap.NewNop())
+	endTs := int(start.Add(7 * 24 * time.Hour).Unix())
+
+	daily, err := a.TimeInRange(int(start.Unix()), endTs, PeriodDay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if daily.Overall.VeryLow.Fraction != 0.2 || daily.Overall.Low.Fraction != 0.2 {
+		t.Errorf("unexpected overall time in range: %+v", daily.Overall)
+	}
+	if len(daily.Periods) != 3 {
+		t.Fatalf("expected a period for each day with readings, got %+v", daily.Periods)
+	}
+	first := daily.Periods[0]
+	if !first.Start.Equal(time.Date(2024, 3, 6, 0, 0, 0, 0, time.UTC)) || first.Readings != 2 {
+		t.Errorf("expected the first day to start at midnight, got %+v", first)
+	}
+	if first.InRange.Fraction != 0.5 || first.InRange.MinutesPerDay != 720 {
+		t.Errorf("expected half the first day in range, got %+v", first.InRange)
+	}
+	if second := daily.Periods[1]; second.High.Fraction != 0.5 || second.VeryHigh.Fraction != 0.5 {
+		t.Errorf("expected the second day to be high, got %+v", second.TimeInRange)
+	}
+
+	weekly, err := a.TimeInRange(int(start.Unix()), endTs, PeriodWeek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(weekly.Periods) != 2 {
+		t.Fatalf("expected two weeks, got %+v", weekly.Periods)
+	}
+	if monday := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC); !weekly.Periods[0].Start.Equal(monday) {
+		t.Errorf("expected the week to start on Monday, got %v", weekly.Periods[0].Start)
+	}
+	if weekly.Periods[1].Readings != 1 {
+		t.Errorf("expected one reading in the second week, got %+v", weekly.Periods[1])
+	}
+
+	if _, err = a.TimeInRange(0, endTs, "month"); err == nil {
+		t.Error("expected an error for an unknown period")
+	}
+}
+
+func TestTimeInRangeTiers(t *testing.T) {
+	st := store.NewMemoryStore()
+	err := st.WriteGlucosePoints([]store.GlucosePoint{
+		{Value: 65, Time: time.Unix(100, 0)},
+		{Value: 150, Time: time.Unix(400, 0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testCfg
+	cfg.Tiers = config.RangeTiers{VeryLow: 54, Low: 63, High: 140, VeryHigh: 250}
+	a := NewAnalyzer(st, cfg, zap.NewNop())
+	result, err := a.TimeInRange(0, 1000, PeriodDay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Overall.InRange.Fraction != 0.5 || result.Overall.High.Fraction != 0.5 {
+		t.Errorf("expected the configured tiers to be used, got %+v", result.Overall)
+	}
+}
+
+func TestTimeInRangeDST(t *testing.T) {
+	st := store.NewMemoryStore()
+	// Clocks in Toronto went forward at 2am on Sunday, March 10 2024.
+	est, edt := -5*3600, -4*3600
+	err := st.WriteGlucosePoints([]store.GlucosePoint{
+		{Value: 100, Time: time.Date(2024, 3, 9, 23, 0, 0, 0, time.FixedZone("", est)), UTCOffset: est},
+		{Value: 100, Time: time.Date(2024, 3, 10, 1, 0, 0, 0, time.FixedZone("", est)), UTCOffset: est},
+		{Value: 200, Time: time.Date(2024, 3, 10, 12, 0, 0, 0, time.FixedZone("", edt)), UTCOffset: edt},
+		{Value: 100, Time: time.Date(2024, 3, 11, 1, 0, 0, 0, time.FixedZone("", edt)), UTCOffset: edt},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAnalyzer(st, testCfg, zap.NewNop())
+	startTs := int(time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC).Unix())
+	endTs := int(time.Date(2024, 3, 12, 0, 0, 0, 0, time.UTC).Unix())
+
+	tests := []struct {
+		period   string
+		starts   []time.Time
+		readings []int
+	}{
+		{
+			period: PeriodDay,
+			starts: []time.Time{
+				time.Date(2024, 3, 9, 0, 0, 0, 0, time.FixedZone("", est)),
+				time.Date(2024, 3, 10, 0, 0, 0, 0, time.FixedZone("", est)),
+				time.Date(2024, 3, 11, 0, 0, 0, 0, time.FixedZone("", edt)),
+			},
+			readings: []int{1, 2, 1},
+		},
+		{
+			period: PeriodWeek,
+			starts: []time.Time{
+				time.Date(2024, 3, 4, 0, 0, 0, 0, time.FixedZone("", est)),
+				time.Date(2024, 3, 11, 0, 0, 0, 0, time.FixedZone("", edt)),
+			},
+			readings: []int{3, 1},
+		},
+	}
+	for _, tt := range tests {
+		result, err := a.TimeInRange(startTs, endTs, tt.period)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Periods) != len(tt.starts) {
+			t.Errorf("%s: expected %d periods, got %+v", tt.period, len(tt.starts), result.Periods)
+			continue
+		}
+		for i, period := range result.Periods {
+			if !period.Start.Equal(tt.starts[i]) || period.Readings != tt.readings[i] {
+				t.Errorf("%s: expected period %d to start at %v with %d readings, got %v with %d",
+					tt.period, i, tt.starts[i], tt.readings[i], period.Start, period.Readings)
+			}
+		}
+	}
+}
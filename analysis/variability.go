@@ -0,0 +1,208 @@
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/algao1/iv3/store"
+	"github.com/montanaflynn/stats"
+)
+
+// VariabilityResult has the glycemic variability metrics over a range.
+// Everything is in mg/dL, except for CV (a fraction between 0 and 1)
+// and the unitless J-index and risk indices.
+type VariabilityResult struct {
+	Readings int
+	Mean     float64
+	SD       float64
+	CV       float64
+	// MAGE is the Mean Amplitude of Glycemic Excursions, the average
+	// swing between a peak and a nadir, counting only swings of more
+	// than 1 SD.
+	MAGE float64
+	// MODD is the Mean Of Daily Differences, between readings 24 hours
+	// apart.
+	MODD float64
+	// CONGA is the Continuous Overall Net Glycemic Action, the SD of the
+	// differences between readings CONGAHours apart.
+	CONGA      float64
+	CONGAHours int
+	JIndex     float64
+	// LBGI and HBGI are the Low and High Blood Glucose Indices, the risk
+	// of hypoglycemia and hyperglycemia.
+	LBGI float64
+	HBGI float64
+}
+
+// pairTolerance is how far off a reading can be from the time it is
+// paired with, for MODD and CONGA.
+const pairTolerance = readingInterval / 2
+
+// Variability computes the variability metrics over [startTs, endTs).
+// MODD needs more than a day of readings, and CONGA more than congaHours,
+// otherwise they are 0.
+func (a *Analyzer) Variability(startTs, endTs, congaHours int) (*VariabilityResult, error) {
+	if congaHours <= 0 {
+		return nil, fmt.Errorf("CONGA hours must be positive: %d", congaHours)
+	}
+
+	glucosePoints, err := a.reader.ReadGlucosePoints(startTs, endTs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read glucose points: %w", err)
+	}
+
+	result := &VariabilityResult{
+		Readings:   len(glucosePoints),
+		CONGAHours: congaHours,
+	}
+	if len(glucosePoints) == 0 {
+		return result, nil
+	}
+
+	values := glucoseValues(glucosePoints)
+	result.Mean, _ = stats.Mean(values)
+	result.SD, _ = stats.StandardDeviation(values)
+	result.CV = result.SD / result.Mean
+	result.JIndex = 0.001 * math.Pow(result.Mean+result.SD, 2)
+	result.MAGE = mage(values, result.SD)
+	result.MODD = meanAbs(lagDifferences(glucosePoints, 24*time.Hour))
+	result.CONGA, _ = stats.StandardDeviation(lagDifferences(glucosePoints, time.Duration(congaHours)*time.Hour))
+	if math.IsNaN(result.CONGA) {
+		result.CONGA = 0
+	}
+	result.LBGI, result.HBGI = riskIndices(values)
+	return result, nil
+}
+
+// mage finds the peaks and nadirs, and averages the swings between them
+// that are larger than sd. Only swings in the direction of the first
+// one counted are averaged, so each excursion is counted once.
+func mage(values []float64, sd float64) float64 {
+	extrema := turningPoints(values)
+
+	// Sensor noise splits an excursion into several smaller swings, so
+	// like Baghurst's method, drop the smallest swing until every swing
+	// left is larger than sd. The points dropped are merged into the
+	// neighbouring peak or nadir, so that the excursion keeps its extremes.
+	for len(extrema) > 2 {
+		smallest := 0
+		for i := 1; i < len(extrema)-1; i++ {
+			if math.Abs(extrema[i+1]-extrema[i]) < math.Abs(extrema[smallest+1]-extrema[smallest]) {
+				smallest = i
+			}
+		}
+		if math.Abs(extrema[smallest+1]-extrema[smallest]) > sd {
+			break
+		}
+		extrema = dropSwing(extrema, smallest)
+	}
+
+	var sum float64
+	var count int
+	var rising *bool
+	for i := 1; i < len(extrema); i++ {
+		swing := extrema[i] - extrema[i-1]
+		if math.Abs(swing) <= sd {
+			continue
+		}
+		up := swing > 0
+		if rising == nil {
+			rising = &up
+		}
+		if up == *rising {
+			sum += math.Abs(swing)
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return sum / float64(count)
+}
+
+// turningPoints reduces the readings to alternating peaks and nadirs.
+func turningPoints(values []float64) []float64 {
+	var extrema []float64
+	for _, v := range values {
+		n := len(extrema)
+		switch {
+		case n == 0:
+			extrema = append(extrema, v)
+		case v == extrema[n-1]:
+		case n == 1:
+			extrema = append(extrema, v)
+		case (extrema[n-1] > extrema[n-2]) == (v > extrema[n-1]):
+			// Still going the same way, so extend the swing.
+			extrema[n-1] = v
+		default:
+			extrema = append(extrema, v)
+		}
+	}
+	return extrema
+}
+
+// dropSwing removes the swing between extrema i and i+1. Each of the two
+// is merged into the next peak or nadir of the same kind, two places
+// over, keeping whichever is more extreme.
+func dropSwing(extrema []float64, i int) []float64 {
+	extreme := func(a, b float64, peak bool) float64 {
+		if peak {
+			return max(a, b)
+		}
+		return min(a, b)
+	}
+	peak := extrema[i] > extrema[i+1]
+	if i+2 < len(extrema) {
+		extrema[i+2] = extreme(extrema[i+2], extrema[i], peak)
+	}
+	if i > 0 {
+		extrema[i-1] = extreme(extrema[i-1], extrema[i+1], !peak)
+	}
+	return append(extrema[:i], extrema[i+2:]...)
+}
+
+// lagDifferences returns the differences between each reading and the
+// reading lag before it, for readings that have one.
+func lagDifferences(glucosePoints []store.GlucosePoint, lag time.Duration) []float64 {
+	var diffs []float64
+	for _, point := range glucosePoints {
+		target := point.Time.Add(-lag)
+		i := sort.Search(len(glucosePoints), func(i int) bool {
+			return !glucosePoints[i].Time.Before(target.Add(-pairTolerance))
+		})
+		if i < len(glucosePoints) && !glucosePoints[i].Time.After(target.Add(pairTolerance)) {
+			diffs = append(diffs, point.Value-glucosePoints[i].Value)
+		}
+	}
+	return diffs
+}
+
+func meanAbs(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += math.Abs(v)
+	}
+	return sum / float64(len(values))
+}
+
+// riskIndices returns the LBGI and HBGI, using Kovatchev's symmetrization
+// of the glucose scale.
+func riskIndices(values []float64) (float64, float64) {
+	var low, high float64
+	for _, v := range values {
+		f := 1.509 * (math.Pow(math.Log(max(v, 1)), 1.084) - 5.381)
+		risk := 10 * f * f
+		if f < 0 {
+			low += risk
+		} else {
+			high += risk
+		}
+	}
+	n := float64(len(values))
+	return low / n, high / n
+}
@@ -0,0 +1,144 @@
+package analysis
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+func approx(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestVariability(t *testing.T) {
+	st := store.NewMemoryStore()
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	// Hourly swings between 100 and 200 over two days, with the second
+	// day 20 higher.
+	var glucose []store.GlucosePoint
+	for h := 0; h < 48; h++ {
+		v := 100.0
+		if h%2 == 1 {
+			v = 200
+		}
+		if h >= 24 {
+			v += 20
+		}
+		glucose = append(glucose, store.GlucosePoint{Value: v, Time: start.Add(time.Duration(h) * time.Hour)})
+	}
+	if err := st.WriteGlucosePoints(glucose); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAnalyzer(st, testCfg, zap.NewNop())
+	result, err := a.Variability(int(start.Unix()), int(start.Add(48*time.Hour).Unix()), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Readings != 48 || result.Mean != 160 {
+		t.Errorf("expected 48 readings with a mean of 160, got %+v", result)
+	}
+	// Half the readings are 10 from their day's mean, so the SD is
+	// sqrt(50^2 + 10^2).
+	if !approx(result.SD, math.Sqrt(2600)) || !approx(result.CV, math.Sqrt(2600)/160) {
+		t.Errorf("unexpected SD and CV: %v, %v", result.SD, result.CV)
+	}
+	if !approx(result.JIndex, 0.001*math.Pow(160+math.Sqrt(2600), 2)) {
+		t.Errorf("unexpected J-index: %v", result.JIndex)
+	}
+	// Every swing is 100, except the one between the days.
+	if !approx(result.MAGE, 100) {
+		t.Errorf("expected a MAGE of 100, got %v", result.MAGE)
+	}
+	if !approx(result.MODD, 20) {
+		t.Errorf("expected a MODD of 20, got %v", result.MODD)
+	}
+	// Hourly differences are +-100, except +120 between the days.
+	if result.CONGA < 99 || result.CONGA > 102 {
+		t.Errorf("expected a CONGA-1 close to 100, got %v", result.CONGA)
+	}
+	if result.LBGI <= 0 || result.HBGI <= result.LBGI {
+		t.Errorf("expected mostly high risk, got LBGI %v and HBGI %v", result.LBGI, result.HBGI)
+	}
+}
+
+func TestRiskIndices(t *testing.T) {
+	// 112.5 mg/dL is the center of the symmetrized scale, so has no risk.
+	low, high := riskIndices([]float64{112.5})
+	if low > 0.01 || high > 0.01 {
+		t.Errorf("expected no risk at 112.5, got %v and %v", low, high)
+	}
+	low, high = riskIndices([]float64{40})
+	if low < 20 || high != 0 {
+		t.Errorf("expected a high LBGI at 40, got %v and %v", low, high)
+	}
+}
+
+func TestVariabilityEmpty(t *testing.T) {
+	a := NewAnalyzer(store.NewMemoryStore(), testCfg, zap.NewNop())
+	result, err := a.Variability(0, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Readings != 0 || result.CONGA != 0 || result.MODD != 0 {
+		t.Errorf("expected an empty result, got %+v", result)
+	}
+	if _, err = a.Variability(0, 100, 0); err == nil {
+		t.Error("expected an error for 0 CONGA hours")
+	}
+}
+
+func TestMAGENoisy(t *testing.T) {
+	// Swings between 100 and 200, with 2 mg/dL of noise on the way up
+	// and down that should not split the excursions.
+	var values []float64
+	for i := 0; i < 4; i++ {
+		values = append(values, 100, 120, 118, 150, 148, 180, 178, 200, 180, 182, 150, 152, 120, 122)
+	}
+	values = append(values, 100)
+
+	sd := 35.0
+	if got := mage(values, sd); !approx(got, 100) {
+		t.Errorf("expected a MAGE of 100, got %v", got)
+	}
+	// Without the noise, the result is the same.
+	if got := mage([]float64{100, 200, 100, 200, 100}, sd); !approx(got, 100) {
+		t.Errorf("expected a MAGE of 100 without noise, got %v", got)
+	}
+	// Swings smaller than the SD are never counted.
+	if got := mage([]float64{100, 110, 100, 110}, sd); got != 0 {
+		t.Errorf("expected a MAGE of 0 for small swings, got %v", got)
+	}
+}
+
+func TestDropSwing(t *testing.T) {
+	tests := []struct {
+		extrema []float64
+		i       int
+		want    []float64
+	}{
+		// The higher peak and lower nadir are kept.
+		{extrema: []float64{100, 200, 196, 202, 90}, i: 1, want: []float64{100, 202, 90}},
+		{extrema: []float64{100, 200, 196, 202, 90}, i: 2, want: []float64{100, 202, 90}},
+		{extrema: []float64{100, 102, 98, 200}, i: 0, want: []float64{98, 200}},
+		{extrema: []float64{100, 200, 198, 201}, i: 2, want: []float64{100, 201}},
+	}
+	for _, tt := range tests {
+		in := append([]float64(nil), tt.extrema...)
+		got := dropSwing(in, tt.i)
+		if len(got) != len(tt.want) {
+			t.Errorf("%v at %d: expected %v, got %v", tt.extrema, tt.i, tt.want, got)
+			continue
+		}
+		for j := range got {
+			if got[j] != tt.want[j] {
+				t.Errorf("%v at %d: expected %v, got %v", tt.extrema, tt.i, tt.want, got)
+				break
+			}
+		}
+	}
+}
@@ -2,24 +2,93 @@ package config
 
 import (
 	"fmt"
+	"net/url"
+	"regexp"
 )
 
+const (
+	SourceDexcom      = "dexcom"
+	SourceNightscout  = "nightscout"
+	SourceLibreLinkUp = "librelinkup"
+	SourceXDrip       = "xdrip"
+
+	DexcomRegionUS  = "us"
+	DexcomRegionOUS = "ous"
+	DexcomRegionJP  = "jp"
+
+	StorageInfluxDB = "influxdb"
+	StorageBolt     = "bolt"
+)
+
+var subjectNameRegex = regexp.MustCompile(`^[a-z0-9_-]*$`)
+
 type Config struct {
-	Dexcom  DexcomConfig    `yaml:"dexcom"`
-	Insulin []InsulinConfig `yaml:"insulin"`
-	API     APIConfig       `yaml:"api"`
-	S3      S3Config        `yaml:"s3"`
-	Iv3     Iv3Config       `yaml:"iv3"`
+	// A single subject can be configured at the top level, which is
+	// the same as having only one entry in subjects.
+	SubjectConfig `yaml:",inline"`
+	Subjects      []SubjectConfig `yaml:"subjects"`
+
+	API     APIConfig     `yaml:"api"`
+	S3      S3Config      `yaml:"s3"`
+	Storage StorageConfig `yaml:"storage"`
+}
+
+// SubjectConfig is everything specific to one monitored person.
+type SubjectConfig struct {
+	Name        string            `yaml:"name"`
+	Source      string            `yaml:"source"`
+	Dexcom      DexcomConfig      `yaml:"dexcom"`
+	Nightscout  NightscoutConfig  `yaml:"nightscout"`
+	LibreLinkUp LibreLinkUpConfig `yaml:"librelinkup"`
+	XDrip       XDripConfig       `yaml:"xdrip"`
+	Insulin     []InsulinConfig   `yaml:"insulin"`
+	Iv3         Iv3Config         `yaml:"iv3"`
 }
 
 type DexcomConfig struct {
 	Account  string `yaml:"account"`
 	Password string `yaml:"password"`
+	// Region picks the Share server, URL overrides it if set.
+	Region string `yaml:"region"`
+	URL    string `yaml:"url"`
+}
+
+type NightscoutConfig struct {
+	URL       string `yaml:"url"`
+	Token     string `yaml:"token"`
+	APISecret string `yaml:"api_secret"`
+}
+
+type LibreLinkUpConfig struct {
+	Email    string `yaml:"email"`
+	Password string `yaml:"password"`
+	URL      string `yaml:"url"`
+}
+
+// XDripConfig enables the Nightscout-style upload endpoint, for apps
+// like xDrip+ that push readings to iv3.
+type XDripConfig struct {
+	APISecret string `yaml:"api_secret"`
+}
+
+// StorageConfig picks the storage backend. Bolt is an embedded database,
+// so iv3 can run without InfluxDB.
+type StorageConfig struct {
+	Backend string `yaml:"backend"`
+	Path    string `yaml:"path"`
 }
 
 type APIConfig struct {
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
+	// Users are additional logins, e.g. one per caregiver, so that their
+	// changes can be told apart in the audit trail.
+	Users []APIUser `yaml:"users"`
+}
+
+type APIUser struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
 }
 
 type S3Config struct {
@@ -42,8 +111,24 @@ type Iv3Config struct {
 	MissingLongThreshold int    `yaml:"missing_long_threshold"`
 	HighThreshold        int    `yaml:"high_threshold"`
 	LowThreshold         int    `yaml:"low_threshold"`
+	// KetoneThreshold is the blood ketone level in mmol/L to alert at.
+	KetoneThreshold float64    `yaml:"ketone_threshold"`
+	Tiers           RangeTiers `yaml:"tiers"`
 }
 
+// RangeTiers are the boundaries of the time in range tiers, in mg/dL.
+// Readings below VeryLow are very low, below Low are low, up to High are
+// in range, up to VeryHigh are high, and above that very high.
+type RangeTiers struct {
+	VeryLow  int `yaml:"very_low"`
+	Low      int `yaml:"low"`
+	High     int `yaml:"high"`
+	VeryHigh int `yaml:"very_high"`
+}
+
+// DefaultRangeTiers are the international consensus targets.
+var DefaultRangeTiers = RangeTiers{VeryLow: 54, Low: 70, High: 180, VeryHigh: 250}
+
 func (cfg *Config) Verify() error {
 	if cfg.API.Username == "" {
 		return fmt.Errorf("no API username provided")
@@ -51,12 +136,126 @@ func (cfg *Config) Verify() error {
 	if cfg.API.Password == "" {
 		return fmt.Errorf("no API password provided")
 	}
+	usernames := map[string]bool{cfg.API.Username: true}
+	for i, user := range cfg.API.Users {
+		if user.Username == "" || user.Password == "" {
+			return fmt.Errorf("API user %d has no username or password", i)
+		}
+		if usernames[user.Username] {
+			return fmt.Errorf("duplicate API username: %s", user.Username)
+		}
+		usernames[user.Username] = true
+	}
+	if cfg.Storage.Backend == "" {
+		cfg.Storage.Backend = StorageInfluxDB
+	}
+	switch cfg.Storage.Backend {
+	case StorageInfluxDB:
+	case StorageBolt:
+		if cfg.Storage.Path == "" {
+			cfg.Storage.Path = ".data/iv3.db"
+		}
+	default:
+		return fmt.Errorf("incorrect storage backend provided: %s", cfg.Storage.Backend)
+	}
+
+	if len(cfg.Subjects) == 0 {
+		cfg.Subjects = []SubjectConfig{cfg.SubjectConfig}
+	}
+	names := make(map[string]bool)
+	secrets := make(map[string]bool)
+	for i := range cfg.Subjects {
+		sub := &cfg.Subjects[i]
+		if len(cfg.Subjects) > 1 && sub.Name == "" {
+			return fmt.Errorf("subject %d has no name", i)
+		}
+		if names[sub.Name] {
+			return fmt.Errorf("duplicate subject name: %s", sub.Name)
+		}
+		names[sub.Name] = true
+
+		// The secret is used to tell which subject an upload is for.
+		if sub.XDrip.APISecret != "" && secrets[sub.XDrip.APISecret] {
+			return fmt.Errorf("subject %s reuses an xDrip API secret", sub.Name)
+		}
+		secrets[sub.XDrip.APISecret] = true
+
+		if err := sub.verify(); err != nil {
+			if sub.Name == "" {
+				return err
+			}
+			return fmt.Errorf("subject %s: %w", sub.Name, err)
+		}
+	}
+	cfg.SubjectConfig = cfg.Subjects[0]
+
+	return nil
+}
+
+func (cfg *SubjectConfig) verify() error {
+	if !subjectNameRegex.MatchString(cfg.Name) {
+		return fmt.Errorf("subject names can only contain a-z, 0-9, _ and -")
+	}
+	if cfg.Source == "" {
+		cfg.Source = SourceDexcom
+	}
+	switch cfg.Source {
+	case SourceDexcom:
+		if err := cfg.Dexcom.verify(); err != nil {
+			return err
+		}
+	case SourceNightscout:
+		if cfg.Nightscout.URL == "" {
+			return fmt.Errorf("no Nightscout url provided")
+		}
+	case SourceLibreLinkUp:
+		if cfg.LibreLinkUp.Email == "" || cfg.LibreLinkUp.Password == "" {
+			return fmt.Errorf("no LibreLinkUp credentials provided")
+		}
+	case SourceXDrip:
+		if cfg.XDrip.APISecret == "" {
+			return fmt.Errorf("no xDrip API secret provided")
+		}
+	default:
+		return fmt.Errorf("incorrect source provided: %s", cfg.Source)
+	}
+	// Same requirement as Nightscout, since uploaders expect it.
+	if cfg.XDrip.APISecret != "" && len(cfg.XDrip.APISecret) < 12 {
+		return fmt.Errorf("xDrip API secret must be at least 12 characters")
+	}
 	if cfg.Iv3.LowThreshold == 0 {
 		cfg.Iv3.LowThreshold = 100
 	}
+	if cfg.Iv3.KetoneThreshold == 0 {
+		cfg.Iv3.KetoneThreshold = 1.5
+	}
+	if cfg.Iv3.Tiers == (RangeTiers{}) {
+		cfg.Iv3.Tiers = DefaultRangeTiers
+	}
+	tiers := cfg.Iv3.Tiers
+	if tiers.VeryLow <= 0 || tiers.VeryLow >= tiers.Low || tiers.Low >= tiers.High || tiers.High >= tiers.VeryHigh {
+		return fmt.Errorf("range tiers must be positive and increasing: %+v", tiers)
+	}
 	if cfg.Iv3.Unit != "mmol/L" && cfg.Iv3.Unit != "mg/dL" {
 		return fmt.Errorf("incorrect unit provided: %s", cfg.Iv3.Unit)
 	}
+	return nil
+}
 
+func (cfg *DexcomConfig) verify() error {
+	if cfg.Region == "" {
+		cfg.Region = DexcomRegionUS
+	}
+	switch cfg.Region {
+	case DexcomRegionUS, DexcomRegionOUS, DexcomRegionJP:
+	default:
+		return fmt.Errorf("incorrect Dexcom region provided: %s", cfg.Region)
+	}
+	if cfg.URL != "" {
+		u, err := url.Parse(cfg.URL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("incorrect Dexcom url provided: %s", cfg.URL)
+		}
+	}
 	return nil
 }
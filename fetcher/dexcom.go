@@ -3,86 +3,164 @@ package fetcher
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/algao1/iv3/config"
 	"github.com/algao1/iv3/store"
 	"go.uber.org/zap"
 )
 
 const (
-	appID           = "d89443d2-327c-4a6f-89e5-496bbb0317db"
-	baseUrl         = "https://share2.dexcom.com/ShareWebServices/Services"
 	loginEndpoint   = "General/LoginPublisherAccountById"
 	authEndpoint    = "General/AuthenticatePublisherAccount"
 	glucoseEndpoint = "Publisher/ReadPublisherLatestGlucoseValues"
 
-	minuteMax = "1440"
-	countMax  = "288"
+	minuteMax = 1440
+	countMax  = 288
+
+	// After this many failed logins in a row, stop trying for a while
+	// so the account does not get locked out.
+	maxAuthFailures = 3
+	authCooldown    = 1 * time.Hour
+)
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errCircuitOpen        = errors.New("too many failed logins")
 )
 
-type GlucosePointsWriter interface {
-	WriteGlucosePoints(glucose []store.GlucosePoint) error
+var shareDateRegex = regexp.MustCompile(`^/?Date\((-?\d+)([+-]\d{4})?\)/?$`)
+
+// Share error codes that mean the account name or password is wrong.
+var invalidCredentialCodes = map[string]bool{
+	"AccountPasswordInvalid":              true,
+	"SSO_AuthenticateAccountNotFound":     true,
+	"SSO_AuthenticatePasswordInvalid":     true,
+	"SSO_AuthenticateMaxAttemptsExceeed":  true,
+	"SSO_AuthenticateMaxAttemptsExceeded": true,
+}
+
+// Accounts registered outside of the US live on a separate server.
+var dexcomUrls = map[string]string{
+	config.DexcomRegionUS:  "https://share2.dexcom.com/ShareWebServices/Services",
+	config.DexcomRegionOUS: "https://shareous1.dexcom.com/ShareWebServices/Services",
+	config.DexcomRegionJP:  "https://share.dexcom.jp/ShareWebServices/Services",
+}
+
+// The Japanese server only accepts its own application ID.
+var dexcomAppIDs = map[string]string{
+	config.DexcomRegionUS:  "d89443d2-327c-4a6f-89e5-496bbb0317db",
+	config.DexcomRegionOUS: "d89443d2-327c-4a6f-89e5-496bbb0317db",
+	config.DexcomRegionJP:  "d8665ade-9673-4e27-9ff6-92db4ce13d13",
+}
+
+// DexcomUrl returns the Share url for the region, defaulting to the US server.
+func DexcomUrl(region string) string {
+	if u, ok := dexcomUrls[region]; ok {
+		return u
+	}
+	return dexcomUrls[config.DexcomRegionUS]
+}
+
+// DexcomAppID returns the Share application ID for the region, defaulting
+// to the US one.
+func DexcomAppID(region string) string {
+	if id, ok := dexcomAppIDs[region]; ok {
+		return id
+	}
+	return dexcomAppIDs[config.DexcomRegionUS]
 }
 
 type DexcomClient struct {
 	client  *http.Client
-	writers []GlucosePointsWriter
+	poller  *poller
+	history GlucoseHistory
 	logger  *zap.Logger
 
+	// Circuit breaker state for logins.
+	authFailures int
+	breakerUntil time.Time
+	// now is the breaker's clock, so tests can move it past the cooldown.
+	now func() time.Time
+
+	baseUrl     string
+	appID       string
 	accountName string
 	password    string
 	accountID   string
 	sessionID   string
 }
 
-func NewDexcom(account, password string,
-	writers []GlucosePointsWriter, logger *zap.Logger) *DexcomClient {
+func NewDexcom(baseUrl, appID, account, password string,
+	writers []GlucosePointsWriter, history GlucoseHistory, logger *zap.Logger) *DexcomClient {
 	client := &DexcomClient{
 		client:      &http.Client{Timeout: 5 * time.Second},
-		writers:     writers,
+		history:     history,
 		logger:      logger,
+		now:         time.Now,
+		baseUrl:     baseUrl,
+		appID:       appID,
 		accountName: account,
 		password:    password,
 	}
-	client.createSession()
-	go client.writePeriodic()
+	client.poller = newPoller(client, writers, history, logger)
 	return client
 }
 
-func (c *DexcomClient) writePeriodic() {
-	for {
-		glucose, err := c.Glucose()
-		if err != nil {
-			c.logger.Error("unable to get glucose points", zap.Error(err))
-			time.Sleep(10 * time.Second)
-			continue
-		}
+func (c *DexcomClient) Start() error {
+	if err := c.createSession(); err != nil {
+		// Not fatal, the poller will try to recreate the session.
+		c.logger.Warn("unable to create initial session", zap.Error(err))
+	}
+	go c.poller.run()
+	return nil
+}
 
-		for _, writer := range c.writers {
-			err := writer.WriteGlucosePoints(glucose)
-			if err != nil {
-				c.logger.Error("unable to write glucose points to writer", zap.Error(err))
-			}
-		}
+func (c *DexcomClient) Stop() {
+	c.poller.stop()
+}
+
+func (c *DexcomClient) Latest() ([]store.GlucosePoint, error) {
+	return c.Glucose(minuteMax, countMax)
+}
+
+// Backfill returns the points between start and end. Share only keeps
+// the past 24 hours, so anything older than that is not returned.
+func (c *DexcomClient) Backfill(start, end time.Time) ([]store.GlucosePoint, error) {
+	minutes := int(time.Since(start).Minutes()) + 1
+	if minutes <= 0 {
+		return []store.GlucosePoint{}, nil
+	}
+	if minutes > minuteMax {
+		minutes = minuteMax
+	}
+
+	glucose, err := c.Glucose(minutes, countMax)
+	if err != nil {
+		return nil, err
+	}
 
-		dur := 5 * time.Minute
-		if len(glucose) > 0 {
-			dur = time.Until(glucose[0].Time.Add(5*time.Minute + 10*time.Second))
+	filtered := make([]store.GlucosePoint, 0, len(glucose))
+	for _, gp := range glucose {
+		if !gp.Time.Before(start) && !gp.Time.After(end) {
+			filtered = append(filtered, gp)
 		}
-		time.Sleep(dur)
 	}
+	return filtered, nil
 }
 
-func (c *DexcomClient) Glucose() ([]store.GlucosePoint, error) {
+func (c *DexcomClient) Glucose(minutes, maxCount int) ([]store.GlucosePoint, error) {
 	// This is very rudimentary retry logic.
 	// We only retry once on failure, try to recreate session again.
-	glucose, err := c.glucose()
+	glucose, err := c.glucose(minutes, maxCount)
 	if err == nil {
 		return glucose, nil
 	}
@@ -91,20 +169,20 @@ func (c *DexcomClient) Glucose() ([]store.GlucosePoint, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to create session: %w", err)
 	}
-	return c.glucose()
+	return c.glucose(minutes, maxCount)
 }
 
 func (c *DexcomClient) getAccountId() error {
 	req := authRequest{
 		AccountName:   c.accountName,
 		Password:      c.password,
-		ApplicationID: appID,
+		ApplicationID: c.appID,
 	}
-	authUrl, _ := url.JoinPath(baseUrl, authEndpoint)
+	authUrl, _ := url.JoinPath(c.baseUrl, authEndpoint)
 
 	body, err := c.makeRequest(req, authUrl, http.MethodPost)
 	if err != nil {
-		c.logger.Warn("unable to make auth request", zap.Any("request", req), zap.Error(err))
+		c.logger.Warn("unable to make auth request", zap.String("accountName", c.accountName), zap.Error(err))
 		return fmt.Errorf("unable to make request: %w", err)
 	}
 	c.accountID = strings.Trim(string(body), "\"")
@@ -113,7 +191,46 @@ func (c *DexcomClient) getAccountId() error {
 	return nil
 }
 
+// createSession logs in, unless there have been too many failed logins
+// recently. In that case it waits out the cooldown before trying again.
 func (c *DexcomClient) createSession() error {
+	if c.now().Before(c.breakerUntil) {
+		return fmt.Errorf("%w, not retrying until %s", errCircuitOpen, c.breakerUntil.Format(time.RFC3339))
+	}
+
+	err := c.login()
+	if err == nil {
+		c.authFailures = 0
+		return nil
+	}
+	if !errors.Is(err, errInvalidCredentials) {
+		return err
+	}
+
+	c.authFailures++
+	if c.authFailures >= maxAuthFailures {
+		c.breakerUntil = c.now().Add(authCooldown)
+		c.logger.Error("too many failed logins, pausing logins",
+			zap.Int("failures", c.authFailures),
+			zap.Time("until", c.breakerUntil),
+		)
+		c.recordInvalidCredentials(err)
+	}
+	return err
+}
+
+func (c *DexcomClient) recordInvalidCredentials(err error) {
+	werr := c.history.WriteEventPoint(store.EventPoint{
+		Event:   store.InvalidCredentialsEvent,
+		Message: fmt.Sprintf("Dexcom Share login failed %d times: %s", c.authFailures, err),
+		Time:    c.now(),
+	})
+	if werr != nil {
+		c.logger.Error("unable to write invalid credentials event", zap.Error(werr))
+	}
+}
+
+func (c *DexcomClient) login() error {
 	if c.accountID == "" {
 		if err := c.getAccountId(); err != nil {
 			return fmt.Errorf("unable to create session: %w", err)
@@ -123,13 +240,13 @@ func (c *DexcomClient) createSession() error {
 	req := loginRequest{
 		AccountID:     c.accountID,
 		Password:      c.password,
-		ApplicationID: appID,
+		ApplicationID: c.appID,
 	}
-	loginUrl, _ := url.JoinPath(baseUrl, loginEndpoint)
+	loginUrl, _ := url.JoinPath(c.baseUrl, loginEndpoint)
 
 	body, err := c.makeRequest(req, loginUrl, http.MethodPost)
 	if err != nil {
-		c.logger.Warn("unable to make session request", zap.Any("request", req), zap.Error(err))
+		c.logger.Warn("unable to make session request", zap.Error(err))
 		return fmt.Errorf("unable to make request: %w", err)
 	}
 	c.sessionID = strings.Trim(string(body), "\"")
@@ -138,13 +255,13 @@ func (c *DexcomClient) createSession() error {
 	return nil
 }
 
-func (c *DexcomClient) glucose() ([]store.GlucosePoint, error) {
+func (c *DexcomClient) glucose(minutes, maxCount int) ([]store.GlucosePoint, error) {
 	params := url.Values{
 		"sessionId": {c.sessionID},
-		"minutes":   {minuteMax},
-		"maxCount":  {countMax},
+		"minutes":   {strconv.Itoa(minutes)},
+		"maxCount":  {strconv.Itoa(maxCount)},
 	}
-	glucoseUrl, _ := url.JoinPath(baseUrl, glucoseEndpoint)
+	glucoseUrl, _ := url.JoinPath(c.baseUrl, glucoseEndpoint)
 	glucoseUrl = glucoseUrl + "?" + params.Encode()
 
 	body, err := c.makeRequest(nil, glucoseUrl, http.MethodGet)
@@ -160,17 +277,54 @@ func (c *DexcomClient) glucose() ([]store.GlucosePoint, error) {
 	}
 
 	for i, gp := range glucose {
-		parsedTime := strings.Trim(gp.WT[4:], "()")
-		unixMs, err := strconv.Atoi(parsedTime)
+		ts, _, err := parseShareDate(gp.WT)
 		if err != nil {
-			return nil, fmt.Errorf("unable to convert to int: %w", err)
+			return nil, fmt.Errorf("unable to parse WT: %w", err)
+		}
+		glucose[i].Time = ts
+
+		// Only the display time carries the receiver's offset, the other
+		// two are always in UTC. ST (system time) is not parsed, since it
+		// is the receiver's own clock, which can drift from WT, and WT is
+		// what Share orders readings by.
+		if gp.DT != "" {
+			_, offset, err := parseShareDate(gp.DT)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse DT: %w", err)
+			}
+			glucose[i].UTCOffset = offset
 		}
-		glucose[i].Time = time.UnixMilli(int64(unixMs))
 	}
 
 	return glucose, nil
 }
 
+// parseShareDate parses Share timestamps, which look like "Date(1691455258000)",
+// "Date(1691455258000-0400)" or "/Date(1691455258000-0400)/". It returns the
+// time, and the offset from UTC in seconds (0 if there is none).
+func parseShareDate(s string) (time.Time, int, error) {
+	m := shareDateRegex.FindStringSubmatch(s)
+	if m == nil {
+		return time.Time{}, 0, fmt.Errorf("unexpected date format: %q", s)
+	}
+
+	unixMs, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("unable to convert to int: %w", err)
+	}
+
+	offset := 0
+	if m[2] != "" {
+		hours, _ := strconv.Atoi(m[2][1:3])
+		minutes, _ := strconv.Atoi(m[2][3:5])
+		offset = hours*3600 + minutes*60
+		if m[2][0] == '-' {
+			offset = -offset
+		}
+	}
+	return time.UnixMilli(unixMs), offset, nil
+}
+
 func (c *DexcomClient) makeRequest(req any, url, method string) ([]byte, error) {
 	b, err := json.Marshal(req)
 	if err != nil {
@@ -188,7 +342,25 @@ func (c *DexcomClient) makeRequest(req any, url, method string) ([]byte, error)
 		return nil, fmt.Errorf("unable to execute request: %w", err)
 	}
 	defer resp.Body.Close()
-	return io.ReadAll(resp.Body)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var shareErr shareError
+		json.Unmarshal(body, &shareErr)
+		if invalidCredentialCodes[shareErr.Code] {
+			return nil, fmt.Errorf("%w: %s", errInvalidCredentials, shareErr.Code)
+		}
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+type shareError struct {
+	Code    string `json:"Code"`
+	Message string `json:"Message"`
 }
 
 type loginRequest struct {
@@ -0,0 +1,216 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/algao1/iv3/config"
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+// fakeShare stands in for Dexcom Share, and records the application IDs
+// it is sent.
+type fakeShare struct {
+	mu     sync.Mutex
+	appIDs []string
+	logins int
+	// invalid makes every login fail with a bad password.
+	invalid bool
+}
+
+func (f *fakeShare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, authEndpoint), strings.HasSuffix(r.URL.Path, loginEndpoint):
+		f.logins++
+		var req struct {
+			ApplicationID string `json:"applicationId"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.appIDs = append(f.appIDs, req.ApplicationID)
+		if f.invalid {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"Code":"AccountPasswordInvalid","Message":"bad password"}`))
+			return
+		}
+		w.Write([]byte(`"00000000-0000-0000-0000-000000000001"`))
+	case strings.HasSuffix(r.URL.Path, glucoseEndpoint):
+		w.Write([]byte(`[{"WT":"Date(1691455258000)","ST":"Date(1691455258000)","DT":"Date(1691455258000-0400)","Value":120,"Trend":"Flat"}]`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestDexcom(t *testing.T, share *fakeShare, region string) (*DexcomClient, *store.MemoryStore) {
+	t.Helper()
+	srv := httptest.NewServer(share)
+	t.Cleanup(srv.Close)
+
+	st := store.NewMemoryStore()
+	client := NewDexcom(srv.URL, DexcomAppID(region), "account", "password",
+		nil, st, zap.NewNop())
+	return client, st
+}
+
+func TestDexcomRegions(t *testing.T) {
+	tests := []struct {
+		region string
+		url    string
+		appID  string
+	}{
+		{config.DexcomRegionUS, "https://share2.dexcom.com/ShareWebServices/Services", "d89443d2-327c-4a6f-89e5-496bbb0317db"},
+		{config.DexcomRegionOUS, "https://shareous1.dexcom.com/ShareWebServices/Services", "d89443d2-327c-4a6f-89e5-496bbb0317db"},
+		{config.DexcomRegionJP, "https://share.dexcom.jp/ShareWebServices/Services", "d8665ade-9673-4e27-9ff6-92db4ce13d13"},
+		{"unknown", "https://share2.dexcom.com/ShareWebServices/Services", "d89443d2-327c-4a6f-89e5-496bbb0317db"},
+	}
+	for _, tt := range tests {
+		if got := DexcomUrl(tt.region); got != tt.url {
+			t.Errorf("region %q: expected url %s, got %s", tt.region, tt.url, got)
+		}
+		if got := DexcomAppID(tt.region); got != tt.appID {
+			t.Errorf("region %q: expected app ID %s, got %s", tt.region, tt.appID, got)
+		}
+	}
+}
+
+func TestDexcomLoginSendsRegionAppID(t *testing.T) {
+	share := &fakeShare{}
+	client, _ := newTestDexcom(t, share, config.DexcomRegionJP)
+	if err := client.createSession(); err != nil {
+		t.Fatal(err)
+	}
+
+	share.mu.Lock()
+	defer share.mu.Unlock()
+	if len(share.appIDs) != 2 {
+		t.Fatalf("expected an auth and a login request, got %d", len(share.appIDs))
+	}
+	for _, id := range share.appIDs {
+		if id != "d8665ade-9673-4e27-9ff6-92db4ce13d13" {
+			t.Errorf("expected the JP app ID, got %s", id)
+		}
+	}
+}
+
+func (f *fakeShare) setInvalid(invalid bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.invalid = invalid
+}
+
+func (f *fakeShare) loginCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.logins
+}
+
+func TestDexcomCircuitBreaker(t *testing.T) {
+	share := &fakeShare{invalid: true}
+	client, st := newTestDexcom(t, share, config.DexcomRegionUS)
+	now := time.Now()
+	client.now = func() time.Time { return now }
+
+	invalidEvents := func() int {
+		t.Helper()
+		events, err := st.ReadEventPoints(0, int(now.Add(2*authCooldown).Unix()), store.WithEvent(store.InvalidCredentialsEvent))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(events)
+	}
+
+	for i := 1; i <= maxAuthFailures; i++ {
+		if err := client.createSession(); !errors.Is(err, errInvalidCredentials) {
+			t.Fatalf("login %d: expected invalid credentials, got %v", i, err)
+		}
+		want := 0
+		if i == maxAuthFailures {
+			want = 1
+		}
+		if got := invalidEvents(); got != want {
+			t.Fatalf("login %d: expected %d invalid credentials events, got %d", i, want, got)
+		}
+	}
+
+	// Once open, logins are not even attempted until the cooldown is over.
+	logins := share.loginCount()
+	now = now.Add(authCooldown / 2)
+	if err := client.createSession(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected the circuit to be open, got %v", err)
+	}
+	if got := share.loginCount(); got != logins {
+		t.Errorf("expected no logins while open, got %d", got-logins)
+	}
+	if got := invalidEvents(); got != 1 {
+		t.Errorf("expected a single invalid credentials event, got %d", got)
+	}
+
+	// After the cooldown, logins are tried again and success resets it.
+	now = now.Add(authCooldown / 2)
+	share.setInvalid(false)
+	if err := client.createSession(); err != nil {
+		t.Fatalf("expected login to succeed after the cooldown, got %v", err)
+	}
+	if client.authFailures != 0 {
+		t.Errorf("expected the failures to be reset, got %d", client.authFailures)
+	}
+}
+
+func TestParseShareDate(t *testing.T) {
+	tests := []struct {
+		in      string
+		unixMs  int64
+		offset  int
+		wantErr bool
+	}{
+		{in: "Date(1691455258000)", unixMs: 1691455258000},
+		{in: "Date(1691455258000-0400)", unixMs: 1691455258000, offset: -4 * 3600},
+		{in: "Date(1691455258000+0530)", unixMs: 1691455258000, offset: 5*3600 + 30*60},
+		{in: "Date(1691455258000+0000)", unixMs: 1691455258000},
+		{in: "/Date(1691455258000-0330)/", unixMs: 1691455258000, offset: -(3*3600 + 30*60)},
+		{in: "", wantErr: true},
+		{in: "1691455258000", wantErr: true},
+		{in: "Date()", wantErr: true},
+		{in: "Date(abc)", wantErr: true},
+		{in: "Date(1691455258000-04)", wantErr: true},
+		{in: "Date(1691455258000)Z", wantErr: true},
+		{in: "Date(99999999999999999999)", wantErr: true},
+	}
+	for _, tt := range tests {
+		ts, offset, err := parseShareDate(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: expected error %v, got %v", tt.in, tt.wantErr, err)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if ts.UnixMilli() != tt.unixMs || offset != tt.offset {
+			t.Errorf("%q: expected %d with offset %d, got %d with offset %d",
+				tt.in, tt.unixMs, tt.offset, ts.UnixMilli(), offset)
+		}
+	}
+}
+
+func TestDexcomGlucoseUsesDisplayOffset(t *testing.T) {
+	client, _ := newTestDexcom(t, &fakeShare{}, config.DexcomRegionUS)
+	glucose, err := client.Glucose(minuteMax, countMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(glucose) != 1 {
+		t.Fatalf("expected 1 point, got %d", len(glucose))
+	}
+	if gp := glucose[0]; gp.Time.UnixMilli() != 1691455258000 || gp.UTCOffset != -4*3600 {
+		t.Errorf("expected the WT with the DT offset, got %s with offset %d", gp.Time, gp.UTCOffset)
+	}
+}
@@ -0,0 +1,257 @@
+package fetcher
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+const (
+	GlucoseGapEvent = "glucose_gap"
+
+	// Readings are every 5 minutes, so anything longer than this is
+	// considered to be a gap.
+	maxReadingGap = 15 * time.Minute
+
+	minErrBackoff = 10 * time.Second
+	maxErrBackoff = 10 * time.Minute
+
+	// Polls are timed off the newest reading, but never closer together
+	// than minPollInterval. If the newest reading is stale, the sensor is
+	// likely down, so fall back to polling every pollInterval.
+	pollInterval    = 5 * time.Minute
+	minPollInterval = 30 * time.Second
+)
+
+type GlucosePointsWriter interface {
+	WriteGlucosePoints(glucose []store.GlucosePoint) error
+}
+
+// GlucoseHistory is used to find, and record gaps in the persisted glucose.
+type GlucoseHistory interface {
+	ReadLatestGlucosePoint() (*store.GlucosePoint, error)
+	WriteEventPoint(event store.EventPoint) error
+}
+
+// Source is anything that can provide CGM readings. Points are always
+// returned newest first, which is the order Dexcom Share uses.
+type Source interface {
+	Start() error
+	Stop()
+	Latest() ([]store.GlucosePoint, error)
+	Backfill(start, end time.Time) ([]store.GlucosePoint, error)
+}
+
+// poller periodically fetches the latest readings from a source,
+// and writes them to all the writers.
+type poller struct {
+	source  Source
+	queues  []*writerQueue
+	history GlucoseHistory
+	logger  *zap.Logger
+
+	// marks holds the newest point handed off to each writer, so we only
+	// forward new points. These start out as zero, so the first poll
+	// resyncs the full window.
+	marks []time.Time
+	// seen holds the times (in ms) of the points from the last poll and
+	// backfill. Readings the sensor fills in late, e.g. after losing
+	// signal, are older than the marks, and are forwarded since they were
+	// not seen before.
+	seen map[int64]bool
+	// gapStart is the start of the last gap recorded, so a gap that is
+	// still ongoing is only recorded once, however often we backfill.
+	gapStart time.Time
+
+	done chan struct{}
+}
+
+func newPoller(source Source, writers []GlucosePointsWriter,
+	history GlucoseHistory, logger *zap.Logger) *poller {
+	p := &poller{
+		source:  source,
+		history: history,
+		logger:  logger,
+		marks:   make([]time.Time, len(writers)),
+		seen:    make(map[int64]bool),
+		done:    make(chan struct{}),
+	}
+	for _, writer := range writers {
+		p.queues = append(p.queues, newWriterQueue(writer, spoolDir, p.done, logger))
+	}
+	return p
+}
+
+func (p *poller) stop() {
+	close(p.done)
+}
+
+func (p *poller) run() {
+	for _, q := range p.queues {
+		go q.run()
+	}
+
+	// Always check for gaps on startup, and after any errors since
+	// we might have been down for a while.
+	needsBackfill := true
+	errBackoff := minErrBackoff
+	for {
+		if needsBackfill {
+			if err := p.fillGaps(); err != nil {
+				p.logger.Error("unable to fill glucose gaps", zap.Error(err))
+			} else {
+				needsBackfill = false
+			}
+		}
+
+		glucose, err := p.source.Latest()
+		if err != nil {
+			p.logger.Error("unable to get glucose points", zap.Error(err))
+			needsBackfill = true
+			if !p.sleep(jitter(errBackoff)) {
+				return
+			}
+			errBackoff = min(2*errBackoff, maxErrBackoff)
+			continue
+		}
+		errBackoff = minErrBackoff
+		p.write(glucose)
+
+		if !p.sleep(nextPoll(glucose, time.Now())) {
+			return
+		}
+	}
+}
+
+// nextPoll returns how long to wait before the next poll, aiming for just
+// after the next reading is due.
+func nextPoll(glucose []store.GlucosePoint, now time.Time) time.Duration {
+	if len(glucose) == 0 {
+		return pollInterval
+	}
+	dur := glucose[0].Time.Add(pollInterval + 10*time.Second).Sub(now)
+	if dur < 0 {
+		return pollInterval
+	}
+	return max(dur, minPollInterval)
+}
+
+// write forwards the points newer than each writer's high-water mark,
+// and any older ones that were filled in since the last poll. The queues
+// take care of retrying failed writes, so the marks can be moved forward
+// right away.
+func (p *poller) write(glucose []store.GlucosePoint) {
+	for i, q := range p.queues {
+		points := make([]store.GlucosePoint, 0, len(glucose))
+		newest := p.marks[i]
+		for _, gp := range glucose {
+			if gp.Time.After(p.marks[i]) || !p.seen[gp.Time.UnixMilli()] {
+				points = append(points, gp)
+			}
+			if gp.Time.After(newest) {
+				newest = gp.Time
+			}
+		}
+		if len(points) == 0 {
+			continue
+		}
+		q.enqueue(points)
+		p.marks[i] = newest
+	}
+
+	p.seen = make(map[int64]bool, len(glucose))
+	for _, gp := range glucose {
+		p.seen[gp.Time.UnixMilli()] = true
+	}
+}
+
+// writeAll writes all the points regardless of the high-water marks.
+func (p *poller) writeAll(glucose []store.GlucosePoint) {
+	for _, q := range p.queues {
+		q.enqueue(glucose)
+	}
+}
+
+// fillGaps backfills everything after the newest persisted point. Anything
+// the source can no longer provide is recorded as an event.
+func (p *poller) fillGaps() error {
+	latest, err := p.history.ReadLatestGlucosePoint()
+	if err != nil {
+		return fmt.Errorf("unable to read latest glucose point: %w", err)
+	}
+	if latest == nil || time.Since(latest.Time) <= maxReadingGap {
+		return nil
+	}
+
+	glucose, err := p.source.Backfill(latest.Time.Add(time.Second), time.Now())
+	if err != nil {
+		return fmt.Errorf("unable to backfill glucose points: %w", err)
+	}
+	p.logger.Info("backfilled glucose points",
+		zap.Time("since", latest.Time),
+		zap.Int("count", len(glucose)),
+	)
+	if len(glucose) > 0 {
+		// Backfilled points are older than what the next poll returns,
+		// so they should not move the high-water marks, but they should
+		// not be forwarded again either.
+		p.writeAll(glucose)
+		for _, gp := range glucose {
+			p.seen[gp.Time.UnixMilli()] = true
+		}
+	}
+
+	// Points are newest first, so walk backwards. Whatever is missing up
+	// to now is a gap too, including everything if nothing was returned.
+	prev := latest.Time
+	for i := len(glucose) - 1; i >= 0; i-- {
+		if glucose[i].Time.Sub(prev) > maxReadingGap {
+			p.recordGap(prev, glucose[i].Time)
+		}
+		prev = glucose[i].Time
+	}
+	if now := time.Now(); now.Sub(prev) > maxReadingGap {
+		p.recordGap(prev, now)
+	}
+	return nil
+}
+
+func (p *poller) recordGap(start, end time.Time) {
+	if start.Equal(p.gapStart) {
+		return
+	}
+	p.gapStart = start
+	p.logger.Warn("unrecoverable gap in glucose", zap.Time("start", start), zap.Time("end", end))
+	err := p.history.WriteEventPoint(store.EventPoint{
+		Event: GlucoseGapEvent,
+		Message: fmt.Sprintf("No glucose between %s and %s",
+			start.Format(time.RFC3339),
+			end.Format(time.RFC3339),
+		),
+		Time: end,
+	})
+	if err != nil {
+		p.logger.Error("unable to write gap event", zap.Error(err))
+	}
+}
+
+// jitter returns a random duration between d/2 and d, so retries
+// do not all line up.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + rand.N(d/2+1)
+}
+
+// sleep waits for d, and returns false if the poller was stopped in the meantime.
+func (p *poller) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
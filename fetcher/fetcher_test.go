@@ -0,0 +1,227 @@
+package fetcher
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+// fakeSource returns the readings it has between start and end,
+// newest first like a real source.
+type fakeSource struct {
+	glucose []store.GlucosePoint
+}
+
+func (s *fakeSource) Start() error { return nil }
+func (s *fakeSource) Stop()        {}
+
+func (s *fakeSource) Latest() ([]store.GlucosePoint, error) {
+	return s.glucose, nil
+}
+
+func (s *fakeSource) Backfill(start, end time.Time) ([]store.GlucosePoint, error) {
+	filtered := make([]store.GlucosePoint, 0)
+	for _, gp := range s.glucose {
+		if !gp.Time.Before(start) && !gp.Time.After(end) {
+			filtered = append(filtered, gp)
+		}
+	}
+	return filtered, nil
+}
+
+// readings returns readings every 5 minutes in [from, to), newest first.
+func readings(from, to time.Time) []store.GlucosePoint {
+	var glucose []store.GlucosePoint
+	for ts := to.Add(-5 * time.Minute); !ts.Before(from); ts = ts.Add(-5 * time.Minute) {
+		glucose = append(glucose, store.GlucosePoint{Value: 100, Time: ts})
+	}
+	return glucose
+}
+
+func TestNextPoll(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		glucose []store.GlucosePoint
+		want    time.Duration
+	}{
+		{name: "no readings", want: pollInterval},
+		{
+			name:    "fresh reading",
+			glucose: []store.GlucosePoint{{Time: now.Add(-1 * time.Minute)}},
+			want:    4*time.Minute + 10*time.Second,
+		},
+		{
+			name:    "reading almost due",
+			glucose: []store.GlucosePoint{{Time: now.Add(-5 * time.Minute)}},
+			want:    minPollInterval,
+		},
+		{
+			name:    "stale reading",
+			glucose: []store.GlucosePoint{{Time: now.Add(-1 * time.Hour)}},
+			want:    pollInterval,
+		},
+	}
+	for _, tt := range tests {
+		if got := nextPoll(tt.glucose, now); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestFillGaps(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		latest   time.Time
+		source   []store.GlucosePoint
+		backfill int
+		gaps     [][2]time.Time
+	}{
+		{
+			name:   "up to date",
+			latest: now.Add(-5 * time.Minute),
+			source: readings(now.Add(-1*time.Hour), now),
+		},
+		{
+			name:     "backfilled",
+			latest:   now.Add(-1 * time.Hour),
+			source:   readings(now.Add(-2*time.Hour), now),
+			backfill: 11,
+		},
+		{
+			name:     "gap before backfill",
+			latest:   now.Add(-3 * time.Hour),
+			source:   readings(now.Add(-1*time.Hour), now),
+			backfill: 12,
+			gaps:     [][2]time.Time{{now.Add(-3 * time.Hour), now.Add(-1 * time.Hour)}},
+		},
+		{
+			name:   "nothing to backfill",
+			latest: now.Add(-1 * time.Hour),
+			gaps:   [][2]time.Time{{now.Add(-1 * time.Hour), now}},
+		},
+	}
+	for _, tt := range tests {
+		st := store.NewMemoryStore()
+		st.WriteGlucosePoints([]store.GlucosePoint{{Value: 100, Time: tt.latest}})
+		w := &fakeWriter{}
+		p := newPoller(&fakeSource{glucose: tt.source}, []GlucosePointsWriter{w}, st, zap.NewNop())
+
+		// Backfilling again should not record the same gap twice.
+		for i := 0; i < 2; i++ {
+			if err := p.fillGaps(); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+
+		backfilled := 0
+		for len(p.queues[0].batches) > 0 {
+			backfilled += len(<-p.queues[0].batches)
+		}
+		if backfilled != 2*tt.backfill {
+			t.Errorf("%s: expected %d points to be backfilled twice, got %d", tt.name, tt.backfill, backfilled)
+		}
+
+		events, err := st.ReadEventPoints(0, int(now.Add(time.Hour).Unix()), store.WithEvent(GlucoseGapEvent))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != len(tt.gaps) {
+			t.Errorf("%s: expected %d gaps, got %+v", tt.name, len(tt.gaps), events)
+			continue
+		}
+		for i, gap := range tt.gaps {
+			// The last gap ends whenever fillGaps ran, so allow some slack.
+			if events[i].Time.Sub(gap[1]).Abs() > time.Second {
+				t.Errorf("%s: expected gap %d to end at %s, got %s", tt.name, i, gap[1], events[i].Time)
+			}
+		}
+	}
+}
+
+// queued returns the times of the points waiting in the queue, oldest
+// first.
+func queued(q *writerQueue) []time.Time {
+	var times []time.Time
+	for len(q.batches) > 0 {
+		for _, gp := range <-q.batches {
+			times = append(times, gp.Time)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times
+}
+
+func TestPollerWrite(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes ...int) []store.GlucosePoint {
+		// Newest first, like a real source.
+		glucose := make([]store.GlucosePoint, len(minutes))
+		for i, m := range minutes {
+			glucose[len(minutes)-1-i] = store.GlucosePoint{Value: 100, Time: start.Add(time.Duration(m) * time.Minute)}
+		}
+		return glucose
+	}
+	p := newPoller(&fakeSource{}, []GlucosePointsWriter{&fakeWriter{}, &fakeWriter{}}, store.NewMemoryStore(), zap.NewNop())
+
+	tests := []struct {
+		name    string
+		glucose []store.GlucosePoint
+		// setup runs before the poll, and want is the minutes each
+		// writer should be sent.
+		setup func()
+		want  [2][]int
+	}{
+		{
+			name:    "first poll resyncs everything",
+			glucose: at(0, 5, 10),
+			want:    [2][]int{{0, 5, 10}, {0, 5, 10}},
+		},
+		{
+			name:    "only new points",
+			glucose: at(0, 5, 10, 15),
+			want:    [2][]int{{15}, {15}},
+		},
+		{
+			name:    "writer behind",
+			glucose: at(0, 5, 10, 15, 20),
+			// The second writer only has up to 5 minutes.
+			setup: func() { p.marks[1] = start.Add(5 * time.Minute) },
+			want:  [2][]int{{20}, {10, 15, 20}},
+		},
+		{
+			name: "late backfill",
+			// The sensor filled in a reading it missed.
+			glucose: at(0, 2, 5, 10, 15, 20, 25),
+			want:    [2][]int{{2, 25}, {2, 25}},
+		},
+		{
+			name:    "nothing new",
+			glucose: at(0, 2, 5, 10, 15, 20, 25),
+			want:    [2][]int{nil, nil},
+		},
+	}
+	for _, tt := range tests {
+		if tt.setup != nil {
+			tt.setup()
+		}
+		p.write(tt.glucose)
+		for i, q := range p.queues {
+			got := queued(q)
+			if len(got) != len(tt.want[i]) {
+				t.Errorf("%s: expected writer %d to be sent %v minutes, got %v", tt.name, i, tt.want[i], got)
+				continue
+			}
+			for j, m := range tt.want[i] {
+				if want := start.Add(time.Duration(m) * time.Minute); !got[j].Equal(want) {
+					t.Errorf("%s: expected writer %d to be sent %v minutes, got %v", tt.name, i, tt.want[i], got)
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package fetcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+const (
+	LibreLinkUpUrl = "https://api.libreview.io"
+
+	lluLoginEndpoint       = "llu/auth/login"
+	lluConnectionsEndpoint = "llu/connections"
+	lluGraphEndpoint       = "graph"
+
+	lluProduct   = "llu.android"
+	lluVersion   = "4.12.0"
+	lluTimestamp = "1/2/2006 3:04:05 PM"
+)
+
+// Libre only has 5 trend arrows, these are mapped onto the closest
+// Dexcom equivalents.
+var libreTrends = map[int]store.Trend{
+	0: store.TrendNone,
+	1: store.TrendSingleDown,
+	2: store.TrendFortyFiveDown,
+	3: store.TrendFlat,
+	4: store.TrendFortyFiveUp,
+	5: store.TrendSingleUp,
+}
+
+type LibreLinkUpClient struct {
+	client *http.Client
+	poller *poller
+	logger *zap.Logger
+
+	baseUrl   string
+	email     string
+	password  string
+	token     string
+	accountID string
+	patientID string
+}
+
+func NewLibreLinkUp(baseUrl, email, password string,
+	writers []GlucosePointsWriter, history GlucoseHistory, logger *zap.Logger) *LibreLinkUpClient {
+	client := &LibreLinkUpClient{
+		client:   &http.Client{Timeout: 5 * time.Second},
+		logger:   logger,
+		baseUrl:  baseUrl,
+		email:    email,
+		password: password,
+	}
+	client.poller = newPoller(client, writers, history, logger)
+	return client
+}
+
+func (c *LibreLinkUpClient) Start() error {
+	if err := c.createSession(); err != nil {
+		// Not fatal, the poller will try to recreate the session.
+		c.logger.Warn("unable to create initial session", zap.Error(err))
+	}
+	go c.poller.run()
+	return nil
+}
+
+func (c *LibreLinkUpClient) Stop() {
+	c.poller.stop()
+}
+
+func (c *LibreLinkUpClient) Latest() ([]store.GlucosePoint, error) {
+	// Same retry logic as the Dexcom client, recreate the session once.
+	glucose, err := c.graph()
+	if err == nil {
+		return glucose, nil
+	}
+
+	err = c.createSession()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create session: %w", err)
+	}
+	return c.graph()
+}
+
+// Backfill returns the points between start and end. The graph endpoint
+// only covers the past 12 hours, so anything older than that is not returned.
+func (c *LibreLinkUpClient) Backfill(start, end time.Time) ([]store.GlucosePoint, error) {
+	glucose, err := c.Latest()
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]store.GlucosePoint, 0, len(glucose))
+	for _, gp := range glucose {
+		if !gp.Time.Before(start) && !gp.Time.After(end) {
+			filtered = append(filtered, gp)
+		}
+	}
+	return filtered, nil
+}
+
+func (c *LibreLinkUpClient) createSession() error {
+	c.token = ""
+	req := lluLoginRequest{
+		Email:    c.email,
+		Password: c.password,
+	}
+
+	var resp lluLoginResponse
+	if err := c.makeRequest(req, lluLoginEndpoint, http.MethodPost, &resp); err != nil {
+		return fmt.Errorf("unable to login: %w", err)
+	}
+
+	// Accounts outside of the default region are redirected.
+	if resp.Data.Redirect {
+		regional, err := regionalUrl(c.baseUrl, resp.Data.Region)
+		if err != nil {
+			return fmt.Errorf("unable to redirect to region %s: %w", resp.Data.Region, err)
+		}
+		c.baseUrl = regional
+		c.logger.Info("redirected to regional server", zap.String("url", c.baseUrl))
+		if err := c.makeRequest(req, lluLoginEndpoint, http.MethodPost, &resp); err != nil {
+			return fmt.Errorf("unable to login: %w", err)
+		}
+	}
+	if resp.Data.AuthTicket.Token == "" {
+		return fmt.Errorf("no auth ticket returned, status %d", resp.Status)
+	}
+
+	c.token = resp.Data.AuthTicket.Token
+	accountHash := sha256.Sum256([]byte(resp.Data.User.ID))
+	c.accountID = hex.EncodeToString(accountHash[:])
+	c.logger.Info("succesfully logged in", zap.String("userID", resp.Data.User.ID))
+
+	var connResp lluConnectionsResponse
+	if err := c.makeRequest(nil, lluConnectionsEndpoint, http.MethodGet, &connResp); err != nil {
+		return fmt.Errorf("unable to list connections: %w", err)
+	}
+	if len(connResp.Data) == 0 {
+		return fmt.Errorf("no connections found for account")
+	}
+	// TODO: Let users pick the connection if there is more than one.
+	c.patientID = connResp.Data[0].PatientID
+	c.logger.Info("succesfully got patient ID", zap.String("patientID", c.patientID))
+
+	return nil
+}
+
+// regionalUrl returns the url of the regional server for baseUrl, which
+// adds the region to the first label of the host, e.g. api.libreview.io
+// becomes api-eu.libreview.io.
+func regionalUrl(baseUrl, region string) (string, error) {
+	u, err := url.Parse(baseUrl)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse url: %w", err)
+	}
+	label, domain, ok := strings.Cut(u.Hostname(), ".")
+	if !ok || region == "" {
+		return "", fmt.Errorf("no regional server for %s", u.Host)
+	}
+	// Drop the region if the base url is already a regional server.
+	label, _, _ = strings.Cut(label, "-")
+
+	host := label + "-" + region + "." + domain
+	if port := u.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	u.Host = host
+	return u.String(), nil
+}
+
+func (c *LibreLinkUpClient) graph() ([]store.GlucosePoint, error) {
+	if c.patientID == "" {
+		return nil, fmt.Errorf("no active session")
+	}
+
+	var resp lluGraphResponse
+	endpoint, _ := url.JoinPath(lluConnectionsEndpoint, c.patientID, lluGraphEndpoint)
+	if err := c.makeRequest(nil, endpoint, http.MethodGet, &resp); err != nil {
+		c.logger.Warn("unable to make graph request", zap.Error(err))
+		return nil, fmt.Errorf("unable to make request: %w", err)
+	}
+
+	measurements := append(resp.Data.GraphData, resp.Data.Connection.GlucoseMeasurement)
+	glucose := make([]store.GlucosePoint, 0, len(measurements))
+	seen := make(map[time.Time]bool)
+	for _, m := range measurements {
+		if m.FactoryTimestamp == "" {
+			continue
+		}
+		// FactoryTimestamp is in UTC, Timestamp is the sensor's local time.
+		ts, err := time.Parse(lluTimestamp, m.FactoryTimestamp)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse timestamp: %w", err)
+		}
+		if seen[ts] {
+			continue
+		}
+		seen[ts] = true
+
+		// The offset is the difference between the two, rounded to the
+		// nearest 15 minutes since they are not always the same second.
+		offset := 0
+		if local, err := time.Parse(lluTimestamp, m.Timestamp); err == nil {
+			offset = int(local.Sub(ts).Round(15*time.Minute) / time.Second)
+		}
+
+		glucose = append(glucose, store.GlucosePoint{
+			Value:     m.ValueInMgPerDl,
+			Trend:     libreTrends[m.TrendArrow],
+			Time:      ts,
+			UTCOffset: offset,
+		})
+	}
+
+	sort.Slice(glucose, func(i, j int) bool {
+		return glucose[i].Time.After(glucose[j].Time)
+	})
+	return glucose, nil
+}
+
+func (c *LibreLinkUpClient) makeRequest(req any, endpoint, method string, resp any) error {
+	var body io.Reader
+	if req != nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return fmt.Errorf("unable to marshal request: %w", err)
+		}
+		body = bytes.NewBuffer(b)
+	}
+
+	reqUrl, _ := url.JoinPath(c.baseUrl, endpoint)
+	httpReq, err := http.NewRequest(method, reqUrl, body)
+	if err != nil {
+		return fmt.Errorf("unable to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("product", lluProduct)
+	httpReq.Header.Set("version", lluVersion)
+	if c.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.token)
+		httpReq.Header.Set("account-id", c.accountID)
+	}
+
+	httpResp, err := c.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("unable to execute request: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	b, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response: %w", err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d: %s", httpResp.StatusCode, b)
+	}
+	if err = json.Unmarshal(b, resp); err != nil {
+		return fmt.Errorf("unable to unmarshal json: %w", err)
+	}
+	return nil
+}
+
+type lluLoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type lluLoginResponse struct {
+	Status int `json:"status"`
+	Data   struct {
+		Redirect bool   `json:"redirect"`
+		Region   string `json:"region"`
+		User     struct {
+			ID string `json:"id"`
+		} `json:"user"`
+		AuthTicket struct {
+			Token string `json:"token"`
+		} `json:"authTicket"`
+	} `json:"data"`
+}
+
+type lluConnectionsResponse struct {
+	Data []struct {
+		PatientID string `json:"patientId"`
+	} `json:"data"`
+}
+
+type lluMeasurement struct {
+	FactoryTimestamp string  `json:"FactoryTimestamp"`
+	Timestamp        string  `json:"Timestamp"`
+	ValueInMgPerDl   float64 `json:"ValueInMgPerDl"`
+	TrendArrow       int     `json:"TrendArrow"`
+}
+
+type lluGraphResponse struct {
+	Data struct {
+		Connection struct {
+			GlucoseMeasurement lluMeasurement `json:"glucoseMeasurement"`
+		} `json:"connection"`
+		GraphData []lluMeasurement `json:"graphData"`
+	} `json:"data"`
+}
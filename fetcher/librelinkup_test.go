@@ -0,0 +1,148 @@
+package fetcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+const lluGraphJSON = `{"data":{
+	"connection":{"glucoseMeasurement":{"FactoryTimestamp":"3/10/2024 7:10:00 PM","Timestamp":"3/10/2024 3:10:04 PM","ValueInMgPerDl":131,"TrendArrow":4}},
+	"graphData":[
+		{"FactoryTimestamp":"3/10/2024 7:00:00 PM","Timestamp":"3/10/2024 3:00:02 PM","ValueInMgPerDl":120,"TrendArrow":3},
+		{"FactoryTimestamp":"3/10/2024 7:05:00 PM","Timestamp":"3/10/2024 3:05:03 PM","ValueInMgPerDl":125,"TrendArrow":3},
+		{"FactoryTimestamp":"3/10/2024 7:10:00 PM","Timestamp":"3/10/2024 3:10:04 PM","ValueInMgPerDl":131,"TrendArrow":4}
+	]
+}}`
+
+// hostRecorder sends every request to the test server, whatever the
+// host, and records the hosts that were asked for.
+type hostRecorder struct {
+	target *url.URL
+
+	mu    sync.Mutex
+	hosts []string
+}
+
+func (h *hostRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	h.mu.Lock()
+	h.hosts = append(h.hosts, req.URL.Host)
+	h.mu.Unlock()
+
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = h.target.Scheme, h.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newFakeLibreLinkUp stands in for LibreLinkUp, redirecting logins to the
+// EU server unless they are made to it already.
+func newFakeLibreLinkUp(t *testing.T) (*LibreLinkUpClient, *hostRecorder) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /llu/auth/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "api-eu.libreview.example" {
+			w.Write([]byte(`{"status":0,"data":{"redirect":true,"region":"eu"}}`))
+			return
+		}
+		w.Write([]byte(`{"status":0,"data":{"user":{"id":"user-1"},"authTicket":{"token":"token-1"}}}`))
+	})
+	mux.HandleFunc("GET /llu/connections", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-1" || r.Header.Get("account-id") == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"data":[{"patientId":"patient-1"}]}`))
+	})
+	mux.HandleFunc("GET /llu/connections/patient-1/graph", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(lluGraphJSON))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	target, _ := url.Parse(srv.URL)
+	recorder := &hostRecorder{target: target}
+	client := NewLibreLinkUp("https://api.libreview.example", "email", "password",
+		nil, store.NewMemoryStore(), zap.NewNop())
+	client.client = &http.Client{Transport: recorder}
+	return client, recorder
+}
+
+func TestLibreLinkUpLogin(t *testing.T) {
+	client, recorder := newFakeLibreLinkUp(t)
+	if err := client.createSession(); err != nil {
+		t.Fatal(err)
+	}
+
+	if client.patientID != "patient-1" {
+		t.Errorf("expected patient-1, got %s", client.patientID)
+	}
+	want := []string{"api.libreview.example", "api-eu.libreview.example", "api-eu.libreview.example"}
+	if len(recorder.hosts) != len(want) {
+		t.Fatalf("expected requests to %v, got %v", want, recorder.hosts)
+	}
+	for i := range want {
+		if recorder.hosts[i] != want[i] {
+			t.Errorf("request %d: expected %s, got %s", i, want[i], recorder.hosts[i])
+		}
+	}
+}
+
+func TestLibreLinkUpGraph(t *testing.T) {
+	client, _ := newFakeLibreLinkUp(t)
+	if err := client.createSession(); err != nil {
+		t.Fatal(err)
+	}
+	glucose, err := client.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Newest first, without the current reading being repeated.
+	want := []store.GlucosePoint{
+		{Value: 131, Trend: store.TrendFortyFiveUp, Time: time.Date(2024, 3, 10, 19, 10, 0, 0, time.UTC), UTCOffset: -4 * 3600},
+		{Value: 125, Trend: store.TrendFlat, Time: time.Date(2024, 3, 10, 19, 5, 0, 0, time.UTC), UTCOffset: -4 * 3600},
+		{Value: 120, Trend: store.TrendFlat, Time: time.Date(2024, 3, 10, 19, 0, 0, 0, time.UTC), UTCOffset: -4 * 3600},
+	}
+	if len(glucose) != len(want) {
+		t.Fatalf("expected %d points, got %d", len(want), len(glucose))
+	}
+	for i := range want {
+		got := glucose[i]
+		if got.Value != want[i].Value || got.Trend != want[i].Trend ||
+			!got.Time.Equal(want[i].Time) || got.UTCOffset != want[i].UTCOffset {
+			t.Errorf("point %d: expected %+v, got %+v", i, want[i], got)
+		}
+	}
+}
+
+func TestRegionalUrl(t *testing.T) {
+	tests := []struct {
+		baseUrl string
+		region  string
+		want    string
+		wantErr bool
+	}{
+		{baseUrl: "https://api.libreview.io", region: "eu", want: "https://api-eu.libreview.io"},
+		{baseUrl: "https://api-us.libreview.io", region: "eu", want: "https://api-eu.libreview.io"},
+		{baseUrl: "https://api.libreview.ru", region: "eu2", want: "https://api-eu2.libreview.ru"},
+		{baseUrl: "http://llu.example.com:8080/proxy", region: "ae", want: "http://llu-ae.example.com:8080/proxy"},
+		{baseUrl: "https://api.libreview.io", region: "", wantErr: true},
+		{baseUrl: "http://localhost:8080", region: "eu", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := regionalUrl(tt.baseUrl, tt.region)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s, %q: expected error %v, got %v", tt.baseUrl, tt.region, tt.wantErr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s, %q: expected %s, got %s", tt.baseUrl, tt.region, tt.want, got)
+		}
+	}
+}
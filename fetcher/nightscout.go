@@ -0,0 +1,146 @@
+package fetcher
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+const (
+	entriesEndpoint = "api/v1/entries/sgv.json"
+)
+
+type NightscoutClient struct {
+	client *http.Client
+	poller *poller
+	logger *zap.Logger
+
+	baseUrl   string
+	token     string
+	apiSecret string
+}
+
+func NewNightscout(baseUrl, token, apiSecret string,
+	writers []GlucosePointsWriter, history GlucoseHistory, logger *zap.Logger) *NightscoutClient {
+	client := &NightscoutClient{
+		client:    &http.Client{Timeout: 5 * time.Second},
+		logger:    logger,
+		baseUrl:   baseUrl,
+		token:     token,
+		apiSecret: apiSecret,
+	}
+	client.poller = newPoller(client, writers, history, logger)
+	return client
+}
+
+func (c *NightscoutClient) Start() error {
+	go c.poller.run()
+	return nil
+}
+
+func (c *NightscoutClient) Stop() {
+	c.poller.stop()
+}
+
+func (c *NightscoutClient) Latest() ([]store.GlucosePoint, error) {
+	return c.entries(url.Values{
+		"count": {strconv.Itoa(countMax)},
+	})
+}
+
+func (c *NightscoutClient) Backfill(start, end time.Time) ([]store.GlucosePoint, error) {
+	// Nightscout has no limit on how far back we can go, so make sure
+	// the count is large enough to cover the range at 5 minute intervals.
+	count := int(end.Sub(start)/(5*time.Minute)) + 1
+	if count < countMax {
+		count = countMax
+	}
+	return c.entries(url.Values{
+		"find[date][$gte]": {strconv.FormatInt(start.UnixMilli(), 10)},
+		"find[date][$lte]": {strconv.FormatInt(end.UnixMilli(), 10)},
+		"count":            {strconv.Itoa(count)},
+	})
+}
+
+func (c *NightscoutClient) entries(params url.Values) ([]store.GlucosePoint, error) {
+	if c.token != "" {
+		params.Set("token", c.token)
+	}
+	entriesUrl, err := url.JoinPath(c.baseUrl, entriesEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build entries url: %w", err)
+	}
+	entriesUrl = entriesUrl + "?" + params.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, entriesUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.apiSecret != "" {
+		hash := sha1.Sum([]byte(c.apiSecret))
+		req.Header.Set("api-secret", hex.EncodeToString(hash[:]))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.logger.Warn("unable to make entries request", zap.Error(err))
+		return nil, fmt.Errorf("unable to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+
+	return ParseNightscoutEntries(body)
+}
+
+// ParseNightscoutEntries parses the entries format used by the Nightscout
+// API, and uploaders like xDrip+. Both a list of entries and a single entry
+// are accepted. Anything that is not a sensor reading is skipped.
+func ParseNightscoutEntries(b []byte) ([]store.GlucosePoint, error) {
+	var entries []nightscoutEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		var entry nightscoutEntry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return nil, fmt.Errorf("unable to unmarshal json: %w", err)
+		}
+		entries = []nightscoutEntry{entry}
+	}
+
+	glucose := make([]store.GlucosePoint, 0, len(entries))
+	for _, entry := range entries {
+		if entry.SGV == 0 || (entry.Type != "" && entry.Type != "sgv") {
+			continue
+		}
+		glucose = append(glucose, store.GlucosePoint{
+			Value:     entry.SGV,
+			Trend:     store.ParseTrend(entry.Direction),
+			Time:      time.UnixMilli(entry.Date),
+			UTCOffset: entry.UTCOffset * 60,
+		})
+	}
+	return glucose, nil
+}
+
+type nightscoutEntry struct {
+	Type      string  `json:"type"`
+	SGV       float64 `json:"sgv"`
+	Date      int64   `json:"date"`
+	Direction string  `json:"direction"`
+	UTCOffset int     `json:"utcOffset"` // In minutes.
+}
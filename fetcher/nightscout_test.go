@@ -0,0 +1,131 @@
+package fetcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+// fakeNightscout stands in for a Nightscout site, and records the query
+// and api-secret header of the last entries request.
+type fakeNightscout struct {
+	mu     sync.Mutex
+	query  url.Values
+	secret string
+}
+
+func (f *fakeNightscout) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, entriesEndpoint) {
+		http.NotFound(w, r)
+		return
+	}
+	f.mu.Lock()
+	f.query = r.URL.Query()
+	f.secret = r.Header.Get("api-secret")
+	f.mu.Unlock()
+	w.Write([]byte(`[{"type":"sgv","sgv":120,"date":1691455258000,"direction":"Flat","utcOffset":-240}]`))
+}
+
+func (f *fakeNightscout) last() (url.Values, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.query, f.secret
+}
+
+func newTestNightscout(t *testing.T, ns *fakeNightscout, token, apiSecret string) *NightscoutClient {
+	t.Helper()
+	srv := httptest.NewServer(ns)
+	t.Cleanup(srv.Close)
+	return NewNightscout(srv.URL, token, apiSecret, nil, store.NewMemoryStore(), zap.NewNop())
+}
+
+func TestNightscoutRequests(t *testing.T) {
+	start := time.UnixMilli(1691440858000)
+	end := start.Add(24 * time.Hour)
+
+	tests := []struct {
+		name      string
+		token     string
+		apiSecret string
+		backfill  bool
+		// want is the expected query, and secret the expected header.
+		want   url.Values
+		secret string
+	}{
+		{
+			name: "latest",
+			want: url.Values{"count": {strconv.Itoa(countMax)}},
+		},
+		{
+			name:  "latest with token",
+			token: "iv3-0123456789abcdef",
+			want: url.Values{
+				"count": {strconv.Itoa(countMax)},
+				"token": {"iv3-0123456789abcdef"},
+			},
+		},
+		{
+			name:      "latest with api secret",
+			apiSecret: "averylongsecret",
+			want:      url.Values{"count": {strconv.Itoa(countMax)}},
+			// sha1("averylongsecret")
+			secret: "1b2673a3631bf6324dcbbd77adb907db2db13a96",
+		},
+		{
+			name:     "backfill",
+			backfill: true,
+			want: url.Values{
+				"find[date][$gte]": {"1691440858000"},
+				"find[date][$lte]": {"1691527258000"},
+				"count":            {"289"},
+			},
+		},
+		{
+			name:      "backfill with token and api secret",
+			token:     "iv3-0123456789abcdef",
+			apiSecret: "averylongsecret",
+			backfill:  true,
+			want: url.Values{
+				"find[date][$gte]": {"1691440858000"},
+				"find[date][$lte]": {"1691527258000"},
+				"count":            {"289"},
+				"token":            {"iv3-0123456789abcdef"},
+			},
+			secret: "1b2673a3631bf6324dcbbd77adb907db2db13a96",
+		},
+	}
+	for _, tt := range tests {
+		ns := &fakeNightscout{}
+		client := newTestNightscout(t, ns, tt.token, tt.apiSecret)
+
+		var glucose []store.GlucosePoint
+		var err error
+		if tt.backfill {
+			glucose, err = client.Backfill(start, end)
+		} else {
+			glucose, err = client.Latest()
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(glucose) != 1 || glucose[0].Value != 120 {
+			t.Errorf("%s: expected a single reading of 120, got %+v", tt.name, glucose)
+		}
+
+		query, secret := ns.last()
+		if query.Encode() != tt.want.Encode() {
+			t.Errorf("%s: expected query %s, got %s", tt.name, tt.want.Encode(), query.Encode())
+		}
+		if secret != tt.secret {
+			t.Errorf("%s: expected api-secret %q, got %q", tt.name, tt.secret, secret)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+const (
+	spoolDir = ".data/spool"
+	// The receiver has its own queues for the same writers as the poller,
+	// so it spools separately to keep them from replaying each other's
+	// batches.
+	receiverSpoolDir = ".data/spool/receiver"
+
+	writeRetries    = 5
+	writeBackoff    = 1 * time.Second
+	maxWriteBackoff = 30 * time.Second
+	replayInterval  = 1 * time.Minute
+)
+
+// writerQueue writes batches to a single writer in its own goroutine, so a
+// slow or failing writer does not hold up the others. Batches that still
+// fail after retrying are spooled to disk, and replayed once the writer
+// recovers.
+type writerQueue struct {
+	writer  GlucosePointsWriter
+	dir     string
+	batches chan []store.GlucosePoint
+	done    <-chan struct{}
+	logger  *zap.Logger
+
+	// backoff is the wait before the first retry, doubling after that.
+	backoff time.Duration
+}
+
+// namedWriter can be implemented by writers to pick their spool directory,
+// which is needed when there are several writers of the same type.
+type namedWriter interface {
+	Name() string
+}
+
+// newWriterQueue creates a queue spooling to a directory under root,
+// named after the writer.
+func newWriterQueue(writer GlucosePointsWriter, root string, done <-chan struct{},
+	logger *zap.Logger) *writerQueue {
+	name := strings.TrimPrefix(fmt.Sprintf("%T", writer), "*")
+	if nw, ok := writer.(namedWriter); ok {
+		name = nw.Name()
+	}
+	return &writerQueue{
+		writer:  writer,
+		dir:     filepath.Join(root, name),
+		batches: make(chan []store.GlucosePoint, 16),
+		done:    done,
+		logger:  logger.With(zap.String("writer", name)),
+		backoff: writeBackoff,
+	}
+}
+
+func (q *writerQueue) enqueue(glucose []store.GlucosePoint) {
+	select {
+	case q.batches <- glucose:
+	default:
+		// The writer is too far behind, so go straight to disk.
+		q.logger.Warn("writer queue is full, spooling batch")
+		q.spool(glucose)
+	}
+}
+
+func (q *writerQueue) run() {
+	ticker := time.NewTicker(replayInterval)
+	defer ticker.Stop()
+
+	q.replay()
+	for {
+		select {
+		case <-q.done:
+			q.drain()
+			return
+		case glucose := <-q.batches:
+			if err := q.writeWithRetry(glucose); err != nil {
+				q.logger.Error("unable to write glucose points, spooling batch", zap.Error(err))
+				q.spool(glucose)
+				continue
+			}
+			q.replay()
+		case <-ticker.C:
+			q.replay()
+		}
+	}
+}
+
+// drain spools anything still pending, so nothing is lost on shutdown.
+func (q *writerQueue) drain() {
+	for {
+		select {
+		case glucose := <-q.batches:
+			q.spool(glucose)
+		default:
+			return
+		}
+	}
+}
+
+func (q *writerQueue) writeWithRetry(glucose []store.GlucosePoint) error {
+	var err error
+	backoff := q.backoff
+	for attempt := 0; attempt < writeRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-q.done:
+				return fmt.Errorf("stopped while retrying: %w", err)
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxWriteBackoff)
+		}
+
+		if err = q.writer.WriteGlucosePoints(glucose); err == nil {
+			return nil
+		}
+		q.logger.Warn("unable to write glucose points, retrying",
+			zap.Int("attempt", attempt+1),
+			zap.Error(err),
+		)
+	}
+	return err
+}
+
+func (q *writerQueue) spool(glucose []store.GlucosePoint) {
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		q.logger.Error("unable to create spool directory", zap.Error(err))
+		return
+	}
+
+	b, err := json.Marshal(glucose)
+	if err != nil {
+		q.logger.Error("unable to marshal batch", zap.Error(err))
+		return
+	}
+
+	// Write to a temporary file first, so replay never sees a partial batch.
+	name := fmt.Sprintf("%020d.json", time.Now().UnixNano())
+	tmpPath := filepath.Join(q.dir, name+".tmp")
+	if err = os.WriteFile(tmpPath, b, 0644); err != nil {
+		q.logger.Error("unable to write spool file", zap.Error(err))
+		return
+	}
+	if err = os.Rename(tmpPath, filepath.Join(q.dir, name)); err != nil {
+		q.logger.Error("unable to rename spool file", zap.Error(err))
+		return
+	}
+	q.logger.Info("spooled glucose points", zap.String("file", name), zap.Int("count", len(glucose)))
+}
+
+// replay writes spooled batches oldest first, and stops at the first failure.
+func (q *writerQueue) replay() {
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil || len(files) == 0 {
+		return
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			q.logger.Error("unable to read spool file", zap.String("file", file), zap.Error(err))
+			return
+		}
+
+		var glucose []store.GlucosePoint
+		if err = json.Unmarshal(b, &glucose); err != nil {
+			// Nothing we can do with this, so set it aside.
+			q.logger.Error("unable to unmarshal spool file", zap.String("file", file), zap.Error(err))
+			os.Rename(file, file+".corrupt")
+			continue
+		}
+
+		if err = q.writer.WriteGlucosePoints(glucose); err != nil {
+			q.logger.Warn("unable to replay spooled batch", zap.String("file", file), zap.Error(err))
+			return
+		}
+		if err = os.Remove(file); err != nil {
+			q.logger.Error("unable to remove spool file", zap.String("file", file), zap.Error(err))
+			return
+		}
+		q.logger.Info("replayed spooled batch", zap.String("file", file), zap.Int("count", len(glucose)))
+	}
+}
@@ -0,0 +1,153 @@
+package fetcher
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+// fakeWriter records the batches written to it, and fails while fail is set.
+type fakeWriter struct {
+	mu      sync.Mutex
+	fail    bool
+	batches [][]store.GlucosePoint
+}
+
+func (w *fakeWriter) WriteGlucosePoints(glucose []store.GlucosePoint) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.fail {
+		return errors.New("writer is down")
+	}
+	w.batches = append(w.batches, glucose)
+	return nil
+}
+
+func (w *fakeWriter) setFail(fail bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.fail = fail
+}
+
+// written returns the first value of each batch written, in order.
+func (w *fakeWriter) written() []float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	values := make([]float64, len(w.batches))
+	for i, batch := range w.batches {
+		values[i] = batch[0].Value
+	}
+	return values
+}
+
+func newTestQueue(t *testing.T, w *fakeWriter) (*writerQueue, chan struct{}) {
+	t.Helper()
+	done := make(chan struct{})
+	q := newWriterQueue(w, t.TempDir(), done, zap.NewNop())
+	q.backoff = time.Millisecond
+	return q, done
+}
+
+// runQueue runs the queue until the test ends.
+func runQueue(t *testing.T, q *writerQueue, done chan struct{}) {
+	t.Helper()
+	finished := make(chan struct{})
+	go func() {
+		q.run()
+		close(finished)
+	}()
+	t.Cleanup(func() {
+		close(done)
+		<-finished
+	})
+}
+
+func spooled(t *testing.T, q *writerQueue) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func batch(value float64) []store.GlucosePoint {
+	return []store.GlucosePoint{{Value: value, Time: time.Unix(int64(value), 0)}}
+}
+
+func TestWriterQueueSpoolsOnFailure(t *testing.T) {
+	w := &fakeWriter{fail: true}
+	q, done := newTestQueue(t, w)
+	runQueue(t, q, done)
+
+	q.enqueue(batch(1))
+	waitFor(t, "the batch to be spooled", func() bool { return len(spooled(t, q)) == 1 })
+	if got := w.written(); len(got) != 0 {
+		t.Errorf("expected nothing to be written, got %v", got)
+	}
+}
+
+func TestWriterQueueReplaysOnStart(t *testing.T) {
+	w := &fakeWriter{}
+	q, done := newTestQueue(t, w)
+	for _, v := range []float64{1, 2, 3} {
+		q.spool(batch(v))
+	}
+	if n := len(spooled(t, q)); n != 3 {
+		t.Fatalf("expected 3 spooled batches, got %d", n)
+	}
+
+	runQueue(t, q, done)
+	waitFor(t, "the spool to be replayed", func() bool { return len(spooled(t, q)) == 0 })
+	got := w.written()
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Errorf("expected batches 1, 2 and 3 in order, got %v", got)
+	}
+}
+
+func TestWriterQueueDrainsInOrder(t *testing.T) {
+	w := &fakeWriter{fail: true}
+	q, done := newTestQueue(t, w)
+
+	// Batches still queued on shutdown are spooled.
+	for _, v := range []float64{1, 2, 3} {
+		q.enqueue(batch(v))
+	}
+	close(done)
+	q.drain()
+	if n := len(spooled(t, q)); n != 3 {
+		t.Fatalf("expected 3 spooled batches, got %d", n)
+	}
+
+	// Replay stops at the first failure, so nothing is skipped.
+	q.replay()
+	if n := len(spooled(t, q)); n != 3 {
+		t.Fatalf("expected the batches to stay spooled, got %d", n)
+	}
+
+	w.setFail(false)
+	q.replay()
+	got := w.written()
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Errorf("expected batches 1, 2 and 3 in order, got %v", got)
+	}
+	if n := len(spooled(t, q)); n != 0 {
+		t.Errorf("expected the spool to be empty, got %d", n)
+	}
+}
@@ -0,0 +1,47 @@
+package fetcher
+
+import (
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+// Receiver accepts readings that are pushed to iv3 (e.g. by xDrip+),
+// instead of polling for them. Writes go through the same kind of retrying
+// queues as the pollers, but spool to their own directory.
+type Receiver struct {
+	queues []*writerQueue
+	logger *zap.Logger
+
+	done chan struct{}
+}
+
+func NewReceiver(writers []GlucosePointsWriter, logger *zap.Logger) *Receiver {
+	r := &Receiver{
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+	for _, writer := range writers {
+		r.queues = append(r.queues, newWriterQueue(writer, receiverSpoolDir, r.done, logger))
+	}
+	return r
+}
+
+func (r *Receiver) Start() {
+	for _, q := range r.queues {
+		go q.run()
+	}
+}
+
+func (r *Receiver) Stop() {
+	close(r.done)
+}
+
+// WriteGlucosePoints hands the points off to the writers. Failures are
+// retried and spooled by the queues, so this never returns an error.
+func (r *Receiver) WriteGlucosePoints(glucose []store.GlucosePoint) error {
+	for _, q := range r.queues {
+		q.enqueue(glucose)
+	}
+	r.logger.Debug("received glucose points", zap.Int("count", len(glucose)))
+	return nil
+}
@@ -8,7 +8,9 @@ require (
 	github.com/DataDog/datadog-api-client-go/v2 v2.34.0
 	github.com/aws/aws-sdk-go v1.44.258
 	github.com/go-co-op/gocron v1.25.0
+	github.com/google/uuid v1.5.0
 	github.com/montanaflynn/stats v0.7.1
+	go.etcd.io/bbolt v1.3.10
 	go.uber.org/zap v1.24.0
 )
 
@@ -16,10 +18,10 @@ require (
 	github.com/DataDog/zstd v1.5.2 // indirect
 	github.com/goccy/go-json v0.10.2 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
-	github.com/google/uuid v1.5.0 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/robfig/cron/v3 v3.0.1 // indirect
 	golang.org/x/oauth2 v0.10.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.31.0 // indirect
 )
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	"github.com/algao1/iv3/alert"
 	"github.com/algao1/iv3/analysis"
@@ -11,6 +12,7 @@ import (
 	"github.com/algao1/iv3/server"
 	"github.com/algao1/iv3/store"
 	"github.com/algao1/iv3/tools/auto_backup"
+	"github.com/algao1/iv3/tools/clarity"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
 )
@@ -30,18 +32,62 @@ func init() {
 	flag.Parse()
 }
 
-func verifyFlags(logger *zap.Logger) {
-	if influxdbToken == "" {
+func verifyFlags(cfg config.Config, logger *zap.Logger) {
+	if cfg.Storage.Backend == config.StorageInfluxDB && influxdbToken == "" {
 		logger.Fatal("no InfluxDB token provided")
 	}
 }
 
+// importClarity imports a Clarity CSV export, and exits.
+// Usage: iv3 [flags] import-clarity [-subject name] [-tz America/Toronto] export.csv
+func importClarity(st store.Store, cfg config.Config,
+	args []string, logger *zap.Logger) {
+	fs := flag.NewFlagSet("import-clarity", flag.ExitOnError)
+	tz := fs.String("tz", "Local", "timezone the export was made in")
+	subject := fs.String("subject", cfg.Subjects[0].Name, "subject to import for")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		logger.Fatal("expected exactly one Clarity export file")
+	}
+
+	var subCfg *config.SubjectConfig
+	for i := range cfg.Subjects {
+		if cfg.Subjects[i].Name == *subject {
+			subCfg = &cfg.Subjects[i]
+		}
+	}
+	if subCfg == nil {
+		logger.Fatal("unknown subject", zap.String("subject", *subject))
+	}
+
+	loc, err := time.LoadLocation(*tz)
+	if err != nil {
+		logger.Fatal("unable to load timezone", zap.Error(err))
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		logger.Fatal("unable to open Clarity export", zap.Error(err))
+	}
+	defer file.Close()
+
+	importer := clarity.NewImporter(
+		st.ForSubject(subCfg.Name),
+		subCfg.Insulin,
+		logger.Named("clarity"),
+	)
+	result, err := importer.Import(file, loc)
+	if err != nil {
+		logger.Fatal("unable to import Clarity export", zap.Error(err))
+	}
+	logger.Info("imported Clarity export", zap.Any("result", result))
+}
+
 func main() {
 	logger, _ := zap.NewProduction()
 	if iv3Env == "dev" {
 		logger, _ = zap.NewDevelopment()
 	}
-	verifyFlags(logger)
 
 	file, err := os.ReadFile(configFile)
 	if err != nil {
@@ -55,68 +101,156 @@ func main() {
 	if err := cfg.Verify(); err != nil {
 		logger.Fatal("incorrect config provided", zap.Error(err))
 	}
+	verifyFlags(cfg, logger)
 
-	influxClient, err := store.NewInfluxDB(
-		influxdbToken,
-		influxdbUrl,
-		logger.Named("influxdb"),
-	)
-	if err != nil {
-		logger.Fatal("unable to create InfluxDB client", zap.Error(err))
+	var st store.Store
+	switch cfg.Storage.Backend {
+	case config.StorageBolt:
+		boltClient, err := store.NewBolt(cfg.Storage.Path, logger.Named("bolt"))
+		if err != nil {
+			logger.Fatal("unable to open bolt db", zap.Error(err))
+		}
+		defer boltClient.Close()
+		st = boltClient
+	default:
+		influxClient, err := store.NewInfluxDB(
+			influxdbToken,
+			influxdbUrl,
+			logger.Named("influxdb"),
+		)
+		if err != nil {
+			logger.Fatal("unable to create InfluxDB client", zap.Error(err))
+		}
+		st = influxClient
 	}
 
-	backuper, err := auto_backup.NewS3Backuper(
-		influxdbToken,
-		influxdbUrl,
-		cfg.S3,
-		logger.Named("s3Backuper"),
-	)
-	if err != nil {
-		logger.Fatal("unable to create S3 backuper", zap.Error(err))
+	if flag.Arg(0) == "import-clarity" {
+		importClarity(st, cfg, flag.Args()[1:], logger)
+		return
 	}
 
-	if iv3Env != "dev" {
-		logger.Info("starting S3 backuper")
-		err := backuper.Start()
+	// The backuper exports InfluxDB buckets, so it only applies there.
+	if cfg.Storage.Backend == config.StorageInfluxDB {
+		backuper, err := auto_backup.NewS3Backuper(
+			influxdbToken,
+			influxdbUrl,
+			cfg.S3,
+			logger.Named("s3Backuper"),
+		)
 		if err != nil {
-			logger.Fatal("unable to start S3 backuper", zap.Error(err))
+			logger.Fatal("unable to create S3 backuper", zap.Error(err))
+		}
+
+		if iv3Env != "dev" {
+			logger.Info("starting S3 backuper")
+			if err := backuper.Start(); err != nil {
+				logger.Fatal("unable to start S3 backuper", zap.Error(err))
+			}
 		}
 	}
 
-	fetcher.NewDexcom(
-		cfg.Dexcom.Account,
-		cfg.Dexcom.Password,
-		[]fetcher.GlucosePointsWriter{
-			store.NewDDClient(&cfg.Iv3),
-			influxClient,
-		},
-		logger.Named("dexcom"),
+	subjects := make([]*server.Subject, len(cfg.Subjects))
+	for i, subCfg := range cfg.Subjects {
+		subLogger := logger
+		if subCfg.Name != "" {
+			subLogger = logger.With(zap.String("subject", subCfg.Name))
+		}
+		subjects[i] = startSubject(subCfg, st.ForSubject(subCfg.Name), subLogger)
+	}
+
+	s := server.NewHttpServer(
+		cfg.API,
+		subjects,
+		logger.Named("httpServer"),
 	)
 
+	logger.Info("everything started successfully!")
+	s.Serve() // Blocking.
+}
+
+// startSubject starts fetching, and alerting for a single subject.
+func startSubject(cfg config.SubjectConfig, st store.Store,
+	logger *zap.Logger) *server.Subject {
+	writers := []fetcher.GlucosePointsWriter{
+		store.NewDDClient(&cfg.Iv3, cfg.Name),
+		st,
+	}
+
+	sub := &server.Subject{Config: cfg}
+
+	// Readings pushed by uploaders like xDrip+ go through the receiver.
+	if cfg.XDrip.APISecret != "" {
+		receiver := fetcher.NewReceiver(writers, logger.Named("receiver"))
+		receiver.Start()
+		sub.Receiver = receiver
+	}
+
+	var source fetcher.Source
+	switch cfg.Source {
+	case config.SourceXDrip:
+		// Nothing to poll, everything is pushed to the receiver.
+	case config.SourceNightscout:
+		source = fetcher.NewNightscout(
+			cfg.Nightscout.URL,
+			cfg.Nightscout.Token,
+			cfg.Nightscout.APISecret,
+			writers,
+			st,
+			logger.Named("nightscout"),
+		)
+	case config.SourceLibreLinkUp:
+		url := cfg.LibreLinkUp.URL
+		if url == "" {
+			url = fetcher.LibreLinkUpUrl
+		}
+		source = fetcher.NewLibreLinkUp(
+			url,
+			cfg.LibreLinkUp.Email,
+			cfg.LibreLinkUp.Password,
+			writers,
+			st,
+			logger.Named("librelinkup"),
+		)
+	default:
+		url := cfg.Dexcom.URL
+		if url == "" {
+			url = fetcher.DexcomUrl(cfg.Dexcom.Region)
+		}
+		source = fetcher.NewDexcom(
+			url,
+			fetcher.DexcomAppID(cfg.Dexcom.Region),
+			cfg.Dexcom.Account,
+			cfg.Dexcom.Password,
+			writers,
+			st,
+			logger.Named("dexcom"),
+		)
+	}
+	if source != nil {
+		if err := source.Start(); err != nil {
+			logger.Fatal("unable to start glucose source", zap.Error(err))
+		}
+	}
+
 	if cfg.Iv3.Endpoint != "" {
 		alert.NewAlerter(
-			influxClient,
+			st,
 			cfg.Iv3,
 			cfg.Insulin,
 			logger.Named("alerter"),
 		)
 	}
 
-	analyzer := analysis.NewAnalyzer(
-		influxClient,
+	sub.ReadWriter = st
+	sub.Analyzer = analysis.NewAnalyzer(
+		st,
 		cfg.Iv3,
 		logger.Named("analyzer"),
 	)
-
-	s := server.NewHttpServer(
-		cfg.API.Username,
-		cfg.API.Password,
-		cfg,
-		influxClient,
-		analyzer,
-		logger.Named("httpServer"),
+	sub.Importer = clarity.NewImporter(
+		st,
+		cfg.Insulin,
+		logger.Named("clarity"),
 	)
-
-	logger.Info("everything started successfully!")
-	s.Serve() // Blocking.
+	return sub
 }
@@ -1,18 +1,27 @@
 package server
 
 import (
+	"context"
+	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/algao1/iv3/analysis"
 	"github.com/algao1/iv3/config"
+	"github.com/algao1/iv3/fetcher"
 	"github.com/algao1/iv3/store"
+	"github.com/algao1/iv3/tools/clarity"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
@@ -20,45 +29,115 @@ const (
 	// TODO: Should make this less jank...
 	certFile = "_iv3_ssl/certfile.crt"
 	keyfile  = "_iv3_ssl/keyfile.key"
+
+	maxUploadSize = 64 << 20
+	// Imports can be up to maxUploadSize, which takes longer to upload
+	// and write than the server timeouts allow.
+	importTimeout = 5 * time.Minute
+
+	defaultEpisodesLimit = 50
+
+	auditWrite  = "write"
+	auditUpdate = "update"
+	auditDelete = "delete"
+	auditImport = "import"
 )
 
+type contextKey int
+
+// actorKey is the username of the authenticated user.
+const actorKey contextKey = iota
+
 type PointsReadWriter interface {
-	ReadGlucosePoints(startTs, endTs int) ([]store.GlucosePoint, error)
+	ReadGlucosePoints(startTs, endTs int, opts ...store.ReadOption) ([]store.GlucosePoint, error)
 
-	ReadInsulinPoints(startTs, endTs int) ([]store.InsulinPoint, error)
+	ReadInsulinPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.InsulinPoint, error)
+	ReadInsulinPoint(id string) (*store.InsulinPoint, error)
 	WriteInsulinPoint(point store.InsulinPoint) error
 	DeleteInsulinPoints(startTs, endTs int) error
+	UpdateInsulinPoint(point store.InsulinPoint) error
+	DeleteInsulinPoint(id string) error
 
-	ReadCarbPoints(startTs, endTs int) ([]store.CarbPoint, error)
+	ReadCarbPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.CarbPoint, error)
+	ReadCarbPoint(id string) (*store.CarbPoint, error)
 	WriteCarbPoint(point store.CarbPoint) error
 	DeleteCarbPoints(startTs, endTs int) error
+	UpdateCarbPoint(point store.CarbPoint) error
+	DeleteCarbPoint(id string) error
+
+	ReadActivityPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.ActivityPoint, error)
+	ReadActivityPoint(id string) (*store.ActivityPoint, error)
+	WriteActivityPoint(point store.ActivityPoint) error
+	DeleteActivityPoints(startTs, endTs int) error
+	DeleteActivityPoint(id string) error
+
+	ReadMeterPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.MeterPoint, error)
+	WriteMeterPoint(point store.MeterPoint) error
+	ReadKetonePoints(startTs, endTs int, opts ...store.ReadOption) ([]store.KetonePoint, error)
+	WriteKetonePoint(point store.KetonePoint) error
+	ReadCalibrationPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.CalibrationPoint, error)
+	WriteCalibrationPoint(point store.CalibrationPoint) error
+
+	WriteAuditPoint(point store.AuditPoint) error
+	ReadAuditPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.AuditPoint, error)
 }
 
 type Analyzer interface {
 	DayToDay(startTs, endTs int) (*analysis.DayToDayResult, error)
+	PostActivity(startTs, endTs int, opts ...store.ReadOption) ([]analysis.ActivityCurve, error)
+	AGP(startTs, endTs int) (*analysis.AGPResult, error)
+	TimeInRange(startTs, endTs int, period string) (*analysis.TimeInRangeResult, error)
+	Variability(startTs, endTs, congaHours int) (*analysis.VariabilityResult, error)
+	GMI(startTs, endTs int) ([]analysis.GMISeries, error)
+	Episodes(startTs, endTs int, episodeType string) ([]analysis.Episode, error)
+}
+
+type GlucoseWriter interface {
+	WriteGlucosePoints(glucose []store.GlucosePoint) error
+}
+
+type Importer interface {
+	Import(r io.Reader, loc *time.Location) (*clarity.Result, error)
+}
+
+// Subject is everything needed to serve one monitored person.
+type Subject struct {
+	Config     config.SubjectConfig
+	ReadWriter PointsReadWriter
+	Analyzer   Analyzer
+	Importer   Importer
+	Receiver   GlucoseWriter
 }
 
+// subjectHandler is a handler scoped to a single subject.
+type subjectHandler func(w http.ResponseWriter, r *http.Request, sub *Subject)
+
 type HttpServer struct {
-	username string
-	password string
+	// users maps usernames to passwords.
+	users map[string]string
 
-	readWriter PointsReadWriter
-	analyzer   Analyzer
-	config     config.Config
+	// The first subject is the default, used by the unscoped routes.
+	subjects       []*Subject
+	subjectsByName map[string]*Subject
 
 	logger *zap.Logger
 }
 
-func NewHttpServer(username, password string, config config.Config,
-	readWriter PointsReadWriter, analyzer Analyzer, logger *zap.Logger) *HttpServer {
-	return &HttpServer{
-		username:   username,
-		password:   password,
-		readWriter: readWriter,
-		analyzer:   analyzer,
-		config:     config,
-		logger:     logger,
+func NewHttpServer(api config.APIConfig, subjects []*Subject,
+	logger *zap.Logger) *HttpServer {
+	s := &HttpServer{
+		users:          map[string]string{api.Username: api.Password},
+		subjects:       subjects,
+		subjectsByName: make(map[string]*Subject),
+		logger:         logger,
+	}
+	for _, user := range api.Users {
+		s.users[user.Username] = user.Password
 	}
+	for _, sub := range subjects {
+		s.subjectsByName[sub.Config.Name] = sub
+	}
+	return s
 }
 
 func (s *HttpServer) Serve() {
@@ -79,21 +158,76 @@ func (s *HttpServer) Serve() {
 }
 
 func (s *HttpServer) addHandlers(mux *http.ServeMux) {
-	mux.HandleFunc("/config", s.basicAuth(s.getConfigHandler))
-	mux.HandleFunc("/glucose", s.basicAuth(s.getGlucoseHandler))
+	mux.HandleFunc("/subjects", s.basicAuth(s.getSubjectsHandler))
+
+	s.handle(mux, "/config", s.getConfigHandler)
+	s.handle(mux, "/glucose", s.getGlucoseHandler)
+
+	s.handle(mux, "/insulin", s.getInsulinHandler)
+	s.handle(mux, "/insulin/write", s.writeInsulinHandler)
+	s.handle(mux, "/insulin/update", s.updateInsulinHandler)
+	s.handle(mux, "/insulin/delete", s.deleteInsulinHandler)
+
+	s.handle(mux, "/carbs", s.getCarbsHandler)
+	s.handle(mux, "/carbs/write", s.writeCarbHandler)
+	s.handle(mux, "/carbs/update", s.updateCarbHandler)
+	s.handle(mux, "/carbs/delete", s.deleteCarbsHandler)
+
+	s.handle(mux, "/activity", s.getActivityHandler)
+	s.handle(mux, "/activity/write", s.writeActivityHandler)
+	s.handle(mux, "/activity/delete", s.deleteActivityHandler)
+	s.handle(mux, "/activity/curves", s.getActivityCurvesHandler)
 
-	mux.HandleFunc("/insulin", s.basicAuth(s.getInsulinHandler))
-	mux.HandleFunc("/insulin/write", s.basicAuth(s.writeInsulinHandler))
-	mux.HandleFunc("/insulin/delete", s.basicAuth(s.deleteInsulinHandler))
+	s.handle(mux, "/meter", s.getMeterHandler)
+	s.handle(mux, "/meter/write", s.writeMeterHandler)
+	s.handle(mux, "/ketones", s.getKetonesHandler)
+	s.handle(mux, "/ketones/write", s.writeKetoneHandler)
+	s.handle(mux, "/calibrations", s.getCalibrationsHandler)
+	s.handle(mux, "/calibrations/write", s.writeCalibrationHandler)
 
-	mux.HandleFunc("/carbs", s.basicAuth(s.getCarbsHandler))
-	mux.HandleFunc("/carbs/write", s.basicAuth(s.writeCarbHandler))
-	mux.HandleFunc("/carbs/delete", s.basicAuth(s.deleteCarbsHandler))
+	s.handle(mux, "/dtd", s.getDayToDayHandler)
+	s.handle(mux, "/agp", s.getAGPHandler)
+	s.handle(mux, "/tir", s.getTimeInRangeHandler)
+	s.handle(mux, "/variability", s.getVariabilityHandler)
+	s.handle(mux, "/gmi", s.getGMIHandler)
+	s.handle(mux, "/episodes", s.getEpisodesHandler)
+
+	s.handle(mux, "/import/clarity", s.importClarityHandler)
+
+	s.handle(mux, "/audit", s.getAuditHandler)
+
+	// Nightscout-style upload endpoints, for apps like xDrip+.
+	// The subject is picked by the API secret.
+	mux.HandleFunc("/api/v1/entries", s.apiSecretAuth(s.uploadEntriesHandler))
+	mux.HandleFunc("/api/v1/entries.json", s.apiSecretAuth(s.uploadEntriesHandler))
+}
+
+// handle registers h for the default subject at path, and for every
+// subject at /subjects/{subject}/path.
+func (s *HttpServer) handle(mux *http.ServeMux, path string, h subjectHandler) {
+	mux.HandleFunc(path, s.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		h(w, r, s.subjects[0])
+	}))
+	mux.HandleFunc("/subjects/{subject}"+path, s.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		sub, ok := s.subjectsByName[r.PathValue("subject")]
+		if !ok {
+			http.Error(w, "unknown subject", http.StatusNotFound)
+			return
+		}
+		h(w, r, sub)
+	}))
+}
 
-	mux.HandleFunc("/dtd", s.basicAuth(s.getDayToDayHandler))
+func (s *HttpServer) getSubjectsHandler(w http.ResponseWriter, r *http.Request) {
+	s.logger.Info("got GET request for /subjects", zap.Any("query", r.URL.Query()))
+	names := make([]string, len(s.subjects))
+	for i, sub := range s.subjects {
+		names[i] = sub.Config.Name
+	}
+	json.NewEncoder(w).Encode(names)
 }
 
-func (s *HttpServer) getGlucoseHandler(w http.ResponseWriter, r *http.Request) {
+func (s *HttpServer) getGlucoseHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
 	s.logger.Info("got GET request for /glucose", zap.Any("query", r.URL.Query()))
 
 	startTs, endTs, err := getStartEndTs(r.URL.Query())
@@ -102,15 +236,36 @@ func (s *HttpServer) getGlucoseHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	glucose, err := s.readWriter.ReadGlucosePoints(startTs, endTs)
+	opts, err := getReadOptions(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse read options: %w", err)
+		return
+	}
+
+	glucose, err := sub.ReadWriter.ReadGlucosePoints(startTs, endTs, opts...)
 	if err != nil {
 		fmt.Fprintln(w, "unable to fetch glucose: %w", err)
 		return
 	}
-	json.NewEncoder(w).Encode(glucose)
+
+	resp := make([]glucoseResponse, len(glucose))
+	for i, gp := range glucose {
+		resp[i].GlucosePoint = gp
+		if rate, ok := gp.Trend.Rate(); ok {
+			resp[i].Rate = &rate
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+type glucoseResponse struct {
+	store.GlucosePoint
+	// Rate is the sensor's expected rate of change in mg/dL/min,
+	// or null if the sensor could not compute one.
+	Rate *float64
 }
 
-func (s *HttpServer) getInsulinHandler(w http.ResponseWriter, r *http.Request) {
+func (s *HttpServer) getInsulinHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
 	s.logger.Info("got GET request for /insulin", zap.Any("query", r.URL.Query()))
 
 	startTs, endTs, err := getStartEndTs(r.URL.Query())
@@ -119,7 +274,13 @@ func (s *HttpServer) getInsulinHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	insulin, err := s.readWriter.ReadInsulinPoints(startTs, endTs)
+	opts, err := getReadOptions(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse read options: %w", err)
+		return
+	}
+
+	insulin, err := sub.ReadWriter.ReadInsulinPoints(startTs, endTs, opts...)
 	if err != nil {
 		fmt.Fprintln(w, "unable to fetch insulin: %w", err)
 		return
@@ -128,12 +289,24 @@ func (s *HttpServer) getInsulinHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 type intermediateInsulinPoint struct {
+	ID    string `json:"id"`
 	Value int    `json:"value"`
 	Type  string `json:"type"`
 	Ts    int    `json:"ts"`
 }
 
-func (s *HttpServer) writeInsulinHandler(w http.ResponseWriter, r *http.Request) {
+func (p intermediateInsulinPoint) point() store.InsulinPoint {
+	return store.InsulinPoint{
+		ID:    p.ID,
+		Value: p.Value,
+		Type:  p.Type,
+		Time:  time.Unix(int64(p.Ts), 0),
+	}
+}
+
+// writeInsulinHandler responds with the written point, so the ID can be
+// used to update or delete it later.
+func (s *HttpServer) writeInsulinHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
 	s.logger.Info("got POST request for /insulin/write", zap.Any("query", r.URL.Query()))
 
 	var intPoint intermediateInsulinPoint
@@ -143,43 +316,106 @@ func (s *HttpServer) writeInsulinHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	point := store.InsulinPoint{
-		Value: intPoint.Value,
-		Type:  intPoint.Type,
-		Time:  time.Unix(int64(intPoint.Ts), 0),
-	}
-	err = s.readWriter.WriteInsulinPoint(point)
+	point := intPoint.point()
+	point.ID = uuid.NewString()
+	err = sub.ReadWriter.WriteInsulinPoint(point)
 	if err != nil {
 		fmt.Fprintln(w, "unable to write insulin point: %w", err)
 		return
 	}
+	s.audit(r, sub, auditWrite, "insulin", point.ID, nil, point)
+	json.NewEncoder(w).Encode(point)
 }
 
-func (s *HttpServer) deleteInsulinHandler(w http.ResponseWriter, r *http.Request) {
+func (s *HttpServer) updateInsulinHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got POST request for /insulin/update", zap.Any("query", r.URL.Query()))
+
+	var intPoint intermediateInsulinPoint
+	err := json.NewDecoder(r.Body).Decode(&intPoint)
+	if err != nil {
+		fmt.Fprintln(w, "unable to decode insulin point: %w", err)
+		return
+	}
+
+	point := intPoint.point()
+	before, err := sub.ReadWriter.ReadInsulinPoint(point.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "insulin point not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(w, "unable to read insulin point: %w", err)
+		return
+	}
+	// Leaving out the timestamp keeps the point where it is.
+	if intPoint.Ts == 0 {
+		point.Time = before.Time
+	}
+
+	err = sub.ReadWriter.UpdateInsulinPoint(point)
+	if err != nil {
+		fmt.Fprintln(w, "unable to update insulin point: %w", err)
+		return
+	}
+	s.audit(r, sub, auditUpdate, "insulin", point.ID, before, point)
+	json.NewEncoder(w).Encode(point)
+}
+
+// deleteInsulinHandler deletes a single point if an id is given,
+// otherwise every point between start and end.
+func (s *HttpServer) deleteInsulinHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
 	s.logger.Info("got DELETE request for /insulin/delete", zap.Any("query", r.URL.Query()))
+	if id := r.URL.Query().Get("id"); id != "" {
+		before, err := sub.ReadWriter.ReadInsulinPoint(id)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "insulin point not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(w, "unable to read insulin point: %w", err)
+			return
+		}
+
+		if err = sub.ReadWriter.DeleteInsulinPoint(id); err != nil {
+			fmt.Fprintln(w, "unable to delete insulin point: %w", err)
+			return
+		}
+		s.audit(r, sub, auditDelete, "insulin", id, before, nil)
+		return
+	}
+
 	startTs, endTs, err := getStartEndTs(r.URL.Query())
 	if err != nil {
 		fmt.Fprintln(w, "unable to parse start/end timestamps: %w", err)
 		return
 	}
 
-	err = s.readWriter.DeleteInsulinPoints(startTs, endTs)
+	// Deletes include the end, unlike reads.
+	before, err := sub.ReadWriter.ReadInsulinPoints(startTs, endTs+1)
+	if err != nil {
+		fmt.Fprintln(w, "unable to read insulin points: %w", err)
+		return
+	}
+
+	err = sub.ReadWriter.DeleteInsulinPoints(startTs, endTs)
 	if err != nil {
 		fmt.Fprintln(w, "unable to delete insulin points: %w", err)
 		return
 	}
+	s.audit(r, sub, auditDelete, "insulin", "", before, nil)
 }
 
-func (s *HttpServer) getConfigHandler(w http.ResponseWriter, r *http.Request) {
+func (s *HttpServer) getConfigHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
 	s.logger.Info("got GET request for /config", zap.Any("query", r.URL.Query()))
-	configCpy := config.Config{
-		Insulin: s.config.Insulin,
-		Iv3:     s.config.Iv3,
+	configCpy := config.SubjectConfig{
+		Name:    sub.Config.Name,
+		Insulin: sub.Config.Insulin,
+		Iv3:     sub.Config.Iv3,
 	}
 	json.NewEncoder(w).Encode(configCpy)
 }
 
-func (s *HttpServer) getCarbsHandler(w http.ResponseWriter, r *http.Request) {
+func (s *HttpServer) getCarbsHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
 	s.logger.Info("got GET request for /carbs", zap.Any("query", r.URL.Query()))
 
 	startTs, endTs, err := getStartEndTs(r.URL.Query())
@@ -188,7 +424,13 @@ func (s *HttpServer) getCarbsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	carbs, err := s.readWriter.ReadCarbPoints(startTs, endTs)
+	opts, err := getReadOptions(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse read options: %w", err)
+		return
+	}
+
+	carbs, err := sub.ReadWriter.ReadCarbPoints(startTs, endTs, opts...)
 	if err != nil {
 		fmt.Fprintln(w, "unable to fetch carbs: %w", err)
 		return
@@ -197,11 +439,20 @@ func (s *HttpServer) getCarbsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 type intermediateCarbPoint struct {
-	Value int `json:"value"`
-	Ts    int `json:"ts"`
+	ID    string `json:"id"`
+	Value int    `json:"value"`
+	Ts    int    `json:"ts"`
 }
 
-func (s *HttpServer) writeCarbHandler(w http.ResponseWriter, r *http.Request) {
+func (p intermediateCarbPoint) point() store.CarbPoint {
+	return store.CarbPoint{
+		ID:    p.ID,
+		Value: p.Value,
+		Time:  time.Unix(int64(p.Ts), 0),
+	}
+}
+
+func (s *HttpServer) writeCarbHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
 	s.logger.Info("got POST request for /carbs/write", zap.Any("query", r.URL.Query()))
 
 	var intPoint intermediateCarbPoint
@@ -211,33 +462,396 @@ func (s *HttpServer) writeCarbHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	point := store.CarbPoint{
-		Value: intPoint.Value,
-		Time:  time.Unix(int64(intPoint.Ts), 0),
-	}
-	err = s.readWriter.WriteCarbPoint(point)
+	point := intPoint.point()
+	point.ID = uuid.NewString()
+	err = sub.ReadWriter.WriteCarbPoint(point)
 	if err != nil {
 		fmt.Fprintln(w, "unable to write carb point: %w", err)
 		return
 	}
+	s.audit(r, sub, auditWrite, "carb", point.ID, nil, point)
+	json.NewEncoder(w).Encode(point)
+}
+
+func (s *HttpServer) updateCarbHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got POST request for /carbs/update", zap.Any("query", r.URL.Query()))
+
+	var intPoint intermediateCarbPoint
+	err := json.NewDecoder(r.Body).Decode(&intPoint)
+	if err != nil {
+		fmt.Fprintln(w, "unable to decode carb point: %w", err)
+		return
+	}
+
+	point := intPoint.point()
+	before, err := sub.ReadWriter.ReadCarbPoint(point.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "carb point not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(w, "unable to read carb point: %w", err)
+		return
+	}
+	// Leaving out the timestamp keeps the point where it is.
+	if intPoint.Ts == 0 {
+		point.Time = before.Time
+	}
+
+	err = sub.ReadWriter.UpdateCarbPoint(point)
+	if err != nil {
+		fmt.Fprintln(w, "unable to update carb point: %w", err)
+		return
+	}
+	s.audit(r, sub, auditUpdate, "carb", point.ID, before, point)
+	json.NewEncoder(w).Encode(point)
 }
 
-func (s *HttpServer) deleteCarbsHandler(w http.ResponseWriter, r *http.Request) {
+// deleteCarbsHandler deletes a single point if an id is given,
+// otherwise every point between start and end.
+func (s *HttpServer) deleteCarbsHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
 	s.logger.Info("got DELETE request for /carbs/delete", zap.Any("query", r.URL.Query()))
+	if id := r.URL.Query().Get("id"); id != "" {
+		before, err := sub.ReadWriter.ReadCarbPoint(id)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "carb point not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(w, "unable to read carb point: %w", err)
+			return
+		}
+
+		if err = sub.ReadWriter.DeleteCarbPoint(id); err != nil {
+			fmt.Fprintln(w, "unable to delete carb point: %w", err)
+			return
+		}
+		s.audit(r, sub, auditDelete, "carb", id, before, nil)
+		return
+	}
+
 	startTs, endTs, err := getStartEndTs(r.URL.Query())
 	if err != nil {
 		fmt.Fprintln(w, "unable to parse start/end timestamps: %w", err)
 		return
 	}
 
-	err = s.readWriter.DeleteCarbPoints(startTs, endTs)
+	// Deletes include the end, unlike reads.
+	before, err := sub.ReadWriter.ReadCarbPoints(startTs, endTs+1)
+	if err != nil {
+		fmt.Fprintln(w, "unable to read carb points: %w", err)
+		return
+	}
+
+	err = sub.ReadWriter.DeleteCarbPoints(startTs, endTs)
 	if err != nil {
 		fmt.Fprintln(w, "unable to delete carb points: %w", err)
 		return
 	}
+	s.audit(r, sub, auditDelete, "carb", "", before, nil)
+}
+
+func (s *HttpServer) getActivityHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got GET request for /activity", zap.Any("query", r.URL.Query()))
+
+	startTs, endTs, err := getStartEndTs(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse start/end timestamps: %w", err)
+		return
+	}
+
+	opts, err := getReadOptions(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse read options: %w", err)
+		return
+	}
+
+	activity, err := sub.ReadWriter.ReadActivityPoints(startTs, endTs, opts...)
+	if err != nil {
+		fmt.Fprintln(w, "unable to fetch activity: %w", err)
+		return
+	}
+	json.NewEncoder(w).Encode(activity)
+}
+
+type intermediateActivityPoint struct {
+	Type      string `json:"type"`
+	Intensity string `json:"intensity"`
+	Duration  int    `json:"duration"`
+	Ts        int    `json:"ts"`
+}
+
+func (p intermediateActivityPoint) point() store.ActivityPoint {
+	return store.ActivityPoint{
+		Type:      p.Type,
+		Intensity: p.Intensity,
+		Duration:  p.Duration,
+		Time:      time.Unix(int64(p.Ts), 0),
+	}
+}
+
+func (p intermediateActivityPoint) validate() error {
+	switch p.Intensity {
+	case store.IntensityLow, store.IntensityModerate, store.IntensityHigh:
+	default:
+		return fmt.Errorf("intensity must be low, moderate or high: %q", p.Intensity)
+	}
+	if p.Duration <= 0 {
+		return fmt.Errorf("duration must be a positive number of minutes: %d", p.Duration)
+	}
+	return nil
+}
+
+func (s *HttpServer) writeActivityHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got POST request for /activity/write", zap.Any("query", r.URL.Query()))
+
+	var intPoint intermediateActivityPoint
+	err := json.NewDecoder(r.Body).Decode(&intPoint)
+	if err != nil {
+		fmt.Fprintln(w, "unable to decode activity point: %w", err)
+		return
+	}
+	if err = intPoint.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	point := intPoint.point()
+	point.ID = uuid.NewString()
+	err = sub.ReadWriter.WriteActivityPoint(point)
+	if err != nil {
+		fmt.Fprintln(w, "unable to write activity point: %w", err)
+		return
+	}
+	s.audit(r, sub, auditWrite, "activity", point.ID, nil, point)
+	json.NewEncoder(w).Encode(point)
+}
+
+// deleteActivityHandler deletes a single point if an id is given,
+// otherwise every point between start and end.
+func (s *HttpServer) deleteActivityHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got DELETE request for /activity/delete", zap.Any("query", r.URL.Query()))
+	if id := r.URL.Query().Get("id"); id != "" {
+		before, err := sub.ReadWriter.ReadActivityPoint(id)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "activity point not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(w, "unable to read activity point: %w", err)
+			return
+		}
+
+		if err = sub.ReadWriter.DeleteActivityPoint(id); err != nil {
+			fmt.Fprintln(w, "unable to delete activity point: %w", err)
+			return
+		}
+		s.audit(r, sub, auditDelete, "activity", id, before, nil)
+		return
+	}
+
+	startTs, endTs, err := getStartEndTs(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse start/end timestamps: %w", err)
+		return
+	}
+
+	// Deletes include the end, unlike reads.
+	before, err := sub.ReadWriter.ReadActivityPoints(startTs, endTs+1)
+	if err != nil {
+		fmt.Fprintln(w, "unable to read activity points: %w", err)
+		return
+	}
+
+	err = sub.ReadWriter.DeleteActivityPoints(startTs, endTs)
+	if err != nil {
+		fmt.Fprintln(w, "unable to delete activity points: %w", err)
+		return
+	}
+	s.audit(r, sub, auditDelete, "activity", "", before, nil)
+}
+
+// getActivityCurvesHandler returns the glucose following each activity
+// that started between start and end. The type filter applies to the
+// activities.
+func (s *HttpServer) getActivityCurvesHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got GET request for /activity/curves", zap.Any("query", r.URL.Query()))
+
+	startTs, endTs, err := getStartEndTs(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse start/end timestamps: %w", err)
+		return
+	}
+
+	opts, err := getReadOptions(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse read options: %w", err)
+		return
+	}
+
+	curves, err := sub.Analyzer.PostActivity(startTs, endTs, opts...)
+	if err != nil {
+		fmt.Fprintln(w, "unable to get post-activity curves: %w", err)
+		return
+	}
+	json.NewEncoder(w).Encode(curves)
+}
+
+// intermediateReading is a meter, ketone or calibration reading. Meter
+// and calibration values are in mg/dL, same as glucose, and ketones are
+// in mmol/L.
+type intermediateReading struct {
+	Value float64 `json:"value"`
+	Ts    int     `json:"ts"`
+}
+
+func decodeReading(r *http.Request) (intermediateReading, error) {
+	var reading intermediateReading
+	if err := json.NewDecoder(r.Body).Decode(&reading); err != nil {
+		return reading, err
+	}
+	if reading.Value <= 0 {
+		return reading, fmt.Errorf("value must be positive: %v", reading.Value)
+	}
+	return reading, nil
+}
+
+func (s *HttpServer) getMeterHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got GET request for /meter", zap.Any("query", r.URL.Query()))
+
+	startTs, endTs, err := getStartEndTs(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse start/end timestamps: %w", err)
+		return
+	}
+
+	opts, err := getReadOptions(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse read options: %w", err)
+		return
+	}
+
+	meter, err := sub.ReadWriter.ReadMeterPoints(startTs, endTs, opts...)
+	if err != nil {
+		fmt.Fprintln(w, "unable to fetch meter readings: %w", err)
+		return
+	}
+	json.NewEncoder(w).Encode(meter)
+}
+
+func (s *HttpServer) writeMeterHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got POST request for /meter/write", zap.Any("query", r.URL.Query()))
+
+	reading, err := decodeReading(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode meter point: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	point := store.MeterPoint{
+		ID:    uuid.NewString(),
+		Value: reading.Value,
+		Time:  time.Unix(int64(reading.Ts), 0),
+	}
+	if err = sub.ReadWriter.WriteMeterPoint(point); err != nil {
+		fmt.Fprintln(w, "unable to write meter point: %w", err)
+		return
+	}
+	s.audit(r, sub, auditWrite, "meter", point.ID, nil, point)
+	json.NewEncoder(w).Encode(point)
+}
+
+func (s *HttpServer) getKetonesHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got GET request for /ketones", zap.Any("query", r.URL.Query()))
+
+	startTs, endTs, err := getStartEndTs(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse start/end timestamps: %w", err)
+		return
+	}
+
+	opts, err := getReadOptions(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse read options: %w", err)
+		return
+	}
+
+	ketones, err := sub.ReadWriter.ReadKetonePoints(startTs, endTs, opts...)
+	if err != nil {
+		fmt.Fprintln(w, "unable to fetch ketones: %w", err)
+		return
+	}
+	json.NewEncoder(w).Encode(ketones)
+}
+
+func (s *HttpServer) writeKetoneHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got POST request for /ketones/write", zap.Any("query", r.URL.Query()))
+
+	reading, err := decodeReading(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode ketone point: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	point := store.KetonePoint{
+		ID:    uuid.NewString(),
+		Value: reading.Value,
+		Time:  time.Unix(int64(reading.Ts), 0),
+	}
+	if err = sub.ReadWriter.WriteKetonePoint(point); err != nil {
+		fmt.Fprintln(w, "unable to write ketone point: %w", err)
+		return
+	}
+	s.audit(r, sub, auditWrite, "ketone", point.ID, nil, point)
+	json.NewEncoder(w).Encode(point)
+}
+
+func (s *HttpServer) getCalibrationsHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got GET request for /calibrations", zap.Any("query", r.URL.Query()))
+
+	startTs, endTs, err := getStartEndTs(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse start/end timestamps: %w", err)
+		return
+	}
+
+	opts, err := getReadOptions(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse read options: %w", err)
+		return
+	}
+
+	calibrations, err := sub.ReadWriter.ReadCalibrationPoints(startTs, endTs, opts...)
+	if err != nil {
+		fmt.Fprintln(w, "unable to fetch calibrations: %w", err)
+		return
+	}
+	json.NewEncoder(w).Encode(calibrations)
 }
 
-func (s *HttpServer) getDayToDayHandler(w http.ResponseWriter, r *http.Request) {
+func (s *HttpServer) writeCalibrationHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got POST request for /calibrations/write", zap.Any("query", r.URL.Query()))
+
+	reading, err := decodeReading(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode calibration point: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	point := store.CalibrationPoint{
+		ID:    uuid.NewString(),
+		Value: reading.Value,
+		Time:  time.Unix(int64(reading.Ts), 0),
+	}
+	if err = sub.ReadWriter.WriteCalibrationPoint(point); err != nil {
+		fmt.Fprintln(w, "unable to write calibration point: %w", err)
+		return
+	}
+	s.audit(r, sub, auditWrite, "calibration", point.ID, nil, point)
+	json.NewEncoder(w).Encode(point)
+}
+
+func (s *HttpServer) getDayToDayHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
 	s.logger.Info("got GET request for /dtd", zap.Any("query", r.URL.Query()))
 	startTs, endTs, err := getStartEndTs(r.URL.Query())
 	if err != nil {
@@ -245,7 +859,7 @@ func (s *HttpServer) getDayToDayHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	result, err := s.analyzer.DayToDay(startTs, endTs)
+	result, err := sub.Analyzer.DayToDay(startTs, endTs)
 	if err != nil {
 		fmt.Fprintln(w, "unable to get day-to-day analysis: %w", err)
 		return
@@ -253,6 +867,270 @@ func (s *HttpServer) getDayToDayHandler(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(result)
 }
 
+func (s *HttpServer) getAGPHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got GET request for /agp", zap.Any("query", r.URL.Query()))
+	startTs, endTs, err := getStartEndTs(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse start/end timestamps: %w", err)
+		return
+	}
+
+	result, err := sub.Analyzer.AGP(startTs, endTs)
+	if err != nil {
+		fmt.Fprintln(w, "unable to get ambulatory glucose profile: %w", err)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// getTimeInRangeHandler returns the time in range overall, and per day
+// or week as given by period (day by default).
+func (s *HttpServer) getTimeInRangeHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got GET request for /tir", zap.Any("query", r.URL.Query()))
+	startTs, endTs, err := getStartEndTs(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse start/end timestamps: %w", err)
+		return
+	}
+
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = analysis.PeriodDay
+	}
+
+	result, err := sub.Analyzer.TimeInRange(startTs, endTs, period)
+	if err != nil {
+		fmt.Fprintln(w, "unable to get time in range: %w", err)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// getVariabilityHandler returns the variability metrics, with CONGA over
+// conga hours (1 by default).
+func (s *HttpServer) getVariabilityHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got GET request for /variability", zap.Any("query", r.URL.Query()))
+	startTs, endTs, err := getStartEndTs(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse start/end timestamps: %w", err)
+		return
+	}
+
+	congaHours := 1
+	if congaStr := r.URL.Query().Get("conga"); congaStr != "" {
+		congaHours, err = strconv.Atoi(congaStr)
+		if err != nil {
+			fmt.Fprintln(w, "unable to parse conga hours: %w", err)
+			return
+		}
+	}
+
+	result, err := sub.Analyzer.Variability(startTs, endTs, congaHours)
+	if err != nil {
+		fmt.Fprintln(w, "unable to get variability: %w", err)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *HttpServer) getGMIHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got GET request for /gmi", zap.Any("query", r.URL.Query()))
+	startTs, endTs, err := getStartEndTs(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse start/end timestamps: %w", err)
+		return
+	}
+
+	result, err := sub.Analyzer.GMI(startTs, endTs)
+	if err != nil {
+		fmt.Fprintln(w, "unable to get GMI: %w", err)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+type episodesResponse struct {
+	// Total is the number of episodes in the range, across all pages.
+	Total    int
+	Offset   int
+	Episodes []analysis.Episode
+}
+
+// getEpisodesHandler returns a page of the hypo and hyper episodes, oldest
+// first. The type (hypo or hyper) is optional, and pages are picked with
+// offset and limit (50 by default).
+func (s *HttpServer) getEpisodesHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got GET request for /episodes", zap.Any("query", r.URL.Query()))
+	startTs, endTs, err := getStartEndTs(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse start/end timestamps: %w", err)
+		return
+	}
+
+	offset, limit := 0, defaultEpisodesLimit
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			fmt.Fprintln(w, "offset is not a valid int:", offsetStr)
+			return
+		}
+	}
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			fmt.Fprintln(w, "limit is not a valid int:", limitStr)
+			return
+		}
+	}
+
+	episodes, err := sub.Analyzer.Episodes(startTs, endTs, r.URL.Query().Get("type"))
+	if err != nil {
+		fmt.Fprintln(w, "unable to get episodes: %w", err)
+		return
+	}
+
+	// Clamp before adding, so a huge limit cannot overflow.
+	from := min(offset, len(episodes))
+	to := from + min(limit, len(episodes)-from)
+	resp := episodesResponse{
+		Total:    len(episodes),
+		Offset:   offset,
+		Episodes: episodes[from:to],
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *HttpServer) importClarityHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got POST request for /import/clarity", zap.Any("query", r.URL.Query()))
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Clarity timestamps have no timezone, so it needs to be provided.
+	loc := time.Local
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			fmt.Fprintln(w, "unable to load timezone: %w", err)
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(importTimeout)
+	if err := rc.SetReadDeadline(deadline); err != nil {
+		s.logger.Warn("unable to extend read deadline", zap.Error(err))
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		s.logger.Warn("unable to extend write deadline", zap.Error(err))
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		fmt.Fprintln(w, "unable to read uploaded file: %w", err)
+		return
+	}
+	defer file.Close()
+
+	result, err := sub.Importer.Import(file, loc)
+	if err != nil {
+		fmt.Fprintln(w, "unable to import clarity export: %w", err)
+		return
+	}
+	s.audit(r, sub, auditImport, "clarity", "", nil, result)
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *HttpServer) uploadEntriesHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got POST request for /api/v1/entries", zap.String("userAgent", r.UserAgent()))
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadSize))
+	if err != nil {
+		http.Error(w, "unable to read body", http.StatusBadRequest)
+		return
+	}
+
+	glucose, err := fetcher.ParseNightscoutEntries(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to parse entries: %s", err), http.StatusBadRequest)
+		return
+	}
+	if len(glucose) > 0 {
+		if err = sub.Receiver.WriteGlucosePoints(glucose); err != nil {
+			http.Error(w, fmt.Sprintf("unable to write entries: %s", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Uploaders expect the created entries to be echoed back.
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (s *HttpServer) getAuditHandler(w http.ResponseWriter, r *http.Request, sub *Subject) {
+	s.logger.Info("got GET request for /audit", zap.Any("query", r.URL.Query()))
+
+	startTs, endTs, err := getStartEndTs(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse start/end timestamps: %w", err)
+		return
+	}
+
+	opts, err := getReadOptions(r.URL.Query())
+	if err != nil {
+		fmt.Fprintln(w, "unable to parse read options: %w", err)
+		return
+	}
+
+	audit, err := sub.ReadWriter.ReadAuditPoints(startTs, endTs, opts...)
+	if err != nil {
+		fmt.Fprintln(w, "unable to fetch audit trail: %w", err)
+		return
+	}
+	json.NewEncoder(w).Encode(audit)
+}
+
+// audit records a change made through the API. The change has already
+// been made by then, so failing to record it is only logged.
+func (s *HttpServer) audit(r *http.Request, sub *Subject, action, kind, id string, before, after any) {
+	actor, _ := r.Context().Value(actorKey).(string)
+	point := store.AuditPoint{
+		Action: action,
+		Kind:   kind,
+		ID:     id,
+		Actor:  actor,
+		Client: strings.TrimSpace(r.RemoteAddr + " " + r.UserAgent()),
+		Time:   time.Now(),
+	}
+
+	var err error
+	if before != nil {
+		if point.Before, err = json.Marshal(before); err != nil {
+			s.logger.Error("unable to marshal audit before", zap.Error(err))
+		}
+	}
+	if after != nil {
+		if point.After, err = json.Marshal(after); err != nil {
+			s.logger.Error("unable to marshal audit after", zap.Error(err))
+		}
+	}
+
+	if err = sub.ReadWriter.WriteAuditPoint(point); err != nil {
+		s.logger.Error("unable to write audit point",
+			zap.String("action", action),
+			zap.String("kind", kind),
+			zap.Error(err),
+		)
+	}
+}
+
 func getStartEndTs(values url.Values) (int, int, error) {
 	startStr := values.Get("start")
 	if startStr == "" {
@@ -275,6 +1153,51 @@ func getStartEndTs(values url.Values) (int, int, error) {
 	return startTs, endTs, nil
 }
 
+// getReadOptions parses the optional filters for reads: type (insulin and
+// activity only), limit, and order (asc or desc).
+func getReadOptions(values url.Values) ([]store.ReadOption, error) {
+	var opts []store.ReadOption
+	if pointType := values.Get("type"); pointType != "" {
+		opts = append(opts, store.WithType(pointType))
+	}
+	if limitStr := values.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("limit is not a valid int: %s", limitStr)
+		}
+		opts = append(opts, store.WithLimit(limit))
+	}
+	switch order := values.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		opts = append(opts, store.Descending())
+	default:
+		return nil, fmt.Errorf("order must be asc or desc: %s", order)
+	}
+	return opts, nil
+}
+
+// apiSecretAuth checks the api-secret header the same way Nightscout does,
+// it is the SHA1 hash of the secret (uploaders always send it hashed).
+// Each subject has its own secret, so this also picks the subject.
+func (s *HttpServer) apiSecretAuth(next subjectHandler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.ToLower(r.Header.Get("api-secret"))
+		for _, sub := range s.subjects {
+			if sub.Config.XDrip.APISecret == "" || sub.Receiver == nil {
+				continue
+			}
+			expectedHash := sha1.Sum([]byte(sub.Config.XDrip.APISecret))
+			expected := hex.EncodeToString(expectedHash[:])
+			if subtle.ConstantTimeCompare([]byte(got), []byte(expected)) == 1 {
+				next(w, r, sub)
+				return
+			}
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
 // This is some very basic authentication, I think it is ok for now.
 // If I need something better, I can always swap out the middleware.
 func (s *HttpServer) basicAuth(next http.HandlerFunc) http.HandlerFunc {
@@ -283,14 +1206,22 @@ func (s *HttpServer) basicAuth(next http.HandlerFunc) http.HandlerFunc {
 		if ok {
 			usernameHash := sha256.Sum256([]byte(username))
 			passwordHash := sha256.Sum256([]byte(password))
-			expectedUsernameHash := sha256.Sum256([]byte(s.username))
-			expectedPasswordHash := sha256.Sum256([]byte(s.password))
 
-			usernameMatch := (subtle.ConstantTimeCompare(usernameHash[:], expectedUsernameHash[:]) == 1)
-			passwordMatch := (subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 1)
+			// Check every user, so the time taken does not give away
+			// which usernames exist.
+			matched := false
+			for expectedUsername, expectedPassword := range s.users {
+				expectedUsernameHash := sha256.Sum256([]byte(expectedUsername))
+				expectedPasswordHash := sha256.Sum256([]byte(expectedPassword))
+
+				usernameMatch := (subtle.ConstantTimeCompare(usernameHash[:], expectedUsernameHash[:]) == 1)
+				passwordMatch := (subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 1)
+				matched = matched || (usernameMatch && passwordMatch)
+			}
 
-			if usernameMatch && passwordMatch {
-				next.ServeHTTP(w, r)
+			if matched {
+				ctx := context.WithValue(r.Context(), actorKey, username)
+				next.ServeHTTP(w, r.WithContext(ctx))
 				return
 			}
 		}
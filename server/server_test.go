@@ -0,0 +1,630 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/algao1/iv3/analysis"
+	"github.com/algao1/iv3/config"
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+const (
+	testUsername = "user"
+	testPassword = "pass"
+	testSecret   = "averylongsecret"
+)
+
+var testIv3Cfg = config.Iv3Config{
+	Unit:          "mg/dL",
+	HighThreshold: 180,
+	LowThreshold:  70,
+}
+
+// newTestServer serves two subjects, alice (the default) and bob, backed
+// by the returned in-memory store.
+func newTestServer(t *testing.T) (*httptest.Server, *store.MemoryStore) {
+	t.Helper()
+	st := store.NewMemoryStore()
+
+	var subjects []*Subject
+	for _, name := range []string{"alice", "bob"} {
+		subStore := st.ForSubject(name)
+		cfg := config.SubjectConfig{Name: name, Iv3: testIv3Cfg}
+		if name == "bob" {
+			cfg.XDrip.APISecret = testSecret
+		}
+		subjects = append(subjects, &Subject{
+			Config:     cfg,
+			ReadWriter: subStore,
+			Analyzer:   analysis.NewAnalyzer(subStore, cfg.Iv3, zap.NewNop()),
+			Receiver:   subStore,
+		})
+	}
+
+	api := config.APIConfig{
+		Username: testUsername,
+		Password: testPassword,
+		Users:    []config.APIUser{{Username: "caregiver", Password: "secret"}},
+	}
+	s := NewHttpServer(api, subjects, zap.NewNop())
+	mux := http.NewServeMux()
+	s.addHandlers(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, st
+}
+
+func doRequest(t *testing.T, method, url string, body string) *http.Response {
+	t.Helper()
+	return doRequestAs(t, testUsername, testPassword, method, url, body)
+}
+
+func doRequestAs(t *testing.T, username, password, method, url string, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth(username, password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func decode[T any](t *testing.T, resp *http.Response) T {
+	t.Helper()
+	var v T
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatalf("unable to decode response: %v", err)
+	}
+	return v
+}
+
+func TestBasicAuth(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	resp, err := http.Get(srv.URL + "/glucose?start=0&end=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", resp.StatusCode)
+	}
+}
+
+func TestBasicAuthUsers(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	resp := doRequestAs(t, "caregiver", "secret", http.MethodGet, srv.URL+"/subjects", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 for an additional user, got %d", resp.StatusCode)
+	}
+	// Passwords belong to a single user.
+	resp = doRequestAs(t, testUsername, "secret", http.MethodGet, srv.URL+"/subjects", "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for another user's password, got %d", resp.StatusCode)
+	}
+}
+
+func TestGetGlucose(t *testing.T) {
+	srv, st := newTestServer(t)
+	ts := time.Unix(1000, 0)
+	err := st.ForSubject("alice").WriteGlucosePoints([]store.GlucosePoint{
+		{Value: 120, Trend: store.TrendFortyFiveUp, Time: ts},
+		{Value: 130, Trend: store.TrendNotComputable, Time: ts.Add(5 * time.Minute)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/glucose?start=0&end=2000", "")
+	glucose := decode[[]glucoseResponse](t, resp)
+	if len(glucose) != 2 {
+		t.Fatalf("expected 2 points, got %d", len(glucose))
+	}
+	if glucose[0].Value != 120 || glucose[0].Trend != store.TrendFortyFiveUp {
+		t.Errorf("unexpected first point: %+v", glucose[0])
+	}
+	if glucose[0].Rate == nil || *glucose[0].Rate != 1.5 {
+		t.Errorf("expected a rate of 1.5, got %v", glucose[0].Rate)
+	}
+	if glucose[1].Rate != nil {
+		t.Errorf("expected no rate when not computable, got %v", *glucose[1].Rate)
+	}
+}
+
+func TestInsulin(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	for i, body := range []string{
+		`{"value": 4, "type": "Humalog", "ts": 1000}`,
+		`{"value": 20, "type": "Tresiba", "ts": 2000}`,
+	} {
+		resp := doRequest(t, http.MethodPost, srv.URL+"/insulin/write", body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("write %d: expected 200, got %d", i, resp.StatusCode)
+		}
+	}
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/insulin?start=0&end=3000", "")
+	insulin := decode[[]store.InsulinPoint](t, resp)
+	if len(insulin) != 2 || insulin[0].Type != "Humalog" || insulin[1].Value != 20 {
+		t.Fatalf("unexpected insulin points: %+v", insulin)
+	}
+
+	// Deletes include the end, same as InfluxDB.
+	doRequest(t, http.MethodDelete, srv.URL+"/insulin/delete?start=0&end=1000", "")
+	resp = doRequest(t, http.MethodGet, srv.URL+"/insulin?start=0&end=3000", "")
+	insulin = decode[[]store.InsulinPoint](t, resp)
+	if len(insulin) != 1 || insulin[0].Type != "Tresiba" {
+		t.Fatalf("expected only the Tresiba dose to be left, got %+v", insulin)
+	}
+}
+
+func TestInsulinUpdateAndDelete(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/insulin/write", `{"value": 4, "type": "Humalog", "ts": 1000}`)
+	written := decode[store.InsulinPoint](t, resp)
+	if written.ID == "" {
+		t.Fatalf("expected the written point to have an ID, got %+v", written)
+	}
+	doRequest(t, http.MethodPost, srv.URL+"/insulin/write", `{"value": 6, "type": "Humalog", "ts": 1000}`)
+
+	body := fmt.Sprintf(`{"id": %q, "value": 5, "type": "Humalog", "ts": 1000}`, written.ID)
+	resp = doRequest(t, http.MethodPost, srv.URL+"/insulin/update", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 updating, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/insulin?start=0&end=2000", "")
+	insulin := decode[[]store.InsulinPoint](t, resp)
+	if len(insulin) != 2 {
+		t.Fatalf("expected both doses at the same time to be kept, got %+v", insulin)
+	}
+	for _, ins := range insulin {
+		if ins.ID == written.ID && ins.Value != 5 {
+			t.Errorf("expected the dose to be updated, got %+v", ins)
+		}
+	}
+
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/insulin/delete?id="+written.ID, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 deleting, got %d", resp.StatusCode)
+	}
+	resp = doRequest(t, http.MethodGet, srv.URL+"/insulin?start=0&end=2000", "")
+	if insulin = decode[[]store.InsulinPoint](t, resp); len(insulin) != 1 || insulin[0].Value != 6 {
+		t.Fatalf("expected only the other dose to be left, got %+v", insulin)
+	}
+
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/insulin/delete?id="+written.ID, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 deleting twice, got %d", resp.StatusCode)
+	}
+	resp = doRequest(t, http.MethodPost, srv.URL+"/carbs/update", `{"id": "missing", "value": 10, "ts": 1000}`)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 updating a missing carb point, got %d", resp.StatusCode)
+	}
+}
+
+func TestUpdateWithoutTimestamp(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	tests := []struct {
+		kind string
+		body string
+	}{
+		{kind: "insulin", body: `{"id": %q, "value": 5, "type": "Humalog"}`},
+		{kind: "carbs", body: `{"id": %q, "value": 50}`},
+	}
+	for _, tt := range tests {
+		resp := doRequest(t, http.MethodPost, srv.URL+"/"+tt.kind+"/write", `{"value": 4, "type": "Humalog", "ts": 1000}`)
+		written := decode[struct{ ID string }](t, resp)
+
+		resp = doRequest(t, http.MethodPost, srv.URL+"/"+tt.kind+"/update", fmt.Sprintf(tt.body, written.ID))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200 updating, got %d", tt.kind, resp.StatusCode)
+		}
+
+		resp = doRequest(t, http.MethodGet, srv.URL+"/"+tt.kind+"?start=0&end=2000", "")
+		points := decode[[]struct {
+			ID    string
+			Value int
+			Time  time.Time
+		}](t, resp)
+		if len(points) != 1 || points[0].ID != written.ID || points[0].Time.Unix() != 1000 {
+			t.Errorf("%s: expected the point to keep its time, got %+v", tt.kind, points)
+		}
+	}
+}
+
+func TestInsulinFilters(t *testing.T) {
+	srv, st := newTestServer(t)
+	alice := st.ForSubject("alice")
+	for i, insType := range []string{"Humalog", "Tresiba", "Humalog"} {
+		alice.WriteInsulinPoint(store.InsulinPoint{
+			Value: i,
+			Type:  insType,
+			Time:  time.Unix(int64(1000*(i+1)), 0),
+		})
+	}
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/insulin?start=0&end=5000&type=Humalog&order=desc&limit=1", "")
+	insulin := decode[[]store.InsulinPoint](t, resp)
+	if len(insulin) != 1 || insulin[0].Value != 2 {
+		t.Fatalf("expected the latest Humalog dose, got %+v", insulin)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/insulin?start=0&end=5000&order=sideways", "")
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "unable to parse read options") {
+		t.Errorf("expected an invalid order error, got %q", body)
+	}
+}
+
+func TestCarbs(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	doRequest(t, http.MethodPost, srv.URL+"/carbs/write", `{"value": 45, "ts": 1000}`)
+	resp := doRequest(t, http.MethodGet, srv.URL+"/carbs?start=0&end=2000", "")
+	carbs := decode[[]store.CarbPoint](t, resp)
+	if len(carbs) != 1 || carbs[0].Value != 45 || carbs[0].Time.Unix() != 1000 {
+		t.Fatalf("unexpected carb points: %+v", carbs)
+	}
+
+	doRequest(t, http.MethodDelete, srv.URL+"/carbs/delete?start=0&end=2000", "")
+	resp = doRequest(t, http.MethodGet, srv.URL+"/carbs?start=0&end=2000", "")
+	if carbs = decode[[]store.CarbPoint](t, resp); len(carbs) != 0 {
+		t.Fatalf("expected no carb points, got %+v", carbs)
+	}
+}
+
+func TestActivity(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/activity/write",
+		`{"type": "run", "intensity": "high", "duration": 30, "ts": 1000}`)
+	written := decode[store.ActivityPoint](t, resp)
+	if written.ID == "" || written.Duration != 30 {
+		t.Fatalf("unexpected written point: %+v", written)
+	}
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/activity/write",
+		`{"type": "run", "intensity": "extreme", "duration": 30, "ts": 1000}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown intensity, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/activity?start=0&end=2000&type=run", "")
+	if activity := decode[[]store.ActivityPoint](t, resp); len(activity) != 1 {
+		t.Fatalf("expected 1 activity point, got %+v", activity)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/activity/curves?start=0&end=2000", "")
+	if curves := decode[[]analysis.ActivityCurve](t, resp); len(curves) != 1 || curves[0].Activity.ID != written.ID {
+		t.Fatalf("expected a curve for the run, got %+v", curves)
+	}
+
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/activity/delete?id="+written.ID, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 deleting, got %d", resp.StatusCode)
+	}
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/activity/delete?id="+written.ID, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 deleting twice, got %d", resp.StatusCode)
+	}
+}
+
+func TestReadings(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	for _, path := range []string{"/meter", "/ketones", "/calibrations"} {
+		resp := doRequest(t, http.MethodPost, srv.URL+path+"/write", `{"value": 1.5, "ts": 1000}`)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200 writing, got %d", path, resp.StatusCode)
+		}
+		resp = doRequest(t, http.MethodPost, srv.URL+path+"/write", `{"value": -1, "ts": 1000}`)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400 for a negative value, got %d", path, resp.StatusCode)
+		}
+	}
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/ketones?start=0&end=2000", "")
+	ketones := decode[[]store.KetonePoint](t, resp)
+	if len(ketones) != 1 || ketones[0].Value != 1.5 || ketones[0].ID == "" {
+		t.Fatalf("unexpected ketone points: %+v", ketones)
+	}
+	resp = doRequest(t, http.MethodGet, srv.URL+"/meter?start=0&end=2000", "")
+	if meter := decode[[]store.MeterPoint](t, resp); len(meter) != 1 {
+		t.Fatalf("expected 1 meter point, got %+v", meter)
+	}
+	resp = doRequest(t, http.MethodGet, srv.URL+"/calibrations?start=0&end=2000", "")
+	if calib := decode[[]store.CalibrationPoint](t, resp); len(calib) != 1 {
+		t.Fatalf("expected 1 calibration point, got %+v", calib)
+	}
+}
+
+func TestMissingTimestamps(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/glucose?start=0", "")
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "no end timestamp provided") {
+		t.Errorf("expected a missing end error, got %q", body)
+	}
+}
+
+func TestSubjects(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/subjects", "")
+	names := decode[[]string](t, resp)
+	if len(names) != 2 || names[0] != "alice" || names[1] != "bob" {
+		t.Fatalf("unexpected subjects: %v", names)
+	}
+
+	doRequest(t, http.MethodPost, srv.URL+"/subjects/bob/carbs/write", `{"value": 30, "ts": 1000}`)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/subjects/bob/carbs?start=0&end=2000", "")
+	if carbs := decode[[]store.CarbPoint](t, resp); len(carbs) != 1 {
+		t.Errorf("expected bob to have 1 carb point, got %+v", carbs)
+	}
+	resp = doRequest(t, http.MethodGet, srv.URL+"/carbs?start=0&end=2000", "")
+	if carbs := decode[[]store.CarbPoint](t, resp); len(carbs) != 0 {
+		t.Errorf("expected alice to have no carb points, got %+v", carbs)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/subjects/carol/carbs?start=0&end=2000", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown subject, got %d", resp.StatusCode)
+	}
+}
+
+func TestDayToDay(t *testing.T) {
+	srv, st := newTestServer(t)
+	ts := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	err := st.ForSubject("alice").WriteGlucosePoints([]store.GlucosePoint{
+		{Value: 100, Time: ts},
+		{Value: 200, Time: ts.Add(5 * time.Minute)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("%s/dtd?start=%d&end=%d", srv.URL, ts.Unix(), ts.Add(time.Hour).Unix())
+	result := decode[analysis.DayToDayResult](t, doRequest(t, http.MethodGet, url, ""))
+	if result.Average != 150 || result.InRange != 0.5 {
+		t.Errorf("unexpected day-to-day result: %+v", result)
+	}
+}
+
+func TestAGP(t *testing.T) {
+	srv, st := newTestServer(t)
+	ts := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	err := st.ForSubject("alice").WriteGlucosePoints([]store.GlucosePoint{
+		{Value: 100, Time: ts},
+		{Value: 200, Time: ts.Add(24 * time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("%s/agp?start=%d&end=%d", srv.URL, ts.Unix(), ts.Add(48*time.Hour).Unix())
+	result := decode[analysis.AGPResult](t, doRequest(t, http.MethodGet, url, ""))
+	if result.P5[0] != 100 || result.P95[0] != 200 || result.Summary.Days != 2 {
+		t.Errorf("unexpected AGP result: %+v", result.Summary)
+	}
+}
+
+func TestTimeInRange(t *testing.T) {
+	srv, st := newTestServer(t)
+	ts := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	err := st.ForSubject("alice").WriteGlucosePoints([]store.GlucosePoint{
+		{Value: 100, Time: ts},
+		{Value: 300, Time: ts.Add(24 * time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("%s/tir?start=%d&end=%d", srv.URL, ts.Unix(), ts.Add(48*time.Hour).Unix())
+	result := decode[analysis.TimeInRangeResult](t, doRequest(t, http.MethodGet, url, ""))
+	if len(result.Periods) != 2 || result.Overall.InRange.Fraction != 0.5 {
+		t.Errorf("unexpected time in range: %+v", result)
+	}
+
+	resp := doRequest(t, http.MethodGet, url+"&period=month", "")
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "unable to get time in range") {
+		t.Errorf("expected an invalid period error, got %q", body)
+	}
+}
+
+func TestVariability(t *testing.T) {
+	srv, st := newTestServer(t)
+	ts := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	err := st.ForSubject("alice").WriteGlucosePoints([]store.GlucosePoint{
+		{Value: 100, Time: ts},
+		{Value: 140, Time: ts.Add(2 * time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("%s/variability?start=%d&end=%d&conga=2", srv.URL, ts.Unix(), ts.Add(24*time.Hour).Unix())
+	result := decode[analysis.VariabilityResult](t, doRequest(t, http.MethodGet, url, ""))
+	if result.Readings != 2 || result.Mean != 120 || result.CONGAHours != 2 {
+		t.Errorf("unexpected variability: %+v", result)
+	}
+
+	url = fmt.Sprintf("%s/variability?start=%d&end=%d&conga=0", srv.URL, ts.Unix(), ts.Add(24*time.Hour).Unix())
+	resp := doRequest(t, http.MethodGet, url, "")
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "unable to get variability") {
+		t.Errorf("expected an invalid conga error, got %q", body)
+	}
+}
+
+func TestGMI(t *testing.T) {
+	srv, _ := newTestServer(t)
+	ts := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	url := fmt.Sprintf("%s/gmi?start=%d&end=%d", srv.URL, ts.Unix(), ts.Add(7*24*time.Hour).Unix())
+	result := decode[[]analysis.GMISeries](t, doRequest(t, http.MethodGet, url, ""))
+	if len(result) != 2 || result[0].Days != 14 || len(result[0].Points) != 7 {
+		t.Fatalf("expected a week of 14 and 90 day GMIs, got %+v", result)
+	}
+	if result[0].Points[6].Sufficient {
+		t.Errorf("expected no GMI without readings, got %+v", result[0].Points[6])
+	}
+}
+
+func TestEpisodes(t *testing.T) {
+	srv, st := newTestServer(t)
+	ts := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	// Three hypos, each three readings long and an hour apart.
+	var glucose []store.GlucosePoint
+	for i := 0; i < 3; i++ {
+		for j, v := range []float64{60, 60, 60, 100, 100, 100} {
+			glucose = append(glucose, store.GlucosePoint{
+				Value: v,
+				Time:  ts.Add(time.Duration(i)*time.Hour + time.Duration(j)*5*time.Minute),
+			})
+		}
+	}
+	if err := st.ForSubject("alice").WriteGlucosePoints(glucose); err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("%s/episodes?start=%d&end=%d&type=hypo&offset=1&limit=1", srv.URL, ts.Unix(), ts.Add(4*time.Hour).Unix())
+	resp := decode[episodesResponse](t, doRequest(t, http.MethodGet, url, ""))
+	if resp.Total != 3 || resp.Offset != 1 || len(resp.Episodes) != 1 {
+		t.Fatalf("expected the second of 3 episodes, got %+v", resp)
+	}
+	if !resp.Episodes[0].Start.Equal(ts.Add(time.Hour)) {
+		t.Errorf("expected the second episode to start after an hour, got %v", resp.Episodes[0].Start)
+	}
+
+	url = fmt.Sprintf("%s/episodes?start=%d&end=%d&offset=5", srv.URL, ts.Unix(), ts.Add(4*time.Hour).Unix())
+	if resp = decode[episodesResponse](t, doRequest(t, http.MethodGet, url, "")); len(resp.Episodes) != 0 {
+		t.Errorf("expected no episodes past the end, got %+v", resp)
+	}
+
+	url = fmt.Sprintf("%s/episodes?start=%d&end=%d&offset=1&limit=%d", srv.URL, ts.Unix(), ts.Add(4*time.Hour).Unix(), math.MaxInt64)
+	if resp = decode[episodesResponse](t, doRequest(t, http.MethodGet, url, "")); len(resp.Episodes) != 2 {
+		t.Errorf("expected the last 2 episodes with a huge limit, got %+v", resp)
+	}
+}
+
+func TestUploadEntries(t *testing.T) {
+	srv, st := newTestServer(t)
+	body := `[{"type": "sgv", "sgv": 110, "date": 1000000, "direction": "Flat"}]`
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/entries", strings.NewReader(body))
+	req.Header.Set("api-secret", "wrong")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 with the wrong secret, got %d", resp.StatusCode)
+	}
+
+	hash := sha1.Sum([]byte(testSecret))
+	req, _ = http.NewRequest(http.MethodPost, srv.URL+"/api/v1/entries", strings.NewReader(body))
+	req.Header.Set("api-secret", hex.EncodeToString(hash[:]))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	// The secret belongs to bob.
+	glucose, err := st.ForSubject("bob").ReadGlucosePoints(0, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(glucose) != 1 || glucose[0].Value != 110 || glucose[0].Trend != store.TrendFlat {
+		t.Fatalf("unexpected glucose points: %+v", glucose)
+	}
+}
+
+func present(raw json.RawMessage) bool {
+	return len(raw) > 0 && string(raw) != "null"
+}
+
+func TestAudit(t *testing.T) {
+	srv, _ := newTestServer(t)
+	start := time.Now().Unix()
+
+	resp := doRequestAs(t, "caregiver", "secret", http.MethodPost, srv.URL+"/insulin/write",
+		`{"value": 4, "type": "Humalog", "ts": 1000}`)
+	written := decode[store.InsulinPoint](t, resp)
+
+	body := fmt.Sprintf(`{"id": %q, "value": 5, "type": "Humalog", "ts": 1000}`, written.ID)
+	doRequest(t, http.MethodPost, srv.URL+"/insulin/update", body)
+	doRequest(t, http.MethodPost, srv.URL+"/carbs/write", `{"value": 45, "ts": 1000}`)
+	doRequest(t, http.MethodDelete, srv.URL+"/carbs/delete?start=0&end=1000", "")
+
+	url := fmt.Sprintf("%s/audit?start=%d&end=%d", srv.URL, start, time.Now().Unix()+1)
+	audit := decode[[]store.AuditPoint](t, doRequest(t, http.MethodGet, url, ""))
+	if len(audit) != 4 {
+		t.Fatalf("expected 4 audit points, got %+v", audit)
+	}
+
+	expected := []struct {
+		action, kind, actor string
+		before, after       bool
+	}{
+		{auditWrite, "insulin", "caregiver", false, true},
+		{auditUpdate, "insulin", testUsername, true, true},
+		{auditWrite, "carb", testUsername, false, true},
+		{auditDelete, "carb", testUsername, true, false},
+	}
+	for i, e := range expected {
+		ap := audit[i]
+		if ap.Action != e.action || ap.Kind != e.kind || ap.Actor != e.actor {
+			t.Errorf("audit %d: expected %s %s by %s, got %+v", i, e.action, e.kind, e.actor, ap)
+		}
+		if present(ap.Before) != e.before || present(ap.After) != e.after {
+			t.Errorf("audit %d: unexpected before/after: %s / %s", i, ap.Before, ap.After)
+		}
+	}
+
+	var before store.InsulinPoint
+	if err := json.Unmarshal(audit[1].Before, &before); err != nil || before.Value != 4 {
+		t.Errorf("expected the dose before the update to be 4, got %s", audit[1].Before)
+	}
+	var deleted []store.CarbPoint
+	if err := json.Unmarshal(audit[3].Before, &deleted); err != nil || len(deleted) != 1 {
+		t.Errorf("expected the deleted carbs to be recorded, got %s", audit[3].Before)
+	}
+	if audit[0].ID != written.ID || audit[0].Client == "" {
+		t.Errorf("expected the ID and client to be recorded, got %+v", audit[0])
+	}
+
+	// The trail is per subject.
+	url = fmt.Sprintf("%s/subjects/bob/audit?start=%d&end=%d", srv.URL, start, time.Now().Unix()+1)
+	if audit = decode[[]store.AuditPoint](t, doRequest(t, http.MethodGet, url, "")); len(audit) != 0 {
+		t.Errorf("expected no audit points for bob, got %+v", audit)
+	}
+}
@@ -0,0 +1,569 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+const (
+	glucoseKind     = "glucose"
+	insulinKind     = "insulin"
+	carbKind        = "carb"
+	eventKind       = "event"
+	activityKind    = "activity"
+	meterKind       = "meter"
+	ketoneKind      = "ketone"
+	calibrationKind = "calibration"
+	auditKind       = "audit"
+)
+
+// BoltClient is an embedded store, for running iv3 without InfluxDB.
+// Each subject gets its own bucket, with a nested bucket for each kind
+// of point. Keys start with the big-endian timestamp, so cursors iterate
+// in time order. Keys of points with an ID end with it.
+type BoltClient struct {
+	db     *bolt.DB
+	logger *zap.Logger
+
+	subject string
+}
+
+func NewBolt(path string, logger *zap.Logger) (*BoltClient, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("unable to create directory for %s: %w", path, err)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open bolt db %s: %w", path, err)
+	}
+	logger.Info("opened bolt db", zap.String("path", path))
+
+	return &BoltClient{
+		db:     db,
+		logger: logger,
+	}, nil
+}
+
+func (c *BoltClient) Close() error {
+	return c.db.Close()
+}
+
+func (c *BoltClient) ForSubject(subject string) Store {
+	scoped := *c
+	scoped.subject = subject
+	scoped.logger = c.logger.With(zap.String("subject", subject))
+	return &scoped
+}
+
+func (c *BoltClient) Name() string {
+	if c.subject == "" {
+		return "bolt"
+	}
+	return "bolt_" + c.subject
+}
+
+func (c *BoltClient) WriteGlucosePoints(glucose []GlucosePoint) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b, err := c.bucket(tx, glucoseKind)
+		if err != nil {
+			return err
+		}
+		for _, gp := range glucose {
+			if err := put(b, timeKey(gp.Time), gp); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write glucose points to bolt: %w", err)
+	}
+	c.logger.Debug("wrote glucose points", zap.Int("count", len(glucose)))
+	return nil
+}
+
+func (c *BoltClient) ReadGlucosePoints(startTs, endTs int, opts ...ReadOption) ([]GlucosePoint, error) {
+	glucose := make([]GlucosePoint, 0)
+	err := c.scan(glucoseKind, startTs, endTs, func(v []byte) error {
+		var gp GlucosePoint
+		if err := json.Unmarshal(v, &gp); err != nil {
+			return err
+		}
+		glucose = append(glucose, gp)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read glucose points between %d and %d: %w", startTs, endTs, err)
+	}
+	return orderAndLimit(glucose, newReadOptions(opts)), nil
+}
+
+func (c *BoltClient) ReadLatestGlucosePoint() (*GlucosePoint, error) {
+	var latest *GlucosePoint
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b := c.readBucket(tx, glucoseKind)
+		if b == nil {
+			return nil
+		}
+		_, v := b.Cursor().Last()
+		if v == nil {
+			return nil
+		}
+		latest = &GlucosePoint{}
+		return json.Unmarshal(v, latest)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read latest glucose point: %w", err)
+	}
+	return latest, nil
+}
+
+func (c *BoltClient) WriteInsulinPoint(insulin InsulinPoint) error {
+	if insulin.ID == "" {
+		insulin.ID = newID()
+	}
+	if err := c.put(insulinKind, idKey(insulin.Time, insulin.ID), insulin); err != nil {
+		return fmt.Errorf("unable to write insulin point to bolt: %w", err)
+	}
+	c.logger.Debug("wrote insulin point", zap.Time("ts", insulin.Time))
+	return nil
+}
+
+func (c *BoltClient) ReadInsulinPoints(startTs, endTs int, opts ...ReadOption) ([]InsulinPoint, error) {
+	o := newReadOptions(opts)
+	insulin := make([]InsulinPoint, 0)
+	err := c.scan(insulinKind, startTs, endTs, func(v []byte) error {
+		var ins InsulinPoint
+		if err := json.Unmarshal(v, &ins); err != nil {
+			return err
+		}
+		if o.pointType == "" || ins.Type == o.pointType {
+			insulin = append(insulin, ins)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read insulin points between %d and %d: %w", startTs, endTs, err)
+	}
+	return orderAndLimit(insulin, o), nil
+}
+
+func (c *BoltClient) ReadInsulinPoint(id string) (*InsulinPoint, error) {
+	var insulin InsulinPoint
+	if err := c.get(insulinKind, id, &insulin); err != nil {
+		return nil, fmt.Errorf("unable to read insulin point %s: %w", id, err)
+	}
+	return &insulin, nil
+}
+
+func (c *BoltClient) DeleteInsulinPoints(startTs, endTs int) error {
+	return c.delete(insulinKind, startTs, endTs)
+}
+
+func (c *BoltClient) UpdateInsulinPoint(insulin InsulinPoint) error {
+	err := c.replace(insulinKind, insulin.ID, idKey(insulin.Time, insulin.ID), insulin)
+	if err != nil {
+		return fmt.Errorf("unable to update insulin point %s: %w", insulin.ID, err)
+	}
+	return nil
+}
+
+func (c *BoltClient) DeleteInsulinPoint(id string) error {
+	if err := c.replace(insulinKind, id, nil, nil); err != nil {
+		return fmt.Errorf("unable to delete insulin point %s: %w", id, err)
+	}
+	return nil
+}
+
+func (c *BoltClient) WriteCarbPoint(carb CarbPoint) error {
+	if carb.ID == "" {
+		carb.ID = newID()
+	}
+	if err := c.put(carbKind, idKey(carb.Time, carb.ID), carb); err != nil {
+		return fmt.Errorf("unable to write carb point to bolt: %w", err)
+	}
+	c.logger.Debug("wrote carb point", zap.Time("ts", carb.Time))
+	return nil
+}
+
+func (c *BoltClient) ReadCarbPoints(startTs, endTs int, opts ...ReadOption) ([]CarbPoint, error) {
+	carbs := make([]CarbPoint, 0)
+	err := c.scan(carbKind, startTs, endTs, func(v []byte) error {
+		var carb CarbPoint
+		if err := json.Unmarshal(v, &carb); err != nil {
+			return err
+		}
+		carbs = append(carbs, carb)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read carb points between %d and %d: %w", startTs, endTs, err)
+	}
+	return orderAndLimit(carbs, newReadOptions(opts)), nil
+}
+
+func (c *BoltClient) ReadCarbPoint(id string) (*CarbPoint, error) {
+	var carb CarbPoint
+	if err := c.get(carbKind, id, &carb); err != nil {
+		return nil, fmt.Errorf("unable to read carb point %s: %w", id, err)
+	}
+	return &carb, nil
+}
+
+func (c *BoltClient) DeleteCarbPoints(startTs, endTs int) error {
+	return c.delete(carbKind, startTs, endTs)
+}
+
+func (c *BoltClient) UpdateCarbPoint(carb CarbPoint) error {
+	if err := c.replace(carbKind, carb.ID, idKey(carb.Time, carb.ID), carb); err != nil {
+		return fmt.Errorf("unable to update carb point %s: %w", carb.ID, err)
+	}
+	return nil
+}
+
+func (c *BoltClient) DeleteCarbPoint(id string) error {
+	if err := c.replace(carbKind, id, nil, nil); err != nil {
+		return fmt.Errorf("unable to delete carb point %s: %w", id, err)
+	}
+	return nil
+}
+
+func (c *BoltClient) WriteActivityPoint(activity ActivityPoint) error {
+	if activity.ID == "" {
+		activity.ID = newID()
+	}
+	if err := c.put(activityKind, idKey(activity.Time, activity.ID), activity); err != nil {
+		return fmt.Errorf("unable to write activity point to bolt: %w", err)
+	}
+	c.logger.Debug("wrote activity point", zap.Time("ts", activity.Time))
+	return nil
+}
+
+func (c *BoltClient) ReadActivityPoints(startTs, endTs int, opts ...ReadOption) ([]ActivityPoint, error) {
+	o := newReadOptions(opts)
+	activity := make([]ActivityPoint, 0)
+	err := c.scan(activityKind, startTs, endTs, func(v []byte) error {
+		var a ActivityPoint
+		if err := json.Unmarshal(v, &a); err != nil {
+			return err
+		}
+		if o.pointType == "" || a.Type == o.pointType {
+			activity = append(activity, a)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read activity points between %d and %d: %w", startTs, endTs, err)
+	}
+	return orderAndLimit(activity, o), nil
+}
+
+func (c *BoltClient) ReadActivityPoint(id string) (*ActivityPoint, error) {
+	var activity ActivityPoint
+	if err := c.get(activityKind, id, &activity); err != nil {
+		return nil, fmt.Errorf("unable to read activity point %s: %w", id, err)
+	}
+	return &activity, nil
+}
+
+func (c *BoltClient) DeleteActivityPoints(startTs, endTs int) error {
+	return c.delete(activityKind, startTs, endTs)
+}
+
+func (c *BoltClient) DeleteActivityPoint(id string) error {
+	if err := c.replace(activityKind, id, nil, nil); err != nil {
+		return fmt.Errorf("unable to delete activity point %s: %w", id, err)
+	}
+	return nil
+}
+
+func (c *BoltClient) WriteMeterPoint(meter MeterPoint) error {
+	if meter.ID == "" {
+		meter.ID = newID()
+	}
+	if err := c.put(meterKind, idKey(meter.Time, meter.ID), meter); err != nil {
+		return fmt.Errorf("unable to write meter point to bolt: %w", err)
+	}
+	c.logger.Debug("wrote meter point", zap.Time("ts", meter.Time))
+	return nil
+}
+
+func (c *BoltClient) ReadMeterPoints(startTs, endTs int, opts ...ReadOption) ([]MeterPoint, error) {
+	meter, err := scanAll[MeterPoint](c, meterKind, startTs, endTs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read meter points between %d and %d: %w", startTs, endTs, err)
+	}
+	return orderAndLimit(meter, newReadOptions(opts)), nil
+}
+
+func (c *BoltClient) WriteKetonePoint(ketone KetonePoint) error {
+	if ketone.ID == "" {
+		ketone.ID = newID()
+	}
+	if err := c.put(ketoneKind, idKey(ketone.Time, ketone.ID), ketone); err != nil {
+		return fmt.Errorf("unable to write ketone point to bolt: %w", err)
+	}
+	c.logger.Debug("wrote ketone point", zap.Time("ts", ketone.Time))
+	return nil
+}
+
+func (c *BoltClient) ReadKetonePoints(startTs, endTs int, opts ...ReadOption) ([]KetonePoint, error) {
+	ketones, err := scanAll[KetonePoint](c, ketoneKind, startTs, endTs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ketone points between %d and %d: %w", startTs, endTs, err)
+	}
+	return orderAndLimit(ketones, newReadOptions(opts)), nil
+}
+
+func (c *BoltClient) WriteCalibrationPoint(calibration CalibrationPoint) error {
+	if calibration.ID == "" {
+		calibration.ID = newID()
+	}
+	if err := c.put(calibrationKind, idKey(calibration.Time, calibration.ID), calibration); err != nil {
+		return fmt.Errorf("unable to write calibration point to bolt: %w", err)
+	}
+	c.logger.Debug("wrote calibration point", zap.Time("ts", calibration.Time))
+	return nil
+}
+
+func (c *BoltClient) ReadCalibrationPoints(startTs, endTs int, opts ...ReadOption) ([]CalibrationPoint, error) {
+	calibrations, err := scanAll[CalibrationPoint](c, calibrationKind, startTs, endTs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read calibration points between %d and %d: %w", startTs, endTs, err)
+	}
+	return orderAndLimit(calibrations, newReadOptions(opts)), nil
+}
+
+func (c *BoltClient) WriteEventPoint(event EventPoint) error {
+	if err := c.put(eventKind, timeKey(event.Time), event); err != nil {
+		return fmt.Errorf("unable to write event point to bolt: %w", err)
+	}
+	c.logger.Debug("wrote event point", zap.Time("ts", event.Time))
+	return nil
+}
+
+func (c *BoltClient) ReadEventPoints(startTs, endTs int, opts ...ReadOption) ([]EventPoint, error) {
+	o := newReadOptions(opts)
+	events := make([]EventPoint, 0)
+	err := c.scan(eventKind, startTs, endTs, func(v []byte) error {
+		var event EventPoint
+		if err := json.Unmarshal(v, &event); err != nil {
+			return err
+		}
+		if o.event == "" || event.Event == o.event {
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read event points between %d and %d: %w", startTs, endTs, err)
+	}
+	return orderAndLimit(events, o), nil
+}
+
+func (c *BoltClient) WriteAuditPoint(audit AuditPoint) error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b, err := c.bucket(tx, auditKind)
+		if err != nil {
+			return err
+		}
+		// Several changes can happen at once, so keep them in order.
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := binary.BigEndian.AppendUint64(timeKey(audit.Time), seq)
+		return put(b, key, audit)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write audit point to bolt: %w", err)
+	}
+	c.logger.Debug("wrote audit point", zap.Time("ts", audit.Time))
+	return nil
+}
+
+func (c *BoltClient) ReadAuditPoints(startTs, endTs int, opts ...ReadOption) ([]AuditPoint, error) {
+	audit := make([]AuditPoint, 0)
+	err := c.scan(auditKind, startTs, endTs, func(v []byte) error {
+		var ap AuditPoint
+		if err := json.Unmarshal(v, &ap); err != nil {
+			return err
+		}
+		audit = append(audit, ap)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read audit points between %d and %d: %w", startTs, endTs, err)
+	}
+	return orderAndLimit(audit, newReadOptions(opts)), nil
+}
+
+// bucket returns the bucket for this subject and kind, creating it if needed.
+func (c *BoltClient) bucket(tx *bolt.Tx, kind string) (*bolt.Bucket, error) {
+	// Bucket names cannot be empty, so prefix the subject.
+	sb, err := tx.CreateBucketIfNotExists([]byte("subject:" + c.subject))
+	if err != nil {
+		return nil, err
+	}
+	return sb.CreateBucketIfNotExists([]byte(kind))
+}
+
+// readBucket returns the bucket for this subject and kind, or nil if
+// nothing has been written to it yet.
+func (c *BoltClient) readBucket(tx *bolt.Tx, kind string) *bolt.Bucket {
+	sb := tx.Bucket([]byte("subject:" + c.subject))
+	if sb == nil {
+		return nil
+	}
+	return sb.Bucket([]byte(kind))
+}
+
+func (c *BoltClient) put(kind string, key []byte, value any) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b, err := c.bucket(tx, kind)
+		if err != nil {
+			return err
+		}
+		return put(b, key, value)
+	})
+}
+
+// scan calls fn with every value in [startTs, endTs).
+func (c *BoltClient) scan(kind string, startTs, endTs int, fn func(v []byte) error) error {
+	start, end := timeKey(time.Unix(int64(startTs), 0)), timeKey(time.Unix(int64(endTs), 0))
+	return c.db.View(func(tx *bolt.Tx) error {
+		b := c.readBucket(tx, kind)
+		if b == nil {
+			return nil
+		}
+		cur := b.Cursor()
+		for k, v := cur.Seek(start); k != nil && string(k[:8]) < string(end); k, v = cur.Next() {
+			if err := fn(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scanAll decodes every point of a kind in [startTs, endTs).
+func scanAll[T any](c *BoltClient, kind string, startTs, endTs int) ([]T, error) {
+	points := make([]T, 0)
+	err := c.scan(kind, startTs, endTs, func(v []byte) error {
+		var p T
+		if err := json.Unmarshal(v, &p); err != nil {
+			return err
+		}
+		points = append(points, p)
+		return nil
+	})
+	return points, err
+}
+
+// delete removes everything in [startTs, endTs], same as the InfluxDB delete API.
+func (c *BoltClient) delete(kind string, startTs, endTs int) error {
+	start, end := timeKey(time.Unix(int64(startTs), 0)), timeKey(time.Unix(int64(endTs)+1, 0))
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := c.readBucket(tx, kind)
+		if b == nil {
+			return nil
+		}
+		// Deleting while iterating skips keys, so collect them first.
+		var keys [][]byte
+		cur := b.Cursor()
+		for k, _ := cur.Seek(start); k != nil && string(k[:8]) < string(end); k, _ = cur.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete %s points between %d and %d: %w", kind, startTs, endTs, err)
+	}
+	return nil
+}
+
+// get unmarshals the point with the given ID into v.
+func (c *BoltClient) get(kind, id string, v any) error {
+	return c.db.View(func(tx *bolt.Tx) error {
+		b := c.readBucket(tx, kind)
+		if b == nil || id == "" {
+			return ErrNotFound
+		}
+		_, value := findID(b, id)
+		if value == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(value, v)
+	})
+}
+
+// findID returns the key and value of the point with the given ID.
+// Keys are ordered by time, so this has to look at all of them.
+func findID(b *bolt.Bucket, id string) ([]byte, []byte) {
+	cur := b.Cursor()
+	for k, v := cur.First(); k != nil; k, v = cur.Next() {
+		if string(k[8:]) == id {
+			return k, v
+		}
+	}
+	return nil, nil
+}
+
+// replace deletes the point with the given ID, and puts value at key in
+// its place. Nothing is put if value is nil.
+func (c *BoltClient) replace(kind, id string, key []byte, value any) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := c.readBucket(tx, kind)
+		if b == nil || id == "" {
+			return ErrNotFound
+		}
+
+		k, _ := findID(b, id)
+		if k == nil {
+			return ErrNotFound
+		}
+		// Keys are only valid until the bucket is changed.
+		found := append([]byte{}, k...)
+
+		if err := b.Delete(found); err != nil {
+			return err
+		}
+		if value == nil {
+			return nil
+		}
+		return put(b, key, value)
+	})
+}
+
+func put(b *bolt.Bucket, key []byte, value any) error {
+	v, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, v)
+}
+
+func idKey(t time.Time, id string) []byte {
+	return append(timeKey(t), []byte(id)...)
+}
+
+// timeKey encodes t so that keys sort in time order. Times before 1970
+// are not supported.
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
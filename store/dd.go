@@ -12,17 +12,26 @@ import (
 type DDClient struct {
 	apiClient *datadog.APIClient
 	iv3cfg    *config.Iv3Config
+	subject   string
 }
 
-func NewDDClient(cfg *config.Iv3Config) *DDClient {
+func NewDDClient(cfg *config.Iv3Config, subject string) *DDClient {
 	configuration := datadog.NewConfiguration()
 	apiClient := datadog.NewAPIClient(configuration)
 	return &DDClient{
 		apiClient: apiClient,
 		iv3cfg:    cfg,
+		subject:   subject,
 	}
 }
 
+func (dd *DDClient) Name() string {
+	if dd.subject == "" {
+		return "datadog"
+	}
+	return "datadog_" + dd.subject
+}
+
 func (dd *DDClient) WriteGlucosePoints(glucose []GlucosePoint) error {
 	body := datadogV2.MetricPayload{
 		Series: []datadogV2.MetricSeries{
@@ -47,6 +56,12 @@ func (dd *DDClient) WriteGlucosePoints(glucose []GlucosePoint) error {
 		},
 	}
 
+	if dd.subject != "" {
+		for i := range body.Series {
+			body.Series[i].Tags = append(body.Series[i].Tags, "subject:"+dd.subject)
+		}
+	}
+
 	for _, point := range glucose {
 		if point.Value > float64(dd.iv3cfg.HighThreshold) {
 			body.Series[0].Points = append(body.Series[0].Points, datadogV2.MetricPoint{
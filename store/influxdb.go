@@ -2,29 +2,50 @@ package store
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/query"
 	"github.com/influxdata/influxdb-client-go/v2/api/write"
 	"github.com/influxdata/influxdb-client-go/v2/domain"
 	"go.uber.org/zap"
 )
 
 const (
-	Org           = "iv3"
-	GlucoseBucket = "iv3_glucose"
-	InsulinBucket = "iv3_insulin"
-	CarbBucket    = "iv3_carb"
-	EventsBucket  = "iv3_events"
+	Org               = "iv3"
+	GlucoseBucket     = "iv3_glucose"
+	InsulinBucket     = "iv3_insulin"
+	CarbBucket        = "iv3_carb"
+	EventsBucket      = "iv3_events"
+	ActivityBucket    = "iv3_activity"
+	MeterBucket       = "iv3_meter"
+	KetoneBucket      = "iv3_ketone"
+	CalibrationBucket = "iv3_calibration"
+	AuditBucket       = "iv3_audit"
+
+	// writeBatchSize is the most points sent in a single write request.
+	// InfluxDB recommends batches of around 5000 lines.
+	writeBatchSize = 5000
 )
 
+// maxDeleteTime is after any point we would have written.
+var maxDeleteTime = time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+
 type InfluxDBClient struct {
 	client influxdb2.Client
 	logger *zap.Logger
 
 	token string
 	url   string
+
+	// subject scopes all reads and writes to one monitored person.
+	// Points for the default (unnamed) subject have no subject tag.
+	subject string
 }
 
 func NewInfluxDB(token, url string, logger *zap.Logger) (*InfluxDBClient, error) {
@@ -58,7 +79,8 @@ func NewInfluxDB(token, url string, logger *zap.Logger) (*InfluxDBClient, error)
 		}
 	}
 
-	var bucketNames = []string{GlucoseBucket, InsulinBucket, CarbBucket, EventsBucket}
+	var bucketNames = []string{GlucoseBucket, InsulinBucket, CarbBucket, EventsBucket, ActivityBucket,
+		MeterBucket, KetoneBucket, CalibrationBucket, AuditBucket}
 	for _, bucketName := range bucketNames {
 		_, err := bucketsAPI.FindBucketByName(ctx, bucketName)
 		if err == nil {
@@ -73,70 +95,292 @@ func NewInfluxDB(token, url string, logger *zap.Logger) (*InfluxDBClient, error)
 	return client, nil
 }
 
+// ForSubject returns a client that only reads and writes points
+// for the given subject. The underlying connection is shared.
+func (c *InfluxDBClient) ForSubject(subject string) Store {
+	scoped := *c
+	scoped.subject = subject
+	scoped.logger = c.logger.With(zap.String("subject", subject))
+	return &scoped
+}
+
+func (c *InfluxDBClient) Name() string {
+	if c.subject == "" {
+		return "influxdb"
+	}
+	return "influxdb_" + c.subject
+}
+
+func (c *InfluxDBClient) tags(tags map[string]string) map[string]string {
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+	if c.subject != "" {
+		tags["subject"] = c.subject
+	}
+	return tags
+}
+
+// fluxParams are passed along with a query, and referenced as params.name
+// in Flux. Queries are only ever put together from constant fragments,
+// every value goes through the params.
+type fluxParams map[string]any
+
+func (c *InfluxDBClient) query(flux string, params fluxParams) (*api.QueryTableResult, error) {
+	if c.subject != "" {
+		params["subject"] = c.subject
+	}
+	return c.client.QueryAPI(Org).QueryWithParams(context.Background(), flux, params)
+}
+
+// rangeParams are the params used by rangeFlux.
+func rangeParams(bucket string, startTs, endTs int) fluxParams {
+	return fluxParams{
+		"bucket": bucket,
+		"start":  time.Unix(int64(startTs), 0),
+		"stop":   time.Unix(int64(endTs), 0),
+	}
+}
+
+const rangeFlux = `
+        from(bucket: params.bucket)
+            |> range(start: time(v: params.start), stop: time(v: params.stop))`
+
+// subjectFilter is the Flux predicate matching this client's points.
+func (c *InfluxDBClient) subjectFilter() string {
+	if c.subject == "" {
+		return `not exists r["subject"]`
+	}
+	return `r["subject"] == params.subject`
+}
+
+// sortFlux merges the tables into one, so that points of different
+// series are ordered together, and applies the order and limit.
+func sortFlux(o readOptions, params fluxParams) string {
+	params["desc"] = o.desc
+	flux := `
+            |> group()
+            |> sort(columns: ["_time"], desc: params.desc)`
+	if o.limit > 0 {
+		params["limit"] = o.limit
+		flux += `
+            |> limit(n: params.limit)`
+	}
+	return flux
+}
+
+// deletePredicate matches this client's points, and the given predicates.
+// Values must be validated before being put into a predicate.
+func (c *InfluxDBClient) deletePredicate(predicates ...string) string {
+	if c.subject != "" {
+		predicates = append(predicates, fmt.Sprintf(`subject="%s"`, c.subject))
+	}
+	return strings.Join(predicates, " AND ")
+}
+
+func (c *InfluxDBClient) writePoint(bucket string, point *write.Point) error {
+	writeAPI := c.client.WriteAPIBlocking(Org, bucket)
+	err := writeAPI.WritePoint(context.Background(), point)
+	if err != nil {
+		return fmt.Errorf("unable to write %s point to InfluxDB: %w", point.Name(), err)
+	}
+	c.logger.Debug("wrote "+point.Name()+" point", zap.Time("ts", point.Time()), zap.Any("fields", point.FieldList()))
+	return nil
+}
+
+// findByID returns the value record of the point with the given ID.
+func (c *InfluxDBClient) findByID(bucket, id string) (*query.FluxRecord, error) {
+	if id == "" {
+		return nil, ErrNotFound
+	}
+	params := fluxParams{"bucket": bucket, "id": id}
+	fluxQuery := `
+        from(bucket: params.bucket)
+            |> range(start: 0)
+            |> filter(fn: (r) => ` + c.subjectFilter() + `)
+            |> filter(fn: (r) => r["id"] == params.id and r["_field"] == "value")
+            |> yield()
+    `
+
+	result, err := c.query(fluxQuery, params)
+	if err != nil {
+		return nil, err
+	}
+	if result.Next() {
+		return result.Record(), nil
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+	return nil, ErrNotFound
+}
+
+// deleteByID deletes every point with the given ID, whenever it is.
+func (c *InfluxDBClient) deleteByID(bucket, id string) error {
+	// IDs are put into the predicate as is, so make sure it is one.
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrNotFound
+	}
+	return c.client.DeleteAPI().DeleteWithName(
+		context.Background(),
+		Org,
+		bucket,
+		time.Unix(0, 0),
+		maxDeleteTime,
+		c.deletePredicate(fmt.Sprintf(`id="%s"`, id)),
+	)
+}
+
+// WriteGlucosePoints writes the points in batches, so refreshes and bulk
+// imports only take a few requests.
 func (c *InfluxDBClient) WriteGlucosePoints(glucose []GlucosePoint) error {
 	writeAPI := c.client.WriteAPIBlocking(Org, GlucoseBucket)
-	for _, gp := range glucose {
-		fields := map[string]any{
-			"value": gp.Value,
-			"trend": gp.Trend,
+	for len(glucose) > 0 {
+		start := time.Now()
+		n := min(len(glucose), writeBatchSize)
+		points := make([]*write.Point, n)
+		for i, gp := range glucose[:n] {
+			fields := map[string]any{
+				"value":      gp.Value,
+				"trend":      gp.Trend.String(),
+				"utc_offset": gp.UTCOffset,
+			}
+			points[i] = write.NewPoint("glucose", c.tags(nil), fields, gp.Time)
 		}
-		point := write.NewPoint("glucose", map[string]string{}, fields, gp.Time)
 
-		err := writeAPI.WritePoint(context.Background(), point)
+		err := writeAPI.WritePoint(context.Background(), points...)
 		if err != nil {
-			return fmt.Errorf("unable to write glucose point to InfluxDB: %w", err)
+			return fmt.Errorf("unable to write glucose points to InfluxDB: %w", err)
 		}
-		c.logger.Debug("wrote glucose point", zap.Time("ts", point.Time()), zap.Any("fields", fields))
+		c.logger.Debug("wrote glucose points",
+			zap.Time("first", points[0].Time()),
+			zap.Time("last", points[n-1].Time()),
+			zap.Int("count", n),
+			zap.Duration("took", time.Since(start)),
+		)
+		glucose = glucose[n:]
 	}
 	return nil
 }
 
-func (c *InfluxDBClient) ReadGlucosePoints(startTs, endTs int) ([]GlucosePoint, error) {
-	queryAPI := c.client.QueryAPI(Org)
+func (c *InfluxDBClient) ReadGlucosePoints(startTs, endTs int, opts ...ReadOption) ([]GlucosePoint, error) {
+	params := rangeParams(GlucoseBucket, startTs, endTs)
 	// Currently, this only grabs all the values, and not the trends.
 	// I am thinking if that is needed, we will need to remove the filter.
-	fluxQuery := fmt.Sprintf(`
-        data = from(bucket: "%s")
-            |> range(start: %d, stop: %d)
-            |> filter(fn: (r) => r["_field"] == "value" or r["_field"] == "trend")
+	fluxQuery := rangeFlux + `
+            |> filter(fn: (r) => ` + c.subjectFilter() + `)
+            |> filter(fn: (r) => r["_field"] == "value" or r["_field"] == "trend" or r["_field"] == "utc_offset")
 			|> group(columns: ["_time", "_field"])
-			|> pivot(rowKey:["_time"], columnKey: ["_field"], valueColumn: "_value")
+			|> pivot(rowKey:["_time"], columnKey: ["_field"], valueColumn: "_value")` +
+		sortFlux(newReadOptions(opts), params) + `
             |> yield()
-    `, GlucoseBucket, startTs, endTs)
+    `
 
-	result, err := queryAPI.Query(context.Background(), fluxQuery)
+	result, err := c.query(fluxQuery, params)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read glucose points between %d and %d: %w", startTs, endTs, err)
 	}
 
 	glucose := make([]GlucosePoint, 0)
 	for result.Next() {
-		glucose = append(glucose, GlucosePoint{
-			Value: result.Record().ValueByKey("value").(float64),
-			Trend: result.Record().ValueByKey("trend").(string),
-			Time:  result.Record().Time(),
-		})
+		glucose = append(glucose, glucoseFromRecord(result.Record()))
 	}
 	return glucose, nil
 }
 
+func glucoseFromRecord(record *query.FluxRecord) GlucosePoint {
+	gp := GlucosePoint{
+		Value: record.ValueByKey("value").(float64),
+		Trend: ParseTrend(record.ValueByKey("trend").(string)),
+		Time:  record.Time(),
+	}
+	// Older points were written without an offset.
+	if offset, ok := record.ValueByKey("utc_offset").(int64); ok {
+		gp.UTCOffset = int(offset)
+	}
+	return gp
+}
+
+// ReadLatestGlucosePoint returns the newest persisted glucose point,
+// or nil if there are none.
+func (c *InfluxDBClient) ReadLatestGlucosePoint() (*GlucosePoint, error) {
+	params := fluxParams{"bucket": GlucoseBucket}
+	fluxQuery := `
+        from(bucket: params.bucket)
+            |> range(start: 0)
+            |> filter(fn: (r) => ` + c.subjectFilter() + `)
+            |> filter(fn: (r) => r["_field"] == "value" or r["_field"] == "trend" or r["_field"] == "utc_offset")
+            |> last()
+			|> group(columns: ["_time", "_field"])
+			|> pivot(rowKey:["_time"], columnKey: ["_field"], valueColumn: "_value")
+            |> yield()
+    `
+
+	result, err := c.query(fluxQuery, params)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read latest glucose point: %w", err)
+	}
+
+	var latest *GlucosePoint
+	for result.Next() {
+		gp := glucoseFromRecord(result.Record())
+		latest = &gp
+	}
+	return latest, nil
+}
+
 func (c *InfluxDBClient) WriteInsulinPoint(insulin InsulinPoint) error {
-	writeAPI := c.client.WriteAPIBlocking(Org, InsulinBucket)
+	if insulin.ID == "" {
+		insulin.ID = newID()
+	}
+	return c.writePoint(InsulinBucket, c.insulinPoint(insulin))
+}
+
+func (c *InfluxDBClient) insulinPoint(insulin InsulinPoint) *write.Point {
 	fields := map[string]any{
 		"value": insulin.Value,
 		"type":  insulin.Type,
 	}
-	tags := map[string]string{
+	tags := c.tags(map[string]string{
 		"type": insulin.Type,
+		"id":   insulin.ID,
+	})
+	return write.NewPoint("insulin", tags, fields, insulin.Time)
+}
+
+func (c *InfluxDBClient) ReadInsulinPoint(id string) (*InsulinPoint, error) {
+	record, err := c.findByID(InsulinBucket, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read insulin point %s: %w", id, err)
 	}
-	point := write.NewPoint("insulin", tags, fields, insulin.Time)
+	return &InsulinPoint{
+		ID:    id,
+		Value: int(record.Value().(int64)),
+		Type:  record.ValueByKey("type").(string),
+		Time:  record.Time(),
+	}, nil
+}
 
-	err := writeAPI.WritePoint(context.Background(), point)
+// UpdateInsulinPoint overwrites the point if only the value changed,
+// otherwise the old point is deleted first, since it is a different series.
+func (c *InfluxDBClient) UpdateInsulinPoint(insulin InsulinPoint) error {
+	record, err := c.findByID(InsulinBucket, insulin.ID)
 	if err != nil {
-		return fmt.Errorf("unable to write insulin point to InfluxDB: %w", err)
+		return fmt.Errorf("unable to find insulin point %s: %w", insulin.ID, err)
 	}
-	c.logger.Debug("wrote insulin point", zap.Time("ts", point.Time()), zap.Any("fields", fields))
-	return nil
+	if !record.Time().Equal(insulin.Time) || record.ValueByKey("type") != insulin.Type {
+		if err = c.deleteByID(InsulinBucket, insulin.ID); err != nil {
+			return fmt.Errorf("unable to delete old insulin point %s: %w", insulin.ID, err)
+		}
+	}
+	return c.writePoint(InsulinBucket, c.insulinPoint(insulin))
+}
+
+func (c *InfluxDBClient) DeleteInsulinPoint(id string) error {
+	if _, err := c.findByID(InsulinBucket, id); err != nil {
+		return fmt.Errorf("unable to find insulin point %s: %w", id, err)
+	}
+	return c.deleteByID(InsulinBucket, id)
 }
 
 func (c *InfluxDBClient) DeleteInsulinPoints(startTs, endTs int) error {
@@ -147,27 +391,36 @@ func (c *InfluxDBClient) DeleteInsulinPoints(startTs, endTs int) error {
 		InsulinBucket,
 		time.Unix(int64(startTs), 0),
 		time.Unix(int64(endTs), 0),
-		"",
+		c.deletePredicate(),
 	)
 }
 
-func (c *InfluxDBClient) ReadInsulinPoints(startTs, endTs int) ([]InsulinPoint, error) {
-	queryAPI := c.client.QueryAPI(Org)
-	fluxQuery := fmt.Sprintf(`
-        data = from(bucket: "%s")
-            |> range(start: %d, stop: %d)
-            |> filter(fn: (r) => r["_field"] == "value")
+func (c *InfluxDBClient) ReadInsulinPoints(startTs, endTs int, opts ...ReadOption) ([]InsulinPoint, error) {
+	o := newReadOptions(opts)
+	params := rangeParams(InsulinBucket, startTs, endTs)
+	fluxQuery := rangeFlux + `
+            |> filter(fn: (r) => ` + c.subjectFilter() + `)
+            |> filter(fn: (r) => r["_field"] == "value")`
+	if o.pointType != "" {
+		params["type"] = o.pointType
+		fluxQuery += `
+            |> filter(fn: (r) => r["type"] == params.type)`
+	}
+	fluxQuery += sortFlux(o, params) + `
             |> yield()
-    `, InsulinBucket, startTs, endTs)
+    `
 
-	result, err := queryAPI.Query(context.Background(), fluxQuery)
+	result, err := c.query(fluxQuery, params)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read insulin points between %d and %d: %w", startTs, endTs, err)
 	}
 
 	insulin := make([]InsulinPoint, 0)
 	for result.Next() {
+		// Older points were written without an ID.
+		id, _ := result.Record().ValueByKey("id").(string)
 		insulin = append(insulin, InsulinPoint{
+			ID:    id,
 			Value: int(result.Record().Value().(int64)),
 			Type:  result.Record().ValueByKey("type").(string),
 			Time:  result.Record().Time(),
@@ -182,7 +435,7 @@ func (c *InfluxDBClient) WriteEventPoint(event EventPoint) error {
 		"event":   event.Event,
 		"message": event.Message,
 	}
-	point := write.NewPoint("event", map[string]string{}, fields, event.Time)
+	point := write.NewPoint("event", c.tags(nil), fields, event.Time)
 
 	err := writeAPI.WritePoint(context.Background(), point)
 	if err != nil {
@@ -192,74 +445,105 @@ func (c *InfluxDBClient) WriteEventPoint(event EventPoint) error {
 	return nil
 }
 
-func (c *InfluxDBClient) ReadEventPoints(startTs, endTs int) ([]EventPoint, error) {
-	queryAPI := c.client.QueryAPI(Org)
-	fluxQuery := fmt.Sprintf(`
-        data = from(bucket: "%s")
-            |> range(start: %d, stop: %d)
+func (c *InfluxDBClient) ReadEventPoints(startTs, endTs int, opts ...ReadOption) ([]EventPoint, error) {
+	o := newReadOptions(opts)
+	params := rangeParams(EventsBucket, startTs, endTs)
+	// Each field gets a record, so pivot them into one row per event.
+	fluxQuery := rangeFlux + `
+            |> filter(fn: (r) => ` + c.subjectFilter() + `)
+            |> pivot(rowKey:["_time"], columnKey: ["_field"], valueColumn: "_value")`
+	if o.event != "" {
+		params["event"] = o.event
+		fluxQuery += `
+            |> filter(fn: (r) => r["event"] == params.event)`
+	}
+	fluxQuery += sortFlux(o, params) + `
             |> yield()
-    `, EventsBucket, startTs, endTs)
+    `
 
-	result, err := queryAPI.Query(context.Background(), fluxQuery)
+	result, err := c.query(fluxQuery, params)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read event points between %d and %d: %w", startTs, endTs, err)
 	}
 
-	// We need to make a map, because each field gets a record.
-	events := make(map[time.Time]*EventPoint)
+	events := make([]EventPoint, 0)
 	for result.Next() {
-		ts := result.Record().Time()
-		if _, ok := events[ts]; !ok {
-			events[ts] = &EventPoint{Time: ts}
-		}
-
-		if result.Record().Field() == "event" {
-			events[ts].Event = result.Record().Value().(string)
-		}
-		if result.Record().Field() == "message" {
-			events[ts].Message = result.Record().Value().(string)
-		}
+		event := EventPoint{Time: result.Record().Time()}
+		event.Event, _ = result.Record().ValueByKey("event").(string)
+		event.Message, _ = result.Record().ValueByKey("message").(string)
+		events = append(events, event)
 	}
+	return events, nil
+}
 
-	eventsSlice := make([]EventPoint, 0)
-	for _, event := range events {
-		eventsSlice = append(eventsSlice, *event)
+func (c *InfluxDBClient) WriteCarbPoint(carb CarbPoint) error {
+	if carb.ID == "" {
+		carb.ID = newID()
 	}
-	return eventsSlice, nil
+	return c.writePoint(CarbBucket, c.carbPoint(carb))
 }
 
-func (c *InfluxDBClient) WriteCarbPoint(carb CarbPoint) error {
-	writeAPI := c.client.WriteAPIBlocking(Org, CarbBucket)
+func (c *InfluxDBClient) carbPoint(carb CarbPoint) *write.Point {
 	fields := map[string]any{
 		"value": carb.Value,
 	}
-	point := write.NewPoint("carb", map[string]string{}, fields, carb.Time)
+	tags := c.tags(map[string]string{
+		"id": carb.ID,
+	})
+	return write.NewPoint("carb", tags, fields, carb.Time)
+}
 
-	err := writeAPI.WritePoint(context.Background(), point)
+func (c *InfluxDBClient) ReadCarbPoint(id string) (*CarbPoint, error) {
+	record, err := c.findByID(CarbBucket, id)
 	if err != nil {
-		return fmt.Errorf("unable to write carb point to InfluxDB: %w", err)
+		return nil, fmt.Errorf("unable to read carb point %s: %w", id, err)
 	}
-	c.logger.Debug("wrote carb point", zap.Time("ts", point.Time()), zap.Any("fields", fields))
-	return nil
+	return &CarbPoint{
+		ID:    id,
+		Value: int(record.Value().(int64)),
+		Time:  record.Time(),
+	}, nil
+}
+
+func (c *InfluxDBClient) UpdateCarbPoint(carb CarbPoint) error {
+	record, err := c.findByID(CarbBucket, carb.ID)
+	if err != nil {
+		return fmt.Errorf("unable to find carb point %s: %w", carb.ID, err)
+	}
+	if !record.Time().Equal(carb.Time) {
+		if err = c.deleteByID(CarbBucket, carb.ID); err != nil {
+			return fmt.Errorf("unable to delete old carb point %s: %w", carb.ID, err)
+		}
+	}
+	return c.writePoint(CarbBucket, c.carbPoint(carb))
+}
+
+func (c *InfluxDBClient) DeleteCarbPoint(id string) error {
+	if _, err := c.findByID(CarbBucket, id); err != nil {
+		return fmt.Errorf("unable to find carb point %s: %w", id, err)
+	}
+	return c.deleteByID(CarbBucket, id)
 }
 
-func (c *InfluxDBClient) ReadCarbPoints(startTs, endTs int) ([]CarbPoint, error) {
-	queryAPI := c.client.QueryAPI(Org)
-	fluxQuery := fmt.Sprintf(`
-        data = from(bucket: "%s")
-            |> range(start: %d, stop: %d)
-            |> filter(fn: (r) => r["_field"] == "value")
+func (c *InfluxDBClient) ReadCarbPoints(startTs, endTs int, opts ...ReadOption) ([]CarbPoint, error) {
+	params := rangeParams(CarbBucket, startTs, endTs)
+	fluxQuery := rangeFlux + `
+            |> filter(fn: (r) => ` + c.subjectFilter() + `)
+            |> filter(fn: (r) => r["_field"] == "value")` +
+		sortFlux(newReadOptions(opts), params) + `
             |> yield()
-    `, CarbBucket, startTs, endTs)
+    `
 
-	result, err := queryAPI.Query(context.Background(), fluxQuery)
+	result, err := c.query(fluxQuery, params)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read carb points between %d and %d: %w", startTs, endTs, err)
 	}
 
 	carbs := make([]CarbPoint, 0)
 	for result.Next() {
+		id, _ := result.Record().ValueByKey("id").(string)
 		carbs = append(carbs, CarbPoint{
+			ID:    id,
 			Value: int(result.Record().Value().(int64)),
 			Time:  result.Record().Time(),
 		})
@@ -275,6 +559,246 @@ func (c *InfluxDBClient) DeleteCarbPoints(startTs, endTs int) error {
 		CarbBucket,
 		time.Unix(int64(startTs), 0),
 		time.Unix(int64(endTs), 0),
-		"",
+		c.deletePredicate(),
+	)
+}
+
+func (c *InfluxDBClient) WriteActivityPoint(activity ActivityPoint) error {
+	if activity.ID == "" {
+		activity.ID = newID()
+	}
+	fields := map[string]any{
+		"intensity": activity.Intensity,
+		"duration":  activity.Duration,
+	}
+	tags := c.tags(map[string]string{
+		"id":   activity.ID,
+		"type": activity.Type,
+	})
+	return c.writePoint(ActivityBucket, write.NewPoint("activity", tags, fields, activity.Time))
+}
+
+// readActivityPoints runs a query over the activity bucket, and returns
+// the points in the pivoted rows.
+func (c *InfluxDBClient) readActivityPoints(fluxQuery string, params fluxParams) ([]ActivityPoint, error) {
+	result, err := c.query(fluxQuery, params)
+	if err != nil {
+		return nil, err
+	}
+
+	activity := make([]ActivityPoint, 0)
+	for result.Next() {
+		record := result.Record()
+		a := ActivityPoint{Time: record.Time()}
+		a.ID, _ = record.ValueByKey("id").(string)
+		a.Type, _ = record.ValueByKey("type").(string)
+		a.Intensity, _ = record.ValueByKey("intensity").(string)
+		if duration, ok := record.ValueByKey("duration").(int64); ok {
+			a.Duration = int(duration)
+		}
+		activity = append(activity, a)
+	}
+	return activity, result.Err()
+}
+
+func (c *InfluxDBClient) ReadActivityPoints(startTs, endTs int, opts ...ReadOption) ([]ActivityPoint, error) {
+	o := newReadOptions(opts)
+	params := rangeParams(ActivityBucket, startTs, endTs)
+	fluxQuery := rangeFlux + `
+            |> filter(fn: (r) => ` + c.subjectFilter() + `)`
+	if o.pointType != "" {
+		params["type"] = o.pointType
+		fluxQuery += `
+            |> filter(fn: (r) => r["type"] == params.type)`
+	}
+	fluxQuery += `
+            |> pivot(rowKey:["_time"], columnKey: ["_field"], valueColumn: "_value")` +
+		sortFlux(o, params) + `
+            |> yield()
+    `
+
+	activity, err := c.readActivityPoints(fluxQuery, params)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read activity points between %d and %d: %w", startTs, endTs, err)
+	}
+	return activity, nil
+}
+
+func (c *InfluxDBClient) ReadActivityPoint(id string) (*ActivityPoint, error) {
+	if id == "" {
+		return nil, fmt.Errorf("unable to read activity point %s: %w", id, ErrNotFound)
+	}
+	params := fluxParams{"bucket": ActivityBucket, "id": id}
+	fluxQuery := `
+        from(bucket: params.bucket)
+            |> range(start: 0)
+            |> filter(fn: (r) => ` + c.subjectFilter() + `)
+            |> filter(fn: (r) => r["id"] == params.id)
+            |> pivot(rowKey:["_time"], columnKey: ["_field"], valueColumn: "_value")
+            |> yield()
+    `
+
+	activity, err := c.readActivityPoints(fluxQuery, params)
+	if err == nil && len(activity) == 0 {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read activity point %s: %w", id, err)
+	}
+	return &activity[0], nil
+}
+
+func (c *InfluxDBClient) DeleteActivityPoints(startTs, endTs int) error {
+	deleteAPI := c.client.DeleteAPI()
+	return deleteAPI.DeleteWithName(
+		context.Background(),
+		Org,
+		ActivityBucket,
+		time.Unix(int64(startTs), 0),
+		time.Unix(int64(endTs), 0),
+		c.deletePredicate(),
 	)
 }
+
+func (c *InfluxDBClient) DeleteActivityPoint(id string) error {
+	if _, err := c.ReadActivityPoint(id); err != nil {
+		return err
+	}
+	return c.deleteByID(ActivityBucket, id)
+}
+
+// writeReading writes a single valued point with an ID, e.g. a meter reading.
+func (c *InfluxDBClient) writeReading(bucket, measurement, id string, value float64, ts time.Time) error {
+	fields := map[string]any{
+		"value": value,
+	}
+	tags := c.tags(map[string]string{
+		"id": id,
+	})
+	return c.writePoint(bucket, write.NewPoint(measurement, tags, fields, ts))
+}
+
+// readReadings reads the points written by writeReading, and calls fn
+// for each of them in order.
+func (c *InfluxDBClient) readReadings(bucket string, startTs, endTs int, opts []ReadOption,
+	fn func(id string, value float64, ts time.Time)) error {
+	params := rangeParams(bucket, startTs, endTs)
+	fluxQuery := rangeFlux + `
+            |> filter(fn: (r) => ` + c.subjectFilter() + `)
+            |> filter(fn: (r) => r["_field"] == "value")` +
+		sortFlux(newReadOptions(opts), params) + `
+            |> yield()
+    `
+
+	result, err := c.query(fluxQuery, params)
+	if err != nil {
+		return err
+	}
+	for result.Next() {
+		id, _ := result.Record().ValueByKey("id").(string)
+		value, _ := result.Record().Value().(float64)
+		fn(id, value, result.Record().Time())
+	}
+	return result.Err()
+}
+
+func (c *InfluxDBClient) WriteMeterPoint(meter MeterPoint) error {
+	if meter.ID == "" {
+		meter.ID = newID()
+	}
+	return c.writeReading(MeterBucket, "meter", meter.ID, meter.Value, meter.Time)
+}
+
+func (c *InfluxDBClient) ReadMeterPoints(startTs, endTs int, opts ...ReadOption) ([]MeterPoint, error) {
+	meter := make([]MeterPoint, 0)
+	err := c.readReadings(MeterBucket, startTs, endTs, opts, func(id string, value float64, ts time.Time) {
+		meter = append(meter, MeterPoint{ID: id, Value: value, Time: ts})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read meter points between %d and %d: %w", startTs, endTs, err)
+	}
+	return meter, nil
+}
+
+func (c *InfluxDBClient) WriteKetonePoint(ketone KetonePoint) error {
+	if ketone.ID == "" {
+		ketone.ID = newID()
+	}
+	return c.writeReading(KetoneBucket, "ketone", ketone.ID, ketone.Value, ketone.Time)
+}
+
+func (c *InfluxDBClient) ReadKetonePoints(startTs, endTs int, opts ...ReadOption) ([]KetonePoint, error) {
+	ketones := make([]KetonePoint, 0)
+	err := c.readReadings(KetoneBucket, startTs, endTs, opts, func(id string, value float64, ts time.Time) {
+		ketones = append(ketones, KetonePoint{ID: id, Value: value, Time: ts})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ketone points between %d and %d: %w", startTs, endTs, err)
+	}
+	return ketones, nil
+}
+
+func (c *InfluxDBClient) WriteCalibrationPoint(calibration CalibrationPoint) error {
+	if calibration.ID == "" {
+		calibration.ID = newID()
+	}
+	return c.writeReading(CalibrationBucket, "calibration", calibration.ID, calibration.Value, calibration.Time)
+}
+
+func (c *InfluxDBClient) ReadCalibrationPoints(startTs, endTs int, opts ...ReadOption) ([]CalibrationPoint, error) {
+	calibrations := make([]CalibrationPoint, 0)
+	err := c.readReadings(CalibrationBucket, startTs, endTs, opts, func(id string, value float64, ts time.Time) {
+		calibrations = append(calibrations, CalibrationPoint{ID: id, Value: value, Time: ts})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read calibration points between %d and %d: %w", startTs, endTs, err)
+	}
+	return calibrations, nil
+}
+
+func (c *InfluxDBClient) WriteAuditPoint(audit AuditPoint) error {
+	fields := map[string]any{
+		"action": audit.Action,
+		"kind":   audit.Kind,
+		"id":     audit.ID,
+		"actor":  audit.Actor,
+		"client": audit.Client,
+		"before": string(audit.Before),
+		"after":  string(audit.After),
+	}
+	return c.writePoint(AuditBucket, write.NewPoint("audit", c.tags(nil), fields, audit.Time))
+}
+
+func (c *InfluxDBClient) ReadAuditPoints(startTs, endTs int, opts ...ReadOption) ([]AuditPoint, error) {
+	params := rangeParams(AuditBucket, startTs, endTs)
+	fluxQuery := rangeFlux + `
+            |> filter(fn: (r) => ` + c.subjectFilter() + `)
+            |> pivot(rowKey:["_time"], columnKey: ["_field"], valueColumn: "_value")` +
+		sortFlux(newReadOptions(opts), params) + `
+            |> yield()
+    `
+
+	result, err := c.query(fluxQuery, params)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read audit points between %d and %d: %w", startTs, endTs, err)
+	}
+
+	audit := make([]AuditPoint, 0)
+	for result.Next() {
+		record := result.Record()
+		ap := AuditPoint{Time: record.Time()}
+		ap.Action, _ = record.ValueByKey("action").(string)
+		ap.Kind, _ = record.ValueByKey("kind").(string)
+		ap.ID, _ = record.ValueByKey("id").(string)
+		ap.Actor, _ = record.ValueByKey("actor").(string)
+		ap.Client, _ = record.ValueByKey("client").(string)
+		if before, _ := record.ValueByKey("before").(string); before != "" {
+			ap.Before = json.RawMessage(before)
+		}
+		if after, _ := record.ValueByKey("after").(string); after != "" {
+			ap.After = json.RawMessage(after)
+		}
+		audit = append(audit, ap)
+	}
+	return audit, nil
+}
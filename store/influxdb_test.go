@@ -0,0 +1,94 @@
+package store
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"go.uber.org/zap"
+)
+
+// fakeInfluxDB accepts writes, and counts the requests and lines.
+type fakeInfluxDB struct {
+	requests atomic.Int64
+	lines    atomic.Int64
+}
+
+func (f *fakeInfluxDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v2/write" {
+		http.NotFound(w, r)
+		return
+	}
+	f.requests.Add(1)
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		f.lines.Add(1)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newFakeInfluxDB(t testing.TB) (*InfluxDBClient, *fakeInfluxDB) {
+	fake := &fakeInfluxDB{}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	client := influxdb2.NewClient(srv.URL, "token")
+	t.Cleanup(client.Close)
+	return &InfluxDBClient{client: client, logger: zap.NewNop()}, fake
+}
+
+func glucoseSeries(n int) []GlucosePoint {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	glucose := make([]GlucosePoint, n)
+	for i := range glucose {
+		glucose[i] = GlucosePoint{
+			Value: 100 + float64(i%50),
+			Trend: TrendFlat,
+			Time:  start.Add(time.Duration(i) * 5 * time.Minute),
+		}
+	}
+	return glucose
+}
+
+func TestWriteGlucosePointsBatches(t *testing.T) {
+	tests := []struct {
+		points   int
+		requests int64
+	}{
+		{points: 1, requests: 1},
+		{points: 288, requests: 1},
+		{points: writeBatchSize, requests: 1},
+		{points: 2*writeBatchSize + 1, requests: 3},
+	}
+	for _, tt := range tests {
+		c, fake := newFakeInfluxDB(t)
+		if err := c.WriteGlucosePoints(glucoseSeries(tt.points)); err != nil {
+			t.Fatal(err)
+		}
+		if got := fake.requests.Load(); got != tt.requests {
+			t.Errorf("%d points: expected %d requests, got %d", tt.points, tt.requests, got)
+		}
+		if got := fake.lines.Load(); got != int64(tt.points) {
+			t.Errorf("%d points: expected %d lines, got %d", tt.points, tt.points, got)
+		}
+	}
+}
+
+// BenchmarkWriteGlucosePoints writes 90 days of readings at a time, the
+// size of a Clarity export.
+func BenchmarkWriteGlucosePoints(b *testing.B) {
+	c, _ := newFakeInfluxDB(b)
+	glucose := glucoseSeries(90 * 288)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.WriteGlucosePoints(glucose); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N*len(glucose))/b.Elapsed().Seconds(), "points/s")
+}
@@ -0,0 +1,450 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in memory, for tests and simulations.
+// It follows the same semantics as InfluxDB: reads cover [startTs, endTs)
+// in time order, deletes cover [startTs, endTs], and a point written at
+// the same time and ID (and type, for insulin) as an existing one replaces it.
+type MemoryStore struct {
+	data    *memoryData
+	subject string
+}
+
+// memoryData is shared by all the subjects of a store.
+type memoryData struct {
+	mu       sync.RWMutex
+	subjects map[string]*memorySubject
+}
+
+type memorySubject struct {
+	glucose  []GlucosePoint
+	insulin  []InsulinPoint
+	carbs    []CarbPoint
+	events   []EventPoint
+	activity []ActivityPoint
+	meter    []MeterPoint
+	ketones  []KetonePoint
+	calib    []CalibrationPoint
+	audit    []AuditPoint
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data: &memoryData{subjects: make(map[string]*memorySubject)},
+	}
+}
+
+func (m *MemoryStore) ForSubject(subject string) Store {
+	return &MemoryStore{data: m.data, subject: subject}
+}
+
+func (m *MemoryStore) Name() string {
+	if m.subject == "" {
+		return "memory"
+	}
+	return "memory_" + m.subject
+}
+
+// peek returns this store's points without creating them, so it only
+// needs the read lock.
+func (m *MemoryStore) peek() *memorySubject {
+	if s, ok := m.data.subjects[m.subject]; ok {
+		return s
+	}
+	return &memorySubject{}
+}
+
+// sub returns this store's points, and must be called with the write lock held.
+func (m *MemoryStore) sub() *memorySubject {
+	s, ok := m.data.subjects[m.subject]
+	if !ok {
+		s = &memorySubject{}
+		m.data.subjects[m.subject] = s
+	}
+	return s
+}
+
+func (m *MemoryStore) WriteGlucosePoints(glucose []GlucosePoint) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	s := m.sub()
+	for _, gp := range glucose {
+		s.glucose = upsert(s.glucose, gp, func(p GlucosePoint) time.Time { return p.Time },
+			func(a, b GlucosePoint) bool { return true })
+	}
+	return nil
+}
+
+func (m *MemoryStore) ReadGlucosePoints(startTs, endTs int, opts ...ReadOption) ([]GlucosePoint, error) {
+	m.data.mu.RLock()
+	defer m.data.mu.RUnlock()
+	glucose := between(m.peek().glucose, startTs, endTs, func(p GlucosePoint) time.Time { return p.Time })
+	return orderAndLimit(glucose, newReadOptions(opts)), nil
+}
+
+func (m *MemoryStore) ReadLatestGlucosePoint() (*GlucosePoint, error) {
+	m.data.mu.RLock()
+	defer m.data.mu.RUnlock()
+	glucose := m.peek().glucose
+	if len(glucose) == 0 {
+		return nil, nil
+	}
+	latest := glucose[len(glucose)-1]
+	return &latest, nil
+}
+
+func (m *MemoryStore) WriteInsulinPoint(insulin InsulinPoint) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	if insulin.ID == "" {
+		insulin.ID = newID()
+	}
+	s := m.sub()
+	s.insulin = upsert(s.insulin, insulin, func(p InsulinPoint) time.Time { return p.Time },
+		func(a, b InsulinPoint) bool { return a.Type == b.Type && a.ID == b.ID })
+	return nil
+}
+
+func (m *MemoryStore) ReadInsulinPoints(startTs, endTs int, opts ...ReadOption) ([]InsulinPoint, error) {
+	m.data.mu.RLock()
+	defer m.data.mu.RUnlock()
+	o := newReadOptions(opts)
+	insulin := between(m.peek().insulin, startTs, endTs, func(p InsulinPoint) time.Time { return p.Time })
+	if o.pointType != "" {
+		insulin = keep(insulin, func(p InsulinPoint) bool { return p.Type == o.pointType })
+	}
+	return orderAndLimit(insulin, o), nil
+}
+
+func (m *MemoryStore) ReadInsulinPoint(id string) (*InsulinPoint, error) {
+	m.data.mu.RLock()
+	defer m.data.mu.RUnlock()
+	insulin := m.peek().insulin
+	i := indexOf(insulin, id, func(p InsulinPoint) string { return p.ID })
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	ins := insulin[i]
+	return &ins, nil
+}
+
+func (m *MemoryStore) DeleteInsulinPoints(startTs, endTs int) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	s := m.sub()
+	s.insulin = without(s.insulin, startTs, endTs, func(p InsulinPoint) time.Time { return p.Time })
+	return nil
+}
+
+func (m *MemoryStore) UpdateInsulinPoint(insulin InsulinPoint) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	s := m.sub()
+	i := indexOf(s.insulin, insulin.ID, func(p InsulinPoint) string { return p.ID })
+	if i < 0 {
+		return ErrNotFound
+	}
+	s.insulin = append(s.insulin[:i], s.insulin[i+1:]...)
+	s.insulin = upsert(s.insulin, insulin, func(p InsulinPoint) time.Time { return p.Time },
+		func(a, b InsulinPoint) bool { return a.Type == b.Type && a.ID == b.ID })
+	return nil
+}
+
+func (m *MemoryStore) DeleteInsulinPoint(id string) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	s := m.sub()
+	i := indexOf(s.insulin, id, func(p InsulinPoint) string { return p.ID })
+	if i < 0 {
+		return ErrNotFound
+	}
+	s.insulin = append(s.insulin[:i], s.insulin[i+1:]...)
+	return nil
+}
+
+func (m *MemoryStore) WriteCarbPoint(carb CarbPoint) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	if carb.ID == "" {
+		carb.ID = newID()
+	}
+	s := m.sub()
+	s.carbs = upsert(s.carbs, carb, func(p CarbPoint) time.Time { return p.Time },
+		func(a, b CarbPoint) bool { return a.ID == b.ID })
+	return nil
+}
+
+func (m *MemoryStore) ReadCarbPoints(startTs, endTs int, opts ...ReadOption) ([]CarbPoint, error) {
+	m.data.mu.RLock()
+	defer m.data.mu.RUnlock()
+	carbs := between(m.peek().carbs, startTs, endTs, func(p CarbPoint) time.Time { return p.Time })
+	return orderAndLimit(carbs, newReadOptions(opts)), nil
+}
+
+func (m *MemoryStore) ReadCarbPoint(id string) (*CarbPoint, error) {
+	m.data.mu.RLock()
+	defer m.data.mu.RUnlock()
+	carbs := m.peek().carbs
+	i := indexOf(carbs, id, func(p CarbPoint) string { return p.ID })
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	carb := carbs[i]
+	return &carb, nil
+}
+
+func (m *MemoryStore) DeleteCarbPoints(startTs, endTs int) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	s := m.sub()
+	s.carbs = without(s.carbs, startTs, endTs, func(p CarbPoint) time.Time { return p.Time })
+	return nil
+}
+
+func (m *MemoryStore) UpdateCarbPoint(carb CarbPoint) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	s := m.sub()
+	i := indexOf(s.carbs, carb.ID, func(p CarbPoint) string { return p.ID })
+	if i < 0 {
+		return ErrNotFound
+	}
+	s.carbs = append(s.carbs[:i], s.carbs[i+1:]...)
+	s.carbs = upsert(s.carbs, carb, func(p CarbPoint) time.Time { return p.Time },
+		func(a, b CarbPoint) bool { return a.ID == b.ID })
+	return nil
+}
+
+func (m *MemoryStore) DeleteCarbPoint(id string) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	s := m.sub()
+	i := indexOf(s.carbs, id, func(p CarbPoint) string { return p.ID })
+	if i < 0 {
+		return ErrNotFound
+	}
+	s.carbs = append(s.carbs[:i], s.carbs[i+1:]...)
+	return nil
+}
+
+func (m *MemoryStore) WriteActivityPoint(activity ActivityPoint) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	if activity.ID == "" {
+		activity.ID = newID()
+	}
+	s := m.sub()
+	s.activity = upsert(s.activity, activity, func(p ActivityPoint) time.Time { return p.Time },
+		func(a, b ActivityPoint) bool { return a.ID == b.ID })
+	return nil
+}
+
+func (m *MemoryStore) ReadActivityPoints(startTs, endTs int, opts ...ReadOption) ([]ActivityPoint, error) {
+	m.data.mu.RLock()
+	defer m.data.mu.RUnlock()
+	o := newReadOptions(opts)
+	activity := between(m.peek().activity, startTs, endTs, func(p ActivityPoint) time.Time { return p.Time })
+	if o.pointType != "" {
+		activity = keep(activity, func(p ActivityPoint) bool { return p.Type == o.pointType })
+	}
+	return orderAndLimit(activity, o), nil
+}
+
+func (m *MemoryStore) ReadActivityPoint(id string) (*ActivityPoint, error) {
+	m.data.mu.RLock()
+	defer m.data.mu.RUnlock()
+	activity := m.peek().activity
+	i := indexOf(activity, id, func(p ActivityPoint) string { return p.ID })
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	a := activity[i]
+	return &a, nil
+}
+
+func (m *MemoryStore) DeleteActivityPoints(startTs, endTs int) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	s := m.sub()
+	s.activity = without(s.activity, startTs, endTs, func(p ActivityPoint) time.Time { return p.Time })
+	return nil
+}
+
+func (m *MemoryStore) DeleteActivityPoint(id string) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	s := m.sub()
+	i := indexOf(s.activity, id, func(p ActivityPoint) string { return p.ID })
+	if i < 0 {
+		return ErrNotFound
+	}
+	s.activity = append(s.activity[:i], s.activity[i+1:]...)
+	return nil
+}
+
+func (m *MemoryStore) WriteMeterPoint(meter MeterPoint) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	if meter.ID == "" {
+		meter.ID = newID()
+	}
+	s := m.sub()
+	s.meter = upsert(s.meter, meter, func(p MeterPoint) time.Time { return p.Time },
+		func(a, b MeterPoint) bool { return a.ID == b.ID })
+	return nil
+}
+
+func (m *MemoryStore) ReadMeterPoints(startTs, endTs int, opts ...ReadOption) ([]MeterPoint, error) {
+	m.data.mu.RLock()
+	defer m.data.mu.RUnlock()
+	meter := between(m.peek().meter, startTs, endTs, func(p MeterPoint) time.Time { return p.Time })
+	return orderAndLimit(meter, newReadOptions(opts)), nil
+}
+
+func (m *MemoryStore) WriteKetonePoint(ketone KetonePoint) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	if ketone.ID == "" {
+		ketone.ID = newID()
+	}
+	s := m.sub()
+	s.ketones = upsert(s.ketones, ketone, func(p KetonePoint) time.Time { return p.Time },
+		func(a, b KetonePoint) bool { return a.ID == b.ID })
+	return nil
+}
+
+func (m *MemoryStore) ReadKetonePoints(startTs, endTs int, opts ...ReadOption) ([]KetonePoint, error) {
+	m.data.mu.RLock()
+	defer m.data.mu.RUnlock()
+	ketones := between(m.peek().ketones, startTs, endTs, func(p KetonePoint) time.Time { return p.Time })
+	return orderAndLimit(ketones, newReadOptions(opts)), nil
+}
+
+func (m *MemoryStore) WriteCalibrationPoint(calibration CalibrationPoint) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	if calibration.ID == "" {
+		calibration.ID = newID()
+	}
+	s := m.sub()
+	s.calib = upsert(s.calib, calibration, func(p CalibrationPoint) time.Time { return p.Time },
+		func(a, b CalibrationPoint) bool { return a.ID == b.ID })
+	return nil
+}
+
+func (m *MemoryStore) ReadCalibrationPoints(startTs, endTs int, opts ...ReadOption) ([]CalibrationPoint, error) {
+	m.data.mu.RLock()
+	defer m.data.mu.RUnlock()
+	calib := between(m.peek().calib, startTs, endTs, func(p CalibrationPoint) time.Time { return p.Time })
+	return orderAndLimit(calib, newReadOptions(opts)), nil
+}
+
+func (m *MemoryStore) WriteEventPoint(event EventPoint) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	s := m.sub()
+	s.events = upsert(s.events, event, func(p EventPoint) time.Time { return p.Time },
+		func(a, b EventPoint) bool { return true })
+	return nil
+}
+
+func (m *MemoryStore) ReadEventPoints(startTs, endTs int, opts ...ReadOption) ([]EventPoint, error) {
+	m.data.mu.RLock()
+	defer m.data.mu.RUnlock()
+	o := newReadOptions(opts)
+	events := between(m.peek().events, startTs, endTs, func(p EventPoint) time.Time { return p.Time })
+	if o.event != "" {
+		events = keep(events, func(p EventPoint) bool { return p.Event == o.event })
+	}
+	return orderAndLimit(events, o), nil
+}
+
+func (m *MemoryStore) WriteAuditPoint(audit AuditPoint) error {
+	m.data.mu.Lock()
+	defer m.data.mu.Unlock()
+	s := m.sub()
+	s.audit = upsert(s.audit, audit, func(p AuditPoint) time.Time { return p.Time },
+		func(a, b AuditPoint) bool { return false })
+	return nil
+}
+
+func (m *MemoryStore) ReadAuditPoints(startTs, endTs int, opts ...ReadOption) ([]AuditPoint, error) {
+	m.data.mu.RLock()
+	defer m.data.mu.RUnlock()
+	audit := between(m.peek().audit, startTs, endTs, func(p AuditPoint) time.Time { return p.Time })
+	return orderAndLimit(audit, newReadOptions(opts)), nil
+}
+
+// upsert inserts p into points, which are sorted by time. If there is
+// already a point at the same time that is the same series, it is replaced.
+func upsert[T any](points []T, p T, at func(T) time.Time, sameSeries func(a, b T) bool) []T {
+	t := at(p)
+	i := sort.Search(len(points), func(i int) bool { return !at(points[i]).Before(t) })
+	for ; i < len(points) && at(points[i]).Equal(t); i++ {
+		if sameSeries(points[i], p) {
+			points[i] = p
+			return points
+		}
+	}
+	// Otherwise insert after any points at the same time, to keep the
+	// order they were written in.
+	var zero T
+	points = append(points, zero)
+	copy(points[i+1:], points[i:])
+	points[i] = p
+	return points
+}
+
+// between returns a copy of the points in [startTs, endTs).
+func between[T any](points []T, startTs, endTs int, at func(T) time.Time) []T {
+	start, end := time.Unix(int64(startTs), 0), time.Unix(int64(endTs), 0)
+	result := make([]T, 0)
+	for _, p := range points {
+		if !at(p).Before(start) && at(p).Before(end) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// indexOf returns the index of the point with the given ID, or -1.
+// Points without an ID are never matched.
+func indexOf[T any](points []T, id string, idOf func(T) string) int {
+	if id == "" {
+		return -1
+	}
+	for i, p := range points {
+		if idOf(p) == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// keep filters points in place, keeping those matching fn.
+func keep[T any](points []T, fn func(T) bool) []T {
+	kept := points[:0]
+	for _, p := range points {
+		if fn(p) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// without removes the points in [startTs, endTs].
+func without[T any](points []T, startTs, endTs int, at func(T) time.Time) []T {
+	start, end := time.Unix(int64(startTs), 0), time.Unix(int64(endTs), 0)
+	kept := points[:0]
+	for _, p := range points {
+		if at(p).Before(start) || at(p).After(end) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreRanges(t *testing.T) {
+	m := NewMemoryStore()
+	err := m.WriteGlucosePoints([]GlucosePoint{
+		{Value: 3, Time: time.Unix(300, 0)},
+		{Value: 1, Time: time.Unix(100, 0)},
+		{Value: 2, Time: time.Unix(200, 0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	glucose, _ := m.ReadGlucosePoints(100, 300)
+	if len(glucose) != 2 || glucose[0].Value != 1 || glucose[1].Value != 2 {
+		t.Fatalf("expected [100, 300) in time order, got %+v", glucose)
+	}
+
+	latest, _ := m.ReadLatestGlucosePoint()
+	if latest == nil || latest.Value != 3 {
+		t.Fatalf("expected the latest point to be 3, got %+v", latest)
+	}
+}
+
+func TestMemoryStoreOverwrites(t *testing.T) {
+	m := NewMemoryStore()
+	ts := time.Unix(100, 0)
+	m.WriteInsulinPoint(InsulinPoint{ID: "a", Value: 4, Type: "Humalog", Time: ts})
+	m.WriteInsulinPoint(InsulinPoint{ID: "b", Value: 20, Type: "Tresiba", Time: ts})
+	m.WriteInsulinPoint(InsulinPoint{ID: "a", Value: 5, Type: "Humalog", Time: ts})
+	// Doses without an ID get a new one, so they are kept separately.
+	m.WriteInsulinPoint(InsulinPoint{Value: 1, Type: "Humalog", Time: ts})
+
+	insulin, _ := m.ReadInsulinPoints(0, 200)
+	if len(insulin) != 3 {
+		t.Fatalf("expected one point per ID, got %+v", insulin)
+	}
+	for _, ins := range insulin {
+		if ins.ID == "" {
+			t.Errorf("expected every point to have an ID, got %+v", ins)
+		}
+		if ins.ID == "a" && ins.Value != 5 {
+			t.Errorf("expected dose a to be replaced, got %d", ins.Value)
+		}
+	}
+}
+
+func TestMemoryStoreUpdateAndDeleteByID(t *testing.T) {
+	m := NewMemoryStore()
+	m.WriteCarbPoint(CarbPoint{ID: "a", Value: 30, Time: time.Unix(100, 0)})
+	m.WriteCarbPoint(CarbPoint{ID: "b", Value: 40, Time: time.Unix(200, 0)})
+
+	// Moving a point in time keeps the order.
+	if err := m.UpdateCarbPoint(CarbPoint{ID: "a", Value: 35, Time: time.Unix(300, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	carbs, _ := m.ReadCarbPoints(0, 400)
+	if len(carbs) != 2 || carbs[0].ID != "b" || carbs[1].Value != 35 {
+		t.Fatalf("expected a to be moved after b, got %+v", carbs)
+	}
+
+	if err := m.DeleteCarbPoint("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeleteCarbPoint("b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound deleting twice, got %v", err)
+	}
+	if err := m.UpdateInsulinPoint(InsulinPoint{ID: "c"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound updating a missing point, got %v", err)
+	}
+}
+
+func TestMemoryStoreDelete(t *testing.T) {
+	m := NewMemoryStore()
+	for _, ts := range []int64{100, 200, 300} {
+		m.WriteCarbPoint(CarbPoint{Value: int(ts), Time: time.Unix(ts, 0)})
+	}
+
+	// Unlike reads, deletes include the end.
+	m.DeleteCarbPoints(100, 200)
+	carbs, _ := m.ReadCarbPoints(0, 400)
+	if len(carbs) != 1 || carbs[0].Value != 300 {
+		t.Fatalf("expected only the last point to be left, got %+v", carbs)
+	}
+}
+
+func TestMemoryStoreSubjects(t *testing.T) {
+	m := NewMemoryStore()
+	alice, bob := m.ForSubject("alice"), m.ForSubject("bob")
+	alice.WriteEventPoint(EventPoint{Event: "test", Time: time.Unix(100, 0)})
+
+	if events, _ := bob.ReadEventPoints(0, 200); len(events) != 0 {
+		t.Errorf("expected bob to have no events, got %+v", events)
+	}
+	if events, _ := m.ForSubject("alice").ReadEventPoints(0, 200); len(events) != 1 {
+		t.Errorf("expected alice to have 1 event, got %+v", events)
+	}
+	if latest, _ := bob.ReadLatestGlucosePoint(); latest != nil {
+		t.Errorf("expected no latest point for bob, got %+v", latest)
+	}
+}
+
+func TestMemoryStoreReadOptions(t *testing.T) {
+	m := NewMemoryStore()
+	for i, insType := range []string{"Humalog", "Tresiba", "Humalog", "Humalog"} {
+		m.WriteInsulinPoint(InsulinPoint{Value: i, Type: insType, Time: time.Unix(int64(100*(i+1)), 0)})
+	}
+
+	insulin, _ := m.ReadInsulinPoints(0, 1000, WithType("Humalog"), Descending(), WithLimit(2))
+	if len(insulin) != 2 || insulin[0].Value != 3 || insulin[1].Value != 2 {
+		t.Fatalf("expected the latest two Humalog doses, got %+v", insulin)
+	}
+
+	m.WriteEventPoint(EventPoint{Event: "a", Time: time.Unix(100, 0)})
+	m.WriteEventPoint(EventPoint{Event: "b", Time: time.Unix(200, 0)})
+	events, _ := m.ReadEventPoints(0, 1000, WithEvent("b"))
+	if len(events) != 1 || events[0].Event != "b" {
+		t.Fatalf("expected only the b event, got %+v", events)
+	}
+}
+
+func TestMemoryStoreActivity(t *testing.T) {
+	m := NewMemoryStore()
+	m.WriteActivityPoint(ActivityPoint{ID: "a", Type: "run", Intensity: IntensityHigh, Duration: 30, Time: time.Unix(100, 0)})
+	m.WriteActivityPoint(ActivityPoint{Type: "walk", Intensity: IntensityLow, Duration: 60, Time: time.Unix(200, 0)})
+
+	activity, _ := m.ReadActivityPoints(0, 300, WithType("run"))
+	if len(activity) != 1 || activity[0].ID != "a" {
+		t.Fatalf("expected only the run, got %+v", activity)
+	}
+	if end := activity[0].End(); !end.Equal(time.Unix(100+30*60, 0)) {
+		t.Errorf("expected the run to end 30 minutes later, got %v", end)
+	}
+
+	if err := m.DeleteActivityPoint("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ReadActivityPoint("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound reading a deleted point, got %v", err)
+	}
+	m.DeleteActivityPoints(200, 200)
+	if activity, _ = m.ReadActivityPoints(0, 300); len(activity) != 0 {
+		t.Errorf("expected no activity left, got %+v", activity)
+	}
+}
+
+func TestMemoryStoreReadings(t *testing.T) {
+	m := NewMemoryStore()
+	m.WriteMeterPoint(MeterPoint{Value: 120, Time: time.Unix(100, 0)})
+	m.WriteKetonePoint(KetonePoint{Value: 0.4, Time: time.Unix(100, 0)})
+	m.WriteKetonePoint(KetonePoint{Value: 1.8, Time: time.Unix(200, 0)})
+	m.WriteCalibrationPoint(CalibrationPoint{Value: 118, Time: time.Unix(100, 0)})
+
+	if meter, _ := m.ReadMeterPoints(0, 300); len(meter) != 1 || meter[0].ID == "" {
+		t.Errorf("expected a meter reading with an ID, got %+v", meter)
+	}
+	if ketones, _ := m.ReadKetonePoints(0, 300, Descending(), WithLimit(1)); len(ketones) != 1 || ketones[0].Value != 1.8 {
+		t.Errorf("expected the latest ketone reading, got %+v", ketones)
+	}
+	if calib, _ := m.ReadCalibrationPoints(0, 300); len(calib) != 1 || calib[0].Value != 118 {
+		t.Errorf("expected a calibration, got %+v", calib)
+	}
+	if calib, _ := m.ForSubject("bob").ReadCalibrationPoints(0, 300); len(calib) != 0 {
+		t.Errorf("expected bob to have no calibrations, got %+v", calib)
+	}
+}
@@ -0,0 +1,54 @@
+package store
+
+// ReadOption narrows down the points returned by a read. Options that do
+// not apply to a kind of point (e.g. WithEvent for insulin) are ignored.
+type ReadOption func(*readOptions)
+
+type readOptions struct {
+	pointType string
+	event     string
+	limit     int
+	desc      bool
+}
+
+// WithType only returns insulin or activity points of the given type.
+func WithType(pointType string) ReadOption {
+	return func(o *readOptions) { o.pointType = pointType }
+}
+
+// WithEvent only returns event points with the given event name.
+func WithEvent(event string) ReadOption {
+	return func(o *readOptions) { o.event = event }
+}
+
+// WithLimit returns at most n points, after ordering. Zero means no limit.
+func WithLimit(n int) ReadOption {
+	return func(o *readOptions) { o.limit = n }
+}
+
+// Descending returns the newest points first, so with WithLimit it
+// returns the latest n points.
+func Descending() ReadOption {
+	return func(o *readOptions) { o.desc = true }
+}
+
+func newReadOptions(opts []ReadOption) readOptions {
+	var o readOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// orderAndLimit applies the order and limit to points sorted oldest first.
+func orderAndLimit[T any](points []T, o readOptions) []T {
+	if o.desc {
+		for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+			points[i], points[j] = points[j], points[i]
+		}
+	}
+	if o.limit > 0 && len(points) > o.limit {
+		points = points[:o.limit]
+	}
+	return points
+}
@@ -0,0 +1,56 @@
+package store
+
+// Store is implemented by all the storage backends. Timestamps are in
+// unix seconds, and reads cover [startTs, endTs) oldest first, unless
+// told otherwise by the ReadOptions. Writes give manually entered points
+// (everything but glucose, events and audit) an ID if they do not have one,
+// and reads, updates and deletes by ID return ErrNotFound if there is no
+// such point.
+type Store interface {
+	// ForSubject returns a store that only reads and writes points
+	// for the given subject.
+	ForSubject(subject string) Store
+	// Name is used to tell writers for different subjects apart.
+	Name() string
+
+	WriteGlucosePoints(glucose []GlucosePoint) error
+	ReadGlucosePoints(startTs, endTs int, opts ...ReadOption) ([]GlucosePoint, error)
+	ReadLatestGlucosePoint() (*GlucosePoint, error)
+
+	WriteInsulinPoint(insulin InsulinPoint) error
+	ReadInsulinPoints(startTs, endTs int, opts ...ReadOption) ([]InsulinPoint, error)
+	ReadInsulinPoint(id string) (*InsulinPoint, error)
+	DeleteInsulinPoints(startTs, endTs int) error
+	// UpdateInsulinPoint replaces the point with the same ID.
+	UpdateInsulinPoint(insulin InsulinPoint) error
+	DeleteInsulinPoint(id string) error
+
+	WriteCarbPoint(carb CarbPoint) error
+	ReadCarbPoints(startTs, endTs int, opts ...ReadOption) ([]CarbPoint, error)
+	ReadCarbPoint(id string) (*CarbPoint, error)
+	DeleteCarbPoints(startTs, endTs int) error
+	UpdateCarbPoint(carb CarbPoint) error
+	DeleteCarbPoint(id string) error
+
+	WriteActivityPoint(activity ActivityPoint) error
+	ReadActivityPoints(startTs, endTs int, opts ...ReadOption) ([]ActivityPoint, error)
+	ReadActivityPoint(id string) (*ActivityPoint, error)
+	DeleteActivityPoints(startTs, endTs int) error
+	DeleteActivityPoint(id string) error
+
+	WriteMeterPoint(meter MeterPoint) error
+	ReadMeterPoints(startTs, endTs int, opts ...ReadOption) ([]MeterPoint, error)
+
+	WriteKetonePoint(ketone KetonePoint) error
+	ReadKetonePoints(startTs, endTs int, opts ...ReadOption) ([]KetonePoint, error)
+
+	WriteCalibrationPoint(calibration CalibrationPoint) error
+	ReadCalibrationPoints(startTs, endTs int, opts ...ReadOption) ([]CalibrationPoint, error)
+
+	WriteEventPoint(event EventPoint) error
+	ReadEventPoints(startTs, endTs int, opts ...ReadOption) ([]EventPoint, error)
+
+	// The audit trail is append only, there is no way to change it.
+	WriteAuditPoint(audit AuditPoint) error
+	ReadAuditPoints(startTs, endTs int, opts ...ReadOption) ([]AuditPoint, error)
+}
@@ -0,0 +1,214 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// These tests run against every backend that does not need a server, so
+// they all behave the same way as far as callers can tell.
+var backends = []struct {
+	name string
+	new  func(t *testing.T) Store
+}{
+	{
+		name: "memory",
+		new:  func(t *testing.T) Store { return NewMemoryStore() },
+	},
+	{
+		name: "bolt",
+		new: func(t *testing.T) Store {
+			c, err := NewBolt(filepath.Join(t.TempDir(), "iv3.db"), zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { c.Close() })
+			return c
+		},
+	},
+}
+
+func forEachBackend(t *testing.T, fn func(t *testing.T, s Store)) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			fn(t, backend.new(t))
+		})
+	}
+}
+
+func TestStoreRanges(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		err := s.WriteGlucosePoints([]GlucosePoint{
+			{Value: 3, Time: time.Unix(300, 0)},
+			{Value: 1, Time: time.Unix(100, 0)},
+			{Value: 2, Time: time.Unix(200, 0)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ts := range []int64{100, 200, 300} {
+			if err = s.WriteInsulinPoint(InsulinPoint{Value: int(ts), Type: "Humalog", Time: time.Unix(ts, 0)}); err != nil {
+				t.Fatal(err)
+			}
+			if err = s.WriteCarbPoint(CarbPoint{Value: int(ts), Time: time.Unix(ts, 0)}); err != nil {
+				t.Fatal(err)
+			}
+			if err = s.WriteMeterPoint(MeterPoint{Value: float64(ts), Time: time.Unix(ts, 0)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		glucose, err := s.ReadGlucosePoints(100, 300)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(glucose) != 2 || glucose[0].Value != 1 || glucose[1].Value != 2 {
+			t.Errorf("expected glucose in [100, 300) in time order, got %+v", glucose)
+		}
+		latest, err := s.ReadLatestGlucosePoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latest == nil || latest.Value != 3 {
+			t.Errorf("expected the latest glucose to be 3, got %+v", latest)
+		}
+
+		insulin, _ := s.ReadInsulinPoints(150, 301)
+		if len(insulin) != 2 || insulin[0].Value != 200 || insulin[1].Value != 300 {
+			t.Errorf("expected insulin in [150, 301), got %+v", insulin)
+		}
+		if insulin[0].ID == "" {
+			t.Errorf("expected insulin to be given an ID")
+		}
+		carbs, _ := s.ReadCarbPoints(0, 200)
+		if len(carbs) != 1 || carbs[0].Value != 100 {
+			t.Errorf("expected carbs in [0, 200), got %+v", carbs)
+		}
+		meter, _ := s.ReadMeterPoints(200, 200)
+		if len(meter) != 0 {
+			t.Errorf("expected an empty range to return nothing, got %+v", meter)
+		}
+	})
+}
+
+func TestStoreReadOptions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		for i, insType := range []string{"Humalog", "Tresiba", "Humalog", "Humalog"} {
+			s.WriteInsulinPoint(InsulinPoint{Value: i, Type: insType, Time: time.Unix(int64(100*(i+1)), 0)})
+			s.WriteGlucosePoints([]GlucosePoint{{Value: float64(i), Time: time.Unix(int64(100*(i+1)), 0)}})
+		}
+
+		glucose, _ := s.ReadGlucosePoints(0, 1000, WithLimit(2))
+		if len(glucose) != 2 || glucose[0].Value != 0 || glucose[1].Value != 1 {
+			t.Errorf("expected the first two glucose points, got %+v", glucose)
+		}
+		glucose, _ = s.ReadGlucosePoints(0, 1000, Descending())
+		if len(glucose) != 4 || glucose[0].Value != 3 || glucose[3].Value != 0 {
+			t.Errorf("expected all glucose points newest first, got %+v", glucose)
+		}
+		insulin, _ := s.ReadInsulinPoints(0, 1000, WithType("Humalog"), Descending(), WithLimit(2))
+		if len(insulin) != 2 || insulin[0].Value != 3 || insulin[1].Value != 2 {
+			t.Errorf("expected the latest two Humalog doses, got %+v", insulin)
+		}
+
+		s.WriteEventPoint(EventPoint{Event: "a", Time: time.Unix(100, 0)})
+		s.WriteEventPoint(EventPoint{Event: "b", Time: time.Unix(200, 0)})
+		events, _ := s.ReadEventPoints(0, 1000, WithEvent("b"))
+		if len(events) != 1 || events[0].Event != "b" {
+			t.Errorf("expected only the b event, got %+v", events)
+		}
+	})
+}
+
+func TestStoreUpdateAndDeleteByID(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		s.WriteCarbPoint(CarbPoint{ID: "a", Value: 30, Time: time.Unix(100, 0)})
+		s.WriteCarbPoint(CarbPoint{ID: "b", Value: 40, Time: time.Unix(200, 0)})
+
+		// Moving a point in time keeps the order.
+		if err := s.UpdateCarbPoint(CarbPoint{ID: "a", Value: 35, Time: time.Unix(300, 0)}); err != nil {
+			t.Fatal(err)
+		}
+		carbs, _ := s.ReadCarbPoints(0, 400)
+		if len(carbs) != 2 || carbs[0].ID != "b" || carbs[1].Value != 35 {
+			t.Fatalf("expected a to be moved after b, got %+v", carbs)
+		}
+		carb, err := s.ReadCarbPoint("a")
+		if err != nil || carb.Value != 35 {
+			t.Errorf("expected to read the updated point, got %+v, %v", carb, err)
+		}
+
+		if err = s.DeleteCarbPoint("b"); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.DeleteCarbPoint("b"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound deleting twice, got %v", err)
+		}
+		if _, err = s.ReadCarbPoint("b"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound reading a deleted point, got %v", err)
+		}
+		if err = s.UpdateInsulinPoint(InsulinPoint{ID: "c", Time: time.Unix(100, 0)}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound updating a missing point, got %v", err)
+		}
+
+		s.WriteActivityPoint(ActivityPoint{ID: "d", Type: "run", Intensity: IntensityHigh, Duration: 30, Time: time.Unix(100, 0)})
+		if err = s.DeleteActivityPoint("d"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.ReadActivityPoint("d"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound reading deleted activity, got %v", err)
+		}
+	})
+}
+
+func TestStoreDeleteRange(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		for _, ts := range []int64{100, 200, 300} {
+			s.WriteInsulinPoint(InsulinPoint{Value: int(ts), Type: "Humalog", Time: time.Unix(ts, 0)})
+		}
+
+		// Unlike reads, deletes include the end.
+		if err := s.DeleteInsulinPoints(100, 200); err != nil {
+			t.Fatal(err)
+		}
+		insulin, _ := s.ReadInsulinPoints(0, 400)
+		if len(insulin) != 1 || insulin[0].Value != 300 {
+			t.Errorf("expected only the last point to be left, got %+v", insulin)
+		}
+	})
+}
+
+func TestStoreSubjects(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		alice, bob := s.ForSubject("alice"), s.ForSubject("bob")
+		alice.WriteGlucosePoints([]GlucosePoint{{Value: 100, Time: time.Unix(100, 0)}})
+		alice.WriteCarbPoint(CarbPoint{ID: "a", Value: 30, Time: time.Unix(100, 0)})
+		alice.WriteEventPoint(EventPoint{Event: "test", Time: time.Unix(100, 0)})
+
+		if glucose, _ := bob.ReadGlucosePoints(0, 200); len(glucose) != 0 {
+			t.Errorf("expected bob to have no glucose, got %+v", glucose)
+		}
+		if latest, _ := bob.ReadLatestGlucosePoint(); latest != nil {
+			t.Errorf("expected no latest point for bob, got %+v", latest)
+		}
+		if events, _ := bob.ReadEventPoints(0, 200); len(events) != 0 {
+			t.Errorf("expected bob to have no events, got %+v", events)
+		}
+		if _, err := bob.ReadCarbPoint("a"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected bob to not find alice's carbs, got %v", err)
+		}
+		if err := bob.DeleteCarbPoint("a"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected bob to not delete alice's carbs, got %v", err)
+		}
+		if carbs, _ := s.ForSubject("alice").ReadCarbPoints(0, 200); len(carbs) != 1 {
+			t.Errorf("expected alice to still have 1 carb point, got %+v", carbs)
+		}
+		if alice.Name() == bob.Name() {
+			t.Errorf("expected subjects to have different names, got %s", alice.Name())
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Trend is the direction the sensor reports glucose moving in. The values
+// match the numeric trends used by older Dexcom Share responses.
+type Trend int
+
+const (
+	TrendNone Trend = iota
+	TrendDoubleUp
+	TrendSingleUp
+	TrendFortyFiveUp
+	TrendFlat
+	TrendFortyFiveDown
+	TrendSingleDown
+	TrendDoubleDown
+	TrendNotComputable
+	TrendRateOutOfRange
+)
+
+var trendNames = []string{
+	TrendNone:           "None",
+	TrendDoubleUp:       "DoubleUp",
+	TrendSingleUp:       "SingleUp",
+	TrendFortyFiveUp:    "FortyFiveUp",
+	TrendFlat:           "Flat",
+	TrendFortyFiveDown:  "FortyFiveDown",
+	TrendSingleDown:     "SingleDown",
+	TrendDoubleDown:     "DoubleDown",
+	TrendNotComputable:  "NotComputable",
+	TrendRateOutOfRange: "RateOutOfRange",
+}
+
+// Expected rate of change in mg/dL/min for each trend, as documented by Dexcom.
+var trendRates = map[Trend][2]float64{
+	TrendDoubleUp:      {3, math.Inf(1)},
+	TrendSingleUp:      {2, 3},
+	TrendFortyFiveUp:   {1, 2},
+	TrendFlat:          {-1, 1},
+	TrendFortyFiveDown: {-2, -1},
+	TrendSingleDown:    {-3, -2},
+	TrendDoubleDown:    {math.Inf(-1), -3},
+}
+
+// ParseTrend converts a trend name into a Trend. Names are matched loosely,
+// so that both Dexcom ("NotComputable") and Nightscout ("NOT COMPUTABLE")
+// spellings work. Unknown names are treated as TrendNone.
+func ParseTrend(s string) Trend {
+	normalized := strings.ToLower(strings.ReplaceAll(s, " ", ""))
+	for i, name := range trendNames {
+		if strings.ToLower(name) == normalized {
+			return Trend(i)
+		}
+	}
+	return TrendNone
+}
+
+func (t Trend) String() string {
+	if t < 0 || int(t) >= len(trendNames) {
+		return trendNames[TrendNone]
+	}
+	return trendNames[t]
+}
+
+// RateRange returns the expected rate of change in mg/dL/min.
+// The bounds are infinite for the double arrows, and ok is false if
+// the trend does not have a rate.
+func (t Trend) RateRange() (lo, hi float64, ok bool) {
+	r, ok := trendRates[t]
+	return r[0], r[1], ok
+}
+
+// Rate returns a single representative rate of change in mg/dL/min,
+// the middle of the expected range.
+func (t Trend) Rate() (float64, bool) {
+	lo, hi, ok := t.RateRange()
+	if !ok {
+		return 0, false
+	}
+	// The double arrows are open ended, so use half a unit past the bound.
+	if math.IsInf(hi, 1) {
+		return lo + 0.5, true
+	}
+	if math.IsInf(lo, -1) {
+		return hi - 0.5, true
+	}
+	return (lo + hi) / 2, true
+}
+
+func (t Trend) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// UnmarshalJSON accepts both the trend names, and the numeric values
+// returned by older Share responses.
+func (t *Trend) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*t = ParseTrend(name)
+		return nil
+	}
+
+	var n int
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("unable to unmarshal trend %s: %w", b, err)
+	}
+	if n < 0 || n >= len(trendNames) {
+		*t = TrendNone
+		return nil
+	}
+	*t = Trend(n)
+	return nil
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func TestTrendUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		num   int
+		trend Trend
+	}{
+		{"None", 0, TrendNone},
+		{"DoubleUp", 1, TrendDoubleUp},
+		{"SingleUp", 2, TrendSingleUp},
+		{"FortyFiveUp", 3, TrendFortyFiveUp},
+		{"Flat", 4, TrendFlat},
+		{"FortyFiveDown", 5, TrendFortyFiveDown},
+		{"SingleDown", 6, TrendSingleDown},
+		{"DoubleDown", 7, TrendDoubleDown},
+		{"NotComputable", 8, TrendNotComputable},
+		{"RateOutOfRange", 9, TrendRateOutOfRange},
+		// Unknown trends are treated as none.
+		{"Sideways", 10, TrendNone},
+	}
+	for _, tt := range tests {
+		var fromName, fromNum Trend
+		if err := json.Unmarshal([]byte(strconv.Quote(tt.name)), &fromName); err != nil {
+			t.Errorf("%q: unexpected error %v", tt.name, err)
+		}
+		if err := json.Unmarshal([]byte(strconv.Itoa(tt.num)), &fromNum); err != nil {
+			t.Errorf("%d: unexpected error %v", tt.num, err)
+		}
+		if fromName != tt.trend {
+			t.Errorf("%q: expected %s, got %s", tt.name, tt.trend, fromName)
+		}
+		if fromNum != tt.trend {
+			t.Errorf("%d: expected %s, got %s", tt.num, tt.trend, fromNum)
+		}
+	}
+
+	var trend Trend
+	if err := json.Unmarshal([]byte(`{"trend":4}`), &trend); err == nil {
+		t.Errorf("expected an error unmarshalling an object")
+	}
+}
@@ -1,27 +1,117 @@
 package store
 
-import "time"
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrNotFound is returned when updating or deleting a point that does not exist.
+var ErrNotFound = errors.New("point not found")
 
 type GlucosePoint struct {
-	WT    string  `json:"WT"` // Not exactly sure what this stands for.
+	// Share returns three timestamps: WT (wall/UTC time), ST (system time)
+	// and DT (display time, which includes the receiver's UTC offset).
+	WT    string  `json:"WT"`
+	ST    string  `json:"ST"`
+	DT    string  `json:"DT"`
 	Value float64 `json:"Value"`
-	Trend string  `json:"Trend"`
+	Trend Trend   `json:"Trend"`
 	Time  time.Time
+	// UTCOffset is the wearer's offset from UTC in seconds, at the time
+	// of the reading. This is 0 if the source does not report it.
+	UTCOffset int
+}
+
+// LocalTime returns the time of the reading in the wearer's timezone.
+func (gp GlucosePoint) LocalTime() time.Time {
+	return gp.Time.In(time.FixedZone("", gp.UTCOffset))
 }
 
+// Insulin and carb points have an ID, so they can be edited one at a time.
+// Points written before IDs were added have none, and can only be deleted
+// by time range.
 type InsulinPoint struct {
+	ID    string
 	Value int
 	Type  string
 	Time  time.Time
 }
 
 type CarbPoint struct {
+	ID    string
 	Value int
 	Time  time.Time
 }
 
+const (
+	IntensityLow      = "low"
+	IntensityModerate = "moderate"
+	IntensityHigh     = "high"
+)
+
+// ActivityPoint is a bout of exercise, starting at Time.
+type ActivityPoint struct {
+	ID        string
+	Type      string
+	Intensity string
+	Duration  int // In minutes.
+	Time      time.Time
+}
+
+// End returns when the activity finished.
+func (a ActivityPoint) End() time.Time {
+	return a.Time.Add(time.Duration(a.Duration) * time.Minute)
+}
+
+// MeterPoint is a fingerstick reading from a blood glucose meter, in mg/dL.
+type MeterPoint struct {
+	ID    string
+	Value float64
+	Time  time.Time
+}
+
+// KetonePoint is a blood ketone (beta-hydroxybutyrate) reading, in mmol/L.
+type KetonePoint struct {
+	ID    string
+	Value float64
+	Time  time.Time
+}
+
+// CalibrationPoint is a meter reading entered into the CGM to calibrate
+// it, in mg/dL.
+type CalibrationPoint struct {
+	ID    string
+	Value float64
+	Time  time.Time
+}
+
+// InvalidCredentialsEvent is recorded when logging in to Dexcom Share
+// keeps failing, and is picked up by the alerter.
+const InvalidCredentialsEvent = "invalid_credentials"
+
 type EventPoint struct {
 	Event   string
 	Message string
 	Time    time.Time
 }
+
+// AuditPoint records a manual change to the data, and who made it.
+// Before and After are the affected points as JSON, and are empty for
+// writes and deletes respectively.
+type AuditPoint struct {
+	Action string
+	Kind   string
+	ID     string
+	Actor  string
+	Client string
+	Before json.RawMessage
+	After  json.RawMessage
+	Time   time.Time
+}
+
+func newID() string {
+	return uuid.NewString()
+}
@@ -0,0 +1,477 @@
+package clarity
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/algao1/iv3/config"
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+const (
+	// Clarity reports readings outside of the sensor range as text.
+	lowGlucose  = 40
+	highGlucose = 400
+
+	// Points this close to an existing one are considered duplicates.
+	glucoseTolerance = 150 * time.Second
+	entryTolerance   = 1 * time.Minute
+)
+
+var timestampLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+type ReadWriter interface {
+	ReadGlucosePoints(startTs, endTs int, opts ...store.ReadOption) ([]store.GlucosePoint, error)
+	WriteGlucosePoints(glucose []store.GlucosePoint) error
+	ReadInsulinPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.InsulinPoint, error)
+	WriteInsulinPoint(point store.InsulinPoint) error
+	ReadCarbPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.CarbPoint, error)
+	WriteCarbPoint(point store.CarbPoint) error
+	ReadCalibrationPoints(startTs, endTs int, opts ...store.ReadOption) ([]store.CalibrationPoint, error)
+	WriteCalibrationPoint(point store.CalibrationPoint) error
+}
+
+// Records are the rows parsed out of a Clarity export.
+type Records struct {
+	Glucose      []store.GlucosePoint
+	Insulin      []store.InsulinPoint
+	Carbs        []store.CarbPoint
+	Calibrations []store.CalibrationPoint
+	// Rounded is the number of carb rows with fractional grams, which
+	// were rounded since points only hold whole grams.
+	Rounded int
+	// Unimported are the rows that cannot be stored as they are, like
+	// fractional insulin doses, which are left out rather than rounded.
+	Unimported []Unimported
+}
+
+// Unimported is a row that was left out of the import, and why.
+type Unimported struct {
+	Line   int
+	Time   time.Time
+	Reason string
+}
+
+// Result is the number of points written, and skipped as duplicates.
+// Rounded and Unimported are the same as in Records.
+type Result struct {
+	Glucose      int
+	Insulin      int
+	Carbs        int
+	Calibrations int
+	Skipped      int
+	Rounded      int
+	Unimported   []Unimported
+}
+
+type Importer struct {
+	rw      ReadWriter
+	insulin []config.InsulinConfig
+	logger  *zap.Logger
+}
+
+func NewImporter(rw ReadWriter, insulin []config.InsulinConfig, logger *zap.Logger) *Importer {
+	return &Importer{
+		rw:      rw,
+		insulin: insulin,
+		logger:  logger,
+	}
+}
+
+// Import parses a Clarity CSV export and writes everything that is not
+// already in the store. Clarity timestamps have no timezone, so loc is
+// the timezone the export was made in.
+func (im *Importer) Import(r io.Reader, loc *time.Location) (*Result, error) {
+	began := time.Now()
+	records, err := Parse(r, loc, im.insulin)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse export: %w", err)
+	}
+
+	start, end, ok := records.timeRange()
+	if !ok {
+		return &Result{}, nil
+	}
+	startTs, endTs := int(start.Unix()), int(end.Unix())+1
+
+	result := &Result{Rounded: records.Rounded, Unimported: records.Unimported}
+	if records.Rounded > 0 {
+		im.logger.Warn("rounded fractional carb values", zap.Int("count", records.Rounded))
+	}
+	for _, row := range records.Unimported {
+		im.logger.Warn("left out row",
+			zap.Int("line", row.Line),
+			zap.Time("ts", row.Time),
+			zap.String("reason", row.Reason),
+		)
+	}
+	if err = im.importGlucose(records.Glucose, startTs, endTs, result); err != nil {
+		return nil, err
+	}
+	if err = im.importInsulin(records.Insulin, startTs, endTs, result); err != nil {
+		return nil, err
+	}
+	if err = im.importCarbs(records.Carbs, startTs, endTs, result); err != nil {
+		return nil, err
+	}
+	if err = im.importCalibrations(records.Calibrations, startTs, endTs, result); err != nil {
+		return nil, err
+	}
+
+	im.logger.Info("imported clarity export",
+		zap.Time("start", start),
+		zap.Time("end", end),
+		zap.Any("result", result),
+		zap.Duration("took", time.Since(began)),
+	)
+	return result, nil
+}
+
+func (im *Importer) importGlucose(glucose []store.GlucosePoint, startTs, endTs int, result *Result) error {
+	existing, err := im.rw.ReadGlucosePoints(startTs, endTs)
+	if err != nil {
+		return fmt.Errorf("unable to read existing glucose points: %w", err)
+	}
+	times := make([]time.Time, len(existing))
+	for i, gp := range existing {
+		times[i] = gp.Time
+	}
+	idx := newTimeIndex(times)
+
+	toWrite := make([]store.GlucosePoint, 0, len(glucose))
+	for _, gp := range glucose {
+		if idx.near(gp.Time, glucoseTolerance) {
+			result.Skipped++
+			continue
+		}
+		toWrite = append(toWrite, gp)
+	}
+	if len(toWrite) == 0 {
+		return nil
+	}
+
+	if err = im.rw.WriteGlucosePoints(toWrite); err != nil {
+		return fmt.Errorf("unable to write glucose points: %w", err)
+	}
+	result.Glucose = len(toWrite)
+	return nil
+}
+
+func (im *Importer) importInsulin(insulin []store.InsulinPoint, startTs, endTs int, result *Result) error {
+	existing, err := im.rw.ReadInsulinPoints(startTs, endTs)
+	if err != nil {
+		return fmt.Errorf("unable to read existing insulin points: %w", err)
+	}
+	times := make(map[string][]time.Time)
+	for _, ins := range existing {
+		key := fmt.Sprintf("%s/%d", ins.Type, ins.Value)
+		times[key] = append(times[key], ins.Time)
+	}
+	idx := make(map[string]timeIndex)
+	for key, t := range times {
+		idx[key] = newTimeIndex(t)
+	}
+
+	for _, ins := range insulin {
+		if idx[fmt.Sprintf("%s/%d", ins.Type, ins.Value)].near(ins.Time, entryTolerance) {
+			result.Skipped++
+			continue
+		}
+		if err = im.rw.WriteInsulinPoint(ins); err != nil {
+			return fmt.Errorf("unable to write insulin point: %w", err)
+		}
+		result.Insulin++
+	}
+	return nil
+}
+
+func (im *Importer) importCarbs(carbs []store.CarbPoint, startTs, endTs int, result *Result) error {
+	existing, err := im.rw.ReadCarbPoints(startTs, endTs)
+	if err != nil {
+		return fmt.Errorf("unable to read existing carb points: %w", err)
+	}
+	times := make(map[int][]time.Time)
+	for _, carb := range existing {
+		times[carb.Value] = append(times[carb.Value], carb.Time)
+	}
+	idx := make(map[int]timeIndex)
+	for key, t := range times {
+		idx[key] = newTimeIndex(t)
+	}
+
+	for _, carb := range carbs {
+		if idx[carb.Value].near(carb.Time, entryTolerance) {
+			result.Skipped++
+			continue
+		}
+		if err = im.rw.WriteCarbPoint(carb); err != nil {
+			return fmt.Errorf("unable to write carb point: %w", err)
+		}
+		result.Carbs++
+	}
+	return nil
+}
+
+func (im *Importer) importCalibrations(calibrations []store.CalibrationPoint, startTs, endTs int, result *Result) error {
+	existing, err := im.rw.ReadCalibrationPoints(startTs, endTs)
+	if err != nil {
+		return fmt.Errorf("unable to read existing calibration points: %w", err)
+	}
+	times := make(map[float64][]time.Time)
+	for _, cal := range existing {
+		times[cal.Value] = append(times[cal.Value], cal.Time)
+	}
+	idx := make(map[float64]timeIndex)
+	for key, t := range times {
+		idx[key] = newTimeIndex(t)
+	}
+
+	for _, cal := range calibrations {
+		if idx[cal.Value].near(cal.Time, entryTolerance) {
+			result.Skipped++
+			continue
+		}
+		if err = im.rw.WriteCalibrationPoint(cal); err != nil {
+			return fmt.Errorf("unable to write calibration point: %w", err)
+		}
+		result.Calibrations++
+	}
+	return nil
+}
+
+// Parse reads a Clarity CSV export. Rows that are not readings or
+// treatments (patient info, alerts, devices) are ignored.
+func Parse(r io.Reader, loc *time.Location, insulin []config.InsulinConfig) (*Records, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read header: %w", err)
+	}
+	cols, mmol, err := parseHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	insulinNames := make(map[string]string)
+	for _, ins := range insulin {
+		if _, ok := insulinNames[ins.PeriodType]; !ok {
+			insulinNames[ins.PeriodType] = ins.Name
+		}
+	}
+
+	records := &Records{}
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read line %d: %w", line, err)
+		}
+		get := func(col string) string {
+			if i := cols[col]; i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+
+		eventType := get("Event Type")
+		if eventType != "EGV" && eventType != "Calibration" &&
+			eventType != "Insulin" && eventType != "Carbs" {
+			continue
+		}
+
+		ts, err := parseTimestamp(get("Timestamp"), loc)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		switch eventType {
+		case "EGV":
+			value, err := parseGlucose(get("Glucose Value"), mmol)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			_, offset := ts.Zone()
+			records.Glucose = append(records.Glucose, store.GlucosePoint{
+				Value:     value,
+				Trend:     store.TrendNone,
+				Time:      ts,
+				UTCOffset: offset,
+			})
+		case "Calibration":
+			value, err := parseGlucose(get("Glucose Value"), mmol)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			records.Calibrations = append(records.Calibrations, store.CalibrationPoint{
+				Value: value,
+				Time:  ts,
+			})
+		case "Insulin":
+			value, err := strconv.ParseFloat(get("Insulin Value"), 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid insulin value: %w", line, err)
+			}
+			// Doses are stored in whole units, and rounding one would
+			// quietly change the dosing history.
+			if value != math.Trunc(value) {
+				records.Unimported = append(records.Unimported, Unimported{
+					Line:   line,
+					Time:   ts,
+					Reason: fmt.Sprintf("fractional insulin dose of %gu", value),
+				})
+				continue
+			}
+			subtype := get("Event Subtype")
+			insType := subtype
+			switch subtype {
+			case "Fast-Acting":
+				if name, ok := insulinNames["rapid"]; ok {
+					insType = name
+				}
+			case "Long-Acting":
+				if name, ok := insulinNames["long"]; ok {
+					insType = name
+				}
+			}
+			records.Insulin = append(records.Insulin, store.InsulinPoint{
+				Value: int(value),
+				Type:  insType,
+				Time:  ts,
+			})
+		case "Carbs":
+			value, err := strconv.ParseFloat(get("Carb Value"), 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid carb value: %w", line, err)
+			}
+			records.Carbs = append(records.Carbs, store.CarbPoint{
+				Value: records.round(value),
+				Time:  ts,
+			})
+		}
+	}
+	return records, nil
+}
+
+// parseHeader finds the columns we need. Clarity puts the units in the
+// column names, e.g. "Glucose Value (mg/dL)", so these are matched by prefix.
+func parseHeader(header []string) (map[string]int, bool, error) {
+	wanted := []string{"Timestamp", "Event Type", "Event Subtype",
+		"Glucose Value", "Insulin Value", "Carb Value"}
+
+	cols := make(map[string]int)
+	mmol := false
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		for _, w := range wanted {
+			if _, ok := cols[w]; !ok && strings.HasPrefix(name, w) {
+				cols[w] = i
+				if w == "Glucose Value" && strings.Contains(name, "mmol/L") {
+					mmol = true
+				}
+			}
+		}
+	}
+
+	for _, w := range wanted {
+		if _, ok := cols[w]; !ok {
+			return nil, false, fmt.Errorf("missing column %q, is this a Clarity export?", w)
+		}
+	}
+	return cols, mmol, nil
+}
+
+func parseTimestamp(s string, loc *time.Location) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if ts, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return ts, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+}
+
+// parseGlucose returns the glucose value in mg/dL.
+func parseGlucose(s string, mmol bool) (float64, error) {
+	switch strings.ToLower(s) {
+	case "low":
+		return lowGlucose, nil
+	case "high":
+		return highGlucose, nil
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid glucose value: %w", err)
+	}
+	if mmol {
+		value = math.Round(value * 18)
+	}
+	return value, nil
+}
+
+// round rounds value to a whole gram, counting it if it was not one.
+func (r *Records) round(value float64) int {
+	rounded := math.Round(value)
+	if rounded != value {
+		r.Rounded++
+	}
+	return int(rounded)
+}
+
+func (r *Records) timeRange() (time.Time, time.Time, bool) {
+	var times []time.Time
+	for _, gp := range r.Glucose {
+		times = append(times, gp.Time)
+	}
+	for _, ins := range r.Insulin {
+		times = append(times, ins.Time)
+	}
+	for _, carb := range r.Carbs {
+		times = append(times, carb.Time)
+	}
+	for _, cal := range r.Calibrations {
+		times = append(times, cal.Time)
+	}
+	if len(times) == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+
+	start, end := times[0], times[0]
+	for _, t := range times {
+		if t.Before(start) {
+			start = t
+		}
+		if t.After(end) {
+			end = t
+		}
+	}
+	return start, end, true
+}
+
+// timeIndex is a sorted list of times, used to find duplicates.
+type timeIndex []time.Time
+
+func newTimeIndex(times []time.Time) timeIndex {
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times
+}
+
+// near returns whether there is a time within tol of t.
+func (idx timeIndex) near(t time.Time, tol time.Duration) bool {
+	i := sort.Search(len(idx), func(i int) bool { return !idx[i].Before(t.Add(-tol)) })
+	return i < len(idx) && !idx[i].After(t.Add(tol))
+}
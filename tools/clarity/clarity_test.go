@@ -0,0 +1,218 @@
+package clarity
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/algao1/iv3/config"
+	"github.com/algao1/iv3/store"
+	"go.uber.org/zap"
+)
+
+var testInsulin = []config.InsulinConfig{
+	{Name: "Humalog", PeriodType: "rapid"},
+	{Name: "Tresiba", PeriodType: "long"},
+}
+
+const testHeader = "Index,Timestamp (YYYY-MM-DDThh:mm:ss),Event Type,Event Subtype,Glucose Value (mg/dL),Insulin Value (u),Carb Value (grams)\n"
+
+func loadFixture(t *testing.T) *os.File {
+	t.Helper()
+	f, err := os.Open("testdata/export.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func toronto(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		t.Skipf("timezone data not available: %v", err)
+	}
+	return loc
+}
+
+func TestParse(t *testing.T) {
+	records, err := Parse(loadFixture(t), toronto(t), testInsulin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records.Glucose) != 3 || len(records.Calibrations) != 1 ||
+		len(records.Insulin) != 2 || len(records.Carbs) != 2 {
+		t.Fatalf("expected 3 glucose, 1 calibration, 2 insulin and 2 carbs, got %d, %d, %d and %d",
+			len(records.Glucose), len(records.Calibrations), len(records.Insulin), len(records.Carbs))
+	}
+	for i, want := range []float64{120, lowGlucose, highGlucose} {
+		if got := records.Glucose[i].Value; got != want {
+			t.Errorf("glucose %d: expected %v, got %v", i, want, got)
+		}
+	}
+	if got := records.Calibrations[0].Value; got != 110 {
+		t.Errorf("expected calibration of 110, got %v", got)
+	}
+	if got := records.Carbs[0].Value; got != 45 {
+		t.Errorf("expected 45g of carbs, got %d", got)
+	}
+	if got := records.Carbs[1].Value; got != 13 || records.Rounded != 1 {
+		t.Errorf("expected 12.5g of carbs to be rounded to 13, got %d with %d rounded", got, records.Rounded)
+	}
+}
+
+func TestParseFractionalInsulin(t *testing.T) {
+	records, err := Parse(loadFixture(t), time.UTC, testInsulin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The 0.5u dose is left out, and listed, instead of being rounded.
+	for _, ins := range records.Insulin {
+		if ins.Time.Equal(time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)) {
+			t.Errorf("expected the fractional dose to be left out, got %+v", ins)
+		}
+	}
+	if len(records.Unimported) != 1 {
+		t.Fatalf("expected 1 unimported row, got %+v", records.Unimported)
+	}
+	if row := records.Unimported[0]; row.Line != 12 || row.Reason != "fractional insulin dose of 0.5u" {
+		t.Errorf("expected line 12 to be the fractional dose, got %+v", row)
+	}
+}
+
+func TestParseInsulinTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		insulin []config.InsulinConfig
+		types   []string
+	}{
+		{name: "configured", insulin: testInsulin, types: []string{"Humalog", "Tresiba"}},
+		{name: "not configured", types: []string{"Fast-Acting", "Long-Acting"}},
+	}
+	for _, tt := range tests {
+		records, err := Parse(loadFixture(t), time.UTC, tt.insulin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range tt.types {
+			if got := records.Insulin[i].Type; got != want {
+				t.Errorf("%s: expected insulin %d to be %s, got %s", tt.name, i, want, got)
+			}
+		}
+		if got := records.Insulin[0].Value; got != 4 {
+			t.Errorf("%s: expected a 4u dose, got %d", tt.name, got)
+		}
+	}
+}
+
+func TestParseTimezone(t *testing.T) {
+	loc := toronto(t)
+	records, err := Parse(loadFixture(t), loc, testInsulin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The export spans the switch to daylight saving time.
+	tests := []struct {
+		want   time.Time
+		offset int
+	}{
+		{want: time.Date(2024, 3, 10, 6, 55, 0, 0, time.UTC), offset: -5 * 3600},
+		{want: time.Date(2024, 3, 10, 7, 0, 0, 0, time.UTC), offset: -4 * 3600},
+	}
+	for i, tt := range tests {
+		gp := records.Glucose[i]
+		if !gp.Time.Equal(tt.want) {
+			t.Errorf("glucose %d: expected %s, got %s", i, tt.want, gp.Time.UTC())
+		}
+		if gp.UTCOffset != tt.offset {
+			t.Errorf("glucose %d: expected offset %d, got %d", i, tt.offset, gp.UTCOffset)
+		}
+	}
+}
+
+func TestParseGlucose(t *testing.T) {
+	tests := []struct {
+		in      string
+		mmol    bool
+		want    float64
+		wantErr bool
+	}{
+		{in: "120", want: 120},
+		{in: "Low", want: lowGlucose},
+		{in: "HIGH", want: highGlucose},
+		{in: "6.7", mmol: true, want: 121},
+		{in: "Low", mmol: true, want: lowGlucose},
+		{in: "", wantErr: true},
+		{in: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseGlucose(tt.in, tt.mmol)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: expected error %v, got %v", tt.in, tt.wantErr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: expected %v, got %v", tt.in, tt.want, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+	}{
+		{name: "empty", csv: ""},
+		{name: "missing column", csv: "Index,Timestamp (YYYY-MM-DDThh:mm:ss),Event Type\n"},
+		{name: "bad timestamp", csv: testHeader + "1,03/10/2024 07:30,EGV,,120,,\n"},
+		{name: "bad glucose", csv: testHeader + "1,2024-03-10T07:30:00,EGV,,abc,,\n"},
+		{name: "bad insulin", csv: testHeader + "1,2024-03-10T07:30:00,Insulin,Fast-Acting,,abc,\n"},
+		{name: "bad carbs", csv: testHeader + "1,2024-03-10T07:30:00,Carbs,,,,abc\n"},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(strings.NewReader(tt.csv), time.UTC, nil); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestImportSkipsDuplicates(t *testing.T) {
+	loc := toronto(t)
+	st := store.NewMemoryStore()
+	im := NewImporter(st, testInsulin, zap.NewNop())
+
+	// Already recorded by the poller, a minute off from the export.
+	err := st.WriteGlucosePoints([]store.GlucosePoint{
+		{Value: 121, Time: time.Date(2024, 3, 10, 1, 56, 0, 0, loc)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want Result
+	}{
+		{name: "first import", want: Result{Glucose: 2, Insulin: 2, Carbs: 2, Calibrations: 1, Skipped: 1, Rounded: 1}},
+		{name: "second import", want: Result{Skipped: 8, Rounded: 1}},
+	}
+	for _, tt := range tests {
+		got, err := im.Import(loadFixture(t), loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Unimported) != 1 {
+			t.Errorf("%s: expected the fractional dose to be listed, got %+v", tt.name, got.Unimported)
+		}
+		got.Unimported = nil
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("%s: expected %+v, got %+v", tt.name, tt.want, *got)
+		}
+	}
+}